@@ -45,12 +45,12 @@ func main() {
 				NoIndent: true,
 			}))
 
-			httpServer, err := api.Prepare(ctx, &cfg, logger)
+			httpServer, tokenBackend, err := api.Prepare(ctx, &cfg, logger)
 			if err != nil {
 				return fmt.Errorf("api.Prepare: %w", err)
 			}
 
-			if err := api.Run(ctx, &cfg, logger, signals, httpServer); err != nil {
+			if err := api.Run(ctx, &cfg, logger, signals, httpServer, tokenBackend); err != nil {
 				return fmt.Errorf("api.Run: %w", err)
 			}
 
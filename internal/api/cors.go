@@ -0,0 +1,88 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pegov/fauth-backend-go/internal/config"
+)
+
+var ErrCORSWildcardWithCredentials = errors.New("cors origin * can't be used with credentials")
+
+func checkCORSConfig(cfg *config.Config) error {
+	if cfg.HTTP.CORSAllowCredentials && slices.Contains(cfg.HTTP.CORSAllowedOrigins, "*") {
+		return ErrCORSWildcardWithCredentials
+	}
+
+	return nil
+}
+
+// NewCORSMiddleware answers preflight requests by itself, so it must go
+// before NewSlogMiddleware. Requests from origins that are not allowed
+// get no cors headers and are blocked by browser.
+func NewCORSMiddleware(cfg *config.Config) func(http.Handler) http.Handler {
+	allowAny := slices.Contains(cfg.HTTP.CORSAllowedOrigins, "*")
+	allowedOrigins := make([]string, 0, len(cfg.HTTP.CORSAllowedOrigins))
+	for _, origin := range cfg.HTTP.CORSAllowedOrigins {
+		if origin = normalizeOrigin(origin); origin != "" {
+			allowedOrigins = append(allowedOrigins, origin)
+		}
+	}
+
+	allowedMethods := strings.Join(cfg.HTTP.CORSAllowedMethods, ", ")
+	allowedHeaders := strings.Join(cfg.HTTP.CORSAllowedHeaders, ", ")
+	maxAge := strconv.Itoa(cfg.HTTP.CORSMaxAge)
+
+	return func(next http.Handler) http.Handler {
+		if !allowAny && len(allowedOrigins) == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			isPreflight := r.Method == http.MethodOptions &&
+				r.Header.Get("Access-Control-Request-Method") != ""
+
+			h := w.Header()
+			h.Add("Vary", "Origin")
+			if isPreflight {
+				h.Add("Vary", "Access-Control-Request-Method")
+				h.Add("Vary", "Access-Control-Request-Headers")
+			}
+
+			allowed := allowAny || slices.Contains(allowedOrigins, normalizeOrigin(origin))
+			if allowed {
+				if allowAny {
+					h.Set("Access-Control-Allow-Origin", "*")
+				} else {
+					h.Set("Access-Control-Allow-Origin", origin)
+				}
+
+				if cfg.HTTP.CORSAllowCredentials {
+					h.Set("Access-Control-Allow-Credentials", "true")
+				}
+			}
+
+			if !isPreflight {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if allowed {
+				h.Set("Access-Control-Allow-Methods", allowedMethods)
+				h.Set("Access-Control-Allow-Headers", allowedHeaders)
+				h.Set("Access-Control-Max-Age", maxAge)
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package api
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ovechkin-dm/mockio/v2/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pegov/fauth-backend-go/internal/api/handler"
+	"github.com/pegov/fauth-backend-go/internal/config"
+	"github.com/pegov/fauth-backend-go/internal/model"
+	"github.com/pegov/fauth-backend-go/internal/service"
+)
+
+func newCORSConfig(origins ...string) *config.Config {
+	cfg := newTestConfig()
+	cfg.HTTP.CORSAllowedOrigins = origins
+	cfg.HTTP.CORSAllowCredentials = true
+	cfg.HTTP.CORSAllowedMethods = []string{"GET", "POST"}
+	cfg.HTTP.CORSAllowedHeaders = []string{"Content-Type", "Authorization"}
+	cfg.HTTP.CORSMaxAge = 600
+	return cfg
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	tests := []struct {
+		name        string
+		origins     []string
+		preflight   bool
+		origin      string
+		allowOrigin string
+		nextCalled  bool
+	}{
+		{"preflight allowed", []string{"https://app.example.com"}, true, "https://app.example.com", "https://app.example.com", false},
+		{"preflight disallowed", []string{"https://app.example.com"}, true, "https://evil.com", "", false},
+		{"request allowed", []string{"https://app.example.com"}, false, "https://app.example.com", "https://app.example.com", true},
+		{"request disallowed", []string{"https://app.example.com"}, false, "https://evil.com", "", true},
+		{"no origin", []string{"https://app.example.com"}, false, "", "", true},
+		{"cors disabled", nil, true, "https://app.example.com", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var nextCalled bool
+			h := NewCORSMiddleware(newCORSConfig(tt.origins...))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				nextCalled = true
+			}))
+
+			r := httptest.NewRequest(http.MethodPost, "/login", nil)
+			if tt.preflight {
+				r.Method = http.MethodOptions
+				r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			}
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			require.Equal(t, tt.nextCalled, nextCalled)
+			require.Equal(t, tt.allowOrigin, w.Header().Get("Access-Control-Allow-Origin"))
+			if tt.allowOrigin != "" {
+				require.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+			} else {
+				require.Empty(t, w.Header().Get("Access-Control-Allow-Credentials"))
+			}
+
+			if tt.origins == nil || tt.origin == "" {
+				require.Empty(t, w.Header().Values("Vary"))
+				return
+			}
+
+			// responses depend on origin, caches must not mix them
+			require.Contains(t, w.Header().Values("Vary"), "Origin")
+			if !tt.preflight {
+				return
+			}
+
+			require.Equal(t, http.StatusNoContent, w.Code)
+			require.Contains(t, w.Header().Values("Vary"), "Access-Control-Request-Method")
+			require.Contains(t, w.Header().Values("Vary"), "Access-Control-Request-Headers")
+			if tt.allowOrigin != "" {
+				require.Equal(t, "GET, POST", w.Header().Get("Access-Control-Allow-Methods"))
+				require.Equal(t, "Content-Type, Authorization", w.Header().Get("Access-Control-Allow-Headers"))
+				require.Equal(t, "600", w.Header().Get("Access-Control-Max-Age"))
+			} else {
+				require.Empty(t, w.Header().Get("Access-Control-Allow-Methods"))
+			}
+		})
+	}
+}
+
+func TestCORSMiddlewareWildcard(t *testing.T) {
+	cfg := newCORSConfig("*")
+	cfg.HTTP.CORSAllowCredentials = false
+	h := NewCORSMiddleware(cfg)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	r := httptest.NewRequest(http.MethodGet, "/me", nil)
+	r.Header.Set("Origin", "https://any.example.com")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	require.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+	require.Empty(t, w.Header().Get("Access-Control-Allow-Credentials"))
+}
+
+func TestCORSPreflightNotLogged(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	srv := newTestServer(t, newCORSConfig("https://app.example.com"), logger)
+
+	r := httptest.NewRequest(http.MethodOptions, "/api/v1/users/login", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusNoContent, w.Code)
+	require.Empty(t, buf.String())
+
+	// other requests are still logged
+	r = httptest.NewRequest(http.MethodGet, "/ping", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	srv.ServeHTTP(httptest.NewRecorder(), r)
+	require.NotEmpty(t, buf.String())
+}
+
+func TestCORSOriginPassesCSRF(t *testing.T) {
+	cfg := newCORSConfig("https://app.example.com")
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	srv := newTestServer(t, cfg, logger)
+	mock.WhenDouble(srv.authService.RefreshToken(mock.AnyContext(), mock.Exact("refresh"))).
+		ThenReturn(&service.Tokens{Access: "access", Refresh: "refresh"}, nil)
+
+	// cross-origin frontend allowed by cors sends refresh cookie
+	r := httptest.NewRequest(http.MethodPost, model.UsersPrefix+handler.RefreshTokenRoute, nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	r.AddCookie(&http.Cookie{Name: "refresh", Value: "refresh"})
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+
+	r = httptest.NewRequest(http.MethodPost, model.UsersPrefix+handler.RefreshTokenRoute, nil)
+	r.Header.Set("Origin", "https://evil.com")
+	r.AddCookie(&http.Cookie{Name: "refresh", Value: "refresh"})
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusForbidden, w.Code)
+	mock.Verify(srv.authService, mock.Once()).RefreshToken(mock.AnyContext(), mock.Exact("refresh"))
+}
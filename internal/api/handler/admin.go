@@ -7,7 +7,9 @@ import (
 
 	"github.com/go-chi/chi/v5"
 
+	"github.com/pegov/fauth-backend-go/internal/http/bind"
 	"github.com/pegov/fauth-backend-go/internal/http/render"
+	"github.com/pegov/fauth-backend-go/internal/model"
 	"github.com/pegov/fauth-backend-go/internal/service"
 )
 
@@ -19,6 +21,12 @@ type AdminHandler interface {
 	Unban(w http.ResponseWriter, r *http.Request) error
 	Kick(w http.ResponseWriter, r *http.Request) error
 	Unkick(w http.ResponseWriter, r *http.Request) error
+	GetRoles(w http.ResponseWriter, r *http.Request) error
+	GetRole(w http.ResponseWriter, r *http.Request) error
+	CreateRole(w http.ResponseWriter, r *http.Request) error
+	UpdateRole(w http.ResponseWriter, r *http.Request) error
+	DeleteRole(w http.ResponseWriter, r *http.Request) error
+	UpdateUserRoles(w http.ResponseWriter, r *http.Request) error
 }
 
 type adminHandler struct {
@@ -67,18 +75,26 @@ func (h *adminHandler) DeactivateMassLogout(
 	return actionOnAll(w, r, h.adminService.DeactivateMassLogout)
 }
 
+func parseID(r *http.Request) (int32, error) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 32)
+	if err != nil {
+		return 0, ErrInvalidPathParamType
+	}
+
+	return int32(id), nil
+}
+
 func actionOnID(
 	w http.ResponseWriter,
 	r *http.Request,
 	action func(context.Context, int32) error,
 ) error {
-	idStr := chi.URLParam(r, "id")
-	id, err := strconv.Atoi(idStr)
+	id, err := parseID(r)
 	if err != nil {
 		return err
 	}
 
-	if err := action(r.Context(), int32(id)); err != nil {
+	if err := action(r.Context(), id); err != nil {
 		return err
 	}
 
@@ -95,9 +111,88 @@ func (h *adminHandler) Unban(w http.ResponseWriter, r *http.Request) error {
 }
 
 func (h *adminHandler) Kick(w http.ResponseWriter, r *http.Request) error {
-	return actionOnID(w, r, h.adminService.Unban)
+	return actionOnID(w, r, h.adminService.Kick)
 }
 
 func (h *adminHandler) Unkick(w http.ResponseWriter, r *http.Request) error {
-	return actionOnID(w, r, h.adminService.Unban)
+	return actionOnID(w, r, h.adminService.Unkick)
+}
+
+func (h *adminHandler) GetRoles(w http.ResponseWriter, r *http.Request) error {
+	roles, err := h.adminService.GetRoles(r.Context())
+	if err != nil {
+		return err
+	}
+
+	return render.JSON(w, http.StatusOK, roles)
+}
+
+func (h *adminHandler) GetRole(w http.ResponseWriter, r *http.Request) error {
+	id, err := parseID(r)
+	if err != nil {
+		return err
+	}
+
+	role, err := h.adminService.GetRole(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	return render.JSON(w, http.StatusOK, role)
+}
+
+func (h *adminHandler) CreateRole(w http.ResponseWriter, r *http.Request) error {
+	var request model.RoleCreate
+	if err := bind.JSON(r, &request); err != nil {
+		return err
+	}
+
+	role, err := h.adminService.CreateRole(r.Context(), &request)
+	if err != nil {
+		return err
+	}
+
+	return render.JSON(w, http.StatusCreated, role)
+}
+
+func (h *adminHandler) UpdateRole(w http.ResponseWriter, r *http.Request) error {
+	id, err := parseID(r)
+	if err != nil {
+		return err
+	}
+
+	var request model.RoleCreate
+	if err := bind.JSON(r, &request); err != nil {
+		return err
+	}
+
+	role, err := h.adminService.UpdateRole(r.Context(), id, &request)
+	if err != nil {
+		return err
+	}
+
+	return render.JSON(w, http.StatusOK, role)
+}
+
+func (h *adminHandler) DeleteRole(w http.ResponseWriter, r *http.Request) error {
+	return actionOnID(w, r, h.adminService.DeleteRole)
+}
+
+func (h *adminHandler) UpdateUserRoles(w http.ResponseWriter, r *http.Request) error {
+	id, err := parseID(r)
+	if err != nil {
+		return err
+	}
+
+	var request model.UserRolesUpdate
+	if err := bind.JSON(r, &request); err != nil {
+		return err
+	}
+
+	if err := h.adminService.UpdateUserRoles(r.Context(), id, &request); err != nil {
+		return err
+	}
+
+	render.Status(w, http.StatusOK)
+	return nil
 }
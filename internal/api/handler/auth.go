@@ -1,23 +1,45 @@
 package handler
 
 import (
+	"context"
 	"errors"
 	"net/http"
 
+	"github.com/go-chi/chi/v5"
+
 	"github.com/pegov/fauth-backend-go/internal/config"
 	"github.com/pegov/fauth-backend-go/internal/http/bind"
 	"github.com/pegov/fauth-backend-go/internal/http/render"
 	"github.com/pegov/fauth-backend-go/internal/model"
 	"github.com/pegov/fauth-backend-go/internal/service"
+	"github.com/pegov/fauth-backend-go/internal/token"
 )
 
 type AuthHandler interface {
 	Register(w http.ResponseWriter, r *http.Request) error
 	Login(w http.ResponseWriter, r *http.Request) error
+	LoginTOTP(w http.ResponseWriter, r *http.Request) error
 	Token(w http.ResponseWriter, r *http.Request) error
 	RefreshToken(w http.ResponseWriter, r *http.Request) error
 	Logout(w http.ResponseWriter, r *http.Request) error
+	LogoutAll(w http.ResponseWriter, r *http.Request) error
 	Me(w http.ResponseWriter, r *http.Request) error
+	SetupTOTP(w http.ResponseWriter, r *http.Request) error
+	ConfirmTOTP(w http.ResponseWriter, r *http.Request) error
+	RemoveTOTP(w http.ResponseWriter, r *http.Request) error
+	RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) error
+	RequestEmailVerification(w http.ResponseWriter, r *http.Request) error
+	VerifyEmail(w http.ResponseWriter, r *http.Request) error
+	RequestEmailChange(w http.ResponseWriter, r *http.Request) error
+	VerifyOldEmail(w http.ResponseWriter, r *http.Request) error
+	VerifyNewEmail(w http.ResponseWriter, r *http.Request) error
+	ForgotPassword(w http.ResponseWriter, r *http.Request) error
+	ResetPassword(w http.ResponseWriter, r *http.Request) error
+	GetPasswordStatus(w http.ResponseWriter, r *http.Request) error
+	ChangePassword(w http.ResponseWriter, r *http.Request) error
+	SetPassword(w http.ResponseWriter, r *http.Request) error
+	GetSessions(w http.ResponseWriter, r *http.Request) error
+	RevokeSession(w http.ResponseWriter, r *http.Request) error
 }
 
 type authHandler struct {
@@ -36,42 +58,6 @@ var (
 	ErrInvalidPathParamType = errors.New("invalid path param type")
 )
 
-func (h *authHandler) setCookie(
-	w http.ResponseWriter,
-	name, value string,
-) {
-	http.SetCookie(w, &http.Cookie{
-		Name:     name,
-		Value:    value,
-		Path:     "/",
-		Domain:   h.cfg.HTTP.Domain,
-		MaxAge:   h.cfg.App.AccessTokenExpiration,
-		Secure:   h.cfg.HTTP.Secure,
-		HttpOnly: true,
-	})
-}
-
-func (h *authHandler) unsetCookie(w http.ResponseWriter, name string) {
-	http.SetCookie(w, &http.Cookie{
-		Name:     name,
-		Value:    "",
-		Path:     "/",
-		Domain:   h.cfg.HTTP.Domain,
-		MaxAge:   -1,
-		Secure:   h.cfg.HTTP.Secure,
-		HttpOnly: true,
-	})
-}
-
-func (h *authHandler) setCookies(
-	w http.ResponseWriter,
-	accessToken,
-	refreshToken string,
-) {
-	h.setCookie(w, h.cfg.App.AccessTokenCookieName, accessToken)
-	h.setCookie(w, h.cfg.App.RefreshTokenCookieName, refreshToken)
-}
-
 func (h *authHandler) Register(w http.ResponseWriter, r *http.Request) error {
 	var request *model.RegisterRequest
 	if err := bind.JSON(r, &request); err != nil {
@@ -83,8 +69,7 @@ func (h *authHandler) Register(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
-	h.setCookies(w, tokens.Access, tokens.Refresh)
-	return nil
+	return h.writeTokens(w, tokens, wantsTokensInBody(r))
 }
 
 func (h *authHandler) Login(w http.ResponseWriter, r *http.Request) error {
@@ -93,26 +78,74 @@ func (h *authHandler) Login(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
-	tokens, err := h.authService.Login(r.Context(), request)
+	result, err := h.authService.Login(r.Context(), request)
 	if err != nil {
 		return err
 	}
 
-	h.setCookies(w, tokens.Access, tokens.Refresh)
-	return nil
+	if result.MFAToken != "" {
+		return render.JSON(w, http.StatusOK, model.MFAChallenge{
+			MFARequired: true,
+			Token:       result.MFAToken,
+		})
+	}
+
+	return h.writeTokens(w, result.Tokens, wantsTokensInBody(r))
 }
 
-var (
-	ErrNoTokenCookie = errors.New("no token cookie error")
-)
+func (h *authHandler) LoginTOTP(w http.ResponseWriter, r *http.Request) error {
+	var request *model.LoginTOTPRequest
+	if err := bind.JSON(r, &request); err != nil {
+		return err
+	}
 
-func (h *authHandler) Token(w http.ResponseWriter, r *http.Request) error {
-	v, err := r.Cookie(h.cfg.App.AccessTokenCookieName)
+	tokens, err := h.authService.LoginTOTP(r.Context(), request)
 	if err != nil {
-		return ErrNoTokenCookie
+		return err
+	}
+
+	return h.writeTokens(w, tokens, wantsTokensInBody(r))
+}
+
+// writeTokens sets cookies for browsers, clients that can't use cookies
+// get tokens in body (see wantsTokensInBody).
+func (h *authHandler) writeTokens(
+	w http.ResponseWriter,
+	tokens *service.Tokens,
+	inBody bool,
+) error {
+	if inBody {
+		return render.JSON(w, http.StatusOK, model.TokensResponse{
+			AccessToken:  tokens.Access,
+			RefreshToken: tokens.Refresh,
+			TokenType:    "Bearer",
+			ExpiresIn:    h.cfg.App.AccessTokenExpiration,
+		})
 	}
 
-	user, err := h.authService.Token(r.Context(), v.String())
+	setTokenCookies(w, h.cfg, tokens.Access, tokens.Refresh)
+	return nil
+}
+
+func getCurrentUser(
+	r *http.Request,
+	cfg *config.Config,
+	authService service.AuthService,
+) (*token.User, error) {
+	accessToken, err := AccessToken(r, AccessTokenCookieName(cfg))
+	if err != nil {
+		return nil, err
+	}
+
+	return authService.Token(r.Context(), accessToken)
+}
+
+func (h *authHandler) currentUser(r *http.Request) (*token.User, error) {
+	return getCurrentUser(r, h.cfg, h.authService)
+}
+
+func (h *authHandler) Token(w http.ResponseWriter, r *http.Request) error {
+	user, err := h.currentUser(r)
 	if err != nil {
 		return err
 	}
@@ -120,34 +153,59 @@ func (h *authHandler) Token(w http.ResponseWriter, r *http.Request) error {
 	return render.JSON(w, http.StatusOK, user)
 }
 
+// RefreshToken takes refresh token from "Authorization: Bearer" header
+// or cookie, new tokens are returned the same way they came.
 func (h *authHandler) RefreshToken(w http.ResponseWriter, r *http.Request) error {
-	v, err := r.Cookie(h.cfg.App.RefreshTokenCookieName)
+	refreshToken, err := requestToken(r, RefreshTokenCookieName(h.cfg))
 	if err != nil {
-		return ErrNoTokenCookie
+		return err
 	}
 
-	accessToken, err := h.authService.RefreshToken(r.Context(), v.String())
+	tokens, err := h.authService.RefreshToken(r.Context(), refreshToken)
 	if err != nil {
 		return err
 	}
 
-	h.setCookie(w, h.cfg.App.AccessTokenCookieName, accessToken)
-	return nil
+	inBody := wantsTokensInBody(r) || r.Header.Get("Authorization") != ""
+	return h.writeTokens(w, tokens, inBody)
 }
 
+// Logout takes refresh token the same way as RefreshToken, header may
+// carry access token as well. It is mounted at RevokeTokenRoute, where
+// browsers send refresh cookie, and at old "/logout", where they don't;
+// without refresh token session is taken from access token.
 func (h *authHandler) Logout(w http.ResponseWriter, r *http.Request) error {
-	h.unsetCookie(w, h.cfg.App.AccessTokenCookieName)
-	h.unsetCookie(w, h.cfg.App.RefreshTokenCookieName)
+	if refreshToken, err := requestToken(r, RefreshTokenCookieName(h.cfg)); err == nil {
+		if err := h.authService.Logout(r.Context(), refreshToken); err != nil {
+			return err
+		}
+	} else if user, err := h.currentUser(r); err == nil && user.SessionID != "" {
+		err := h.authService.RevokeSession(r.Context(), user.ID, user.SessionID)
+		if err != nil && !errors.Is(err, service.ErrSessionNotFound) {
+			return err
+		}
+	}
+
+	unsetTokenCookies(w, h.cfg)
 	return nil
 }
 
-func (h *authHandler) Me(w http.ResponseWriter, r *http.Request) error {
-	v, err := r.Cookie(h.cfg.App.AccessTokenCookieName)
+func (h *authHandler) LogoutAll(w http.ResponseWriter, r *http.Request) error {
+	user, err := h.currentUser(r)
 	if err != nil {
-		return ErrNoTokenCookie
+		return err
 	}
 
-	tokenPayload, err := h.authService.Token(r.Context(), v.String())
+	if err := h.authService.LogoutAll(r.Context(), user.ID); err != nil {
+		return err
+	}
+
+	unsetTokenCookies(w, h.cfg)
+	return nil
+}
+
+func (h *authHandler) Me(w http.ResponseWriter, r *http.Request) error {
+	tokenPayload, err := h.currentUser(r)
 	if err != nil {
 		return err
 	}
@@ -159,3 +217,251 @@ func (h *authHandler) Me(w http.ResponseWriter, r *http.Request) error {
 
 	return render.JSON(w, http.StatusOK, me)
 }
+
+func (h *authHandler) SetupTOTP(w http.ResponseWriter, r *http.Request) error {
+	user, err := h.currentUser(r)
+	if err != nil {
+		return err
+	}
+
+	setup, err := h.authService.SetupTOTP(r.Context(), user.ID)
+	if err != nil {
+		return err
+	}
+
+	return render.JSON(w, http.StatusOK, setup)
+}
+
+func (h *authHandler) ConfirmTOTP(w http.ResponseWriter, r *http.Request) error {
+	user, err := h.currentUser(r)
+	if err != nil {
+		return err
+	}
+
+	var request *model.TOTPCodeRequest
+	if err := bind.JSON(r, &request); err != nil {
+		return err
+	}
+
+	codes, err := h.authService.ConfirmTOTP(r.Context(), user.ID, request)
+	if err != nil {
+		return err
+	}
+
+	return render.JSON(w, http.StatusOK, codes)
+}
+
+func (h *authHandler) RemoveTOTP(w http.ResponseWriter, r *http.Request) error {
+	user, err := h.currentUser(r)
+	if err != nil {
+		return err
+	}
+
+	var request *model.TOTPCodeRequest
+	if err := bind.JSON(r, &request); err != nil {
+		return err
+	}
+
+	if err := h.authService.RemoveTOTP(r.Context(), user.ID, request); err != nil {
+		return err
+	}
+
+	render.Status(w, http.StatusOK)
+	return nil
+}
+
+func (h *authHandler) RegenerateRecoveryCodes(
+	w http.ResponseWriter,
+	r *http.Request,
+) error {
+	user, err := h.currentUser(r)
+	if err != nil {
+		return err
+	}
+
+	var request *model.TOTPCodeRequest
+	if err := bind.JSON(r, &request); err != nil {
+		return err
+	}
+
+	codes, err := h.authService.RegenerateRecoveryCodes(r.Context(), user.ID, request)
+	if err != nil {
+		return err
+	}
+
+	return render.JSON(w, http.StatusOK, codes)
+}
+
+func (h *authHandler) RequestEmailVerification(
+	w http.ResponseWriter,
+	r *http.Request,
+) error {
+	user, err := h.currentUser(r)
+	if err != nil {
+		return err
+	}
+
+	if err := h.authService.RequestEmailVerification(r.Context(), user.ID); err != nil {
+		return err
+	}
+
+	render.Status(w, http.StatusOK)
+	return nil
+}
+
+func actionOnToken(
+	w http.ResponseWriter,
+	r *http.Request,
+	action func(context.Context, *model.TokenRequest) error,
+) error {
+	var request *model.TokenRequest
+	if err := bind.JSON(r, &request); err != nil {
+		return err
+	}
+
+	if err := action(r.Context(), request); err != nil {
+		return err
+	}
+
+	render.Status(w, http.StatusOK)
+	return nil
+}
+
+func (h *authHandler) VerifyEmail(w http.ResponseWriter, r *http.Request) error {
+	return actionOnToken(w, r, h.authService.VerifyEmail)
+}
+
+func (h *authHandler) RequestEmailChange(w http.ResponseWriter, r *http.Request) error {
+	user, err := h.currentUser(r)
+	if err != nil {
+		return err
+	}
+
+	var request *model.EmailChangeRequest
+	if err := bind.JSON(r, &request); err != nil {
+		return err
+	}
+
+	if err := h.authService.RequestEmailChange(r.Context(), user.ID, request); err != nil {
+		return err
+	}
+
+	render.Status(w, http.StatusOK)
+	return nil
+}
+
+func (h *authHandler) VerifyOldEmail(w http.ResponseWriter, r *http.Request) error {
+	return actionOnToken(w, r, h.authService.VerifyOldEmail)
+}
+
+func (h *authHandler) VerifyNewEmail(w http.ResponseWriter, r *http.Request) error {
+	return actionOnToken(w, r, h.authService.VerifyNewEmail)
+}
+
+func (h *authHandler) ForgotPassword(w http.ResponseWriter, r *http.Request) error {
+	var request *model.ForgotPasswordRequest
+	if err := bind.JSON(r, &request); err != nil {
+		return err
+	}
+
+	if err := h.authService.ForgotPassword(r.Context(), request); err != nil {
+		return err
+	}
+
+	render.Status(w, http.StatusOK)
+	return nil
+}
+
+func (h *authHandler) ResetPassword(w http.ResponseWriter, r *http.Request) error {
+	var request *model.ResetPasswordRequest
+	if err := bind.JSON(r, &request); err != nil {
+		return err
+	}
+
+	if err := h.authService.ResetPassword(r.Context(), request); err != nil {
+		return err
+	}
+
+	render.Status(w, http.StatusOK)
+	return nil
+}
+
+func (h *authHandler) GetPasswordStatus(w http.ResponseWriter, r *http.Request) error {
+	user, err := h.currentUser(r)
+	if err != nil {
+		return err
+	}
+
+	status, err := h.authService.GetPasswordStatus(r.Context(), user.ID)
+	if err != nil {
+		return err
+	}
+
+	return render.JSON(w, http.StatusOK, status)
+}
+
+func (h *authHandler) ChangePassword(w http.ResponseWriter, r *http.Request) error {
+	user, err := h.currentUser(r)
+	if err != nil {
+		return err
+	}
+
+	var request *model.ChangePasswordRequest
+	if err := bind.JSON(r, &request); err != nil {
+		return err
+	}
+
+	if err := h.authService.ChangePassword(r.Context(), user.ID, request); err != nil {
+		return err
+	}
+
+	render.Status(w, http.StatusOK)
+	return nil
+}
+
+func (h *authHandler) SetPassword(w http.ResponseWriter, r *http.Request) error {
+	user, err := h.currentUser(r)
+	if err != nil {
+		return err
+	}
+
+	var request *model.SetPasswordRequest
+	if err := bind.JSON(r, &request); err != nil {
+		return err
+	}
+
+	if err := h.authService.SetPassword(r.Context(), user.ID, request); err != nil {
+		return err
+	}
+
+	render.Status(w, http.StatusOK)
+	return nil
+}
+
+func (h *authHandler) GetSessions(w http.ResponseWriter, r *http.Request) error {
+	user, err := h.currentUser(r)
+	if err != nil {
+		return err
+	}
+
+	sessions, err := h.authService.GetSessions(r.Context(), user.ID, user.SessionID)
+	if err != nil {
+		return err
+	}
+
+	return render.JSON(w, http.StatusOK, sessions)
+}
+
+func (h *authHandler) RevokeSession(w http.ResponseWriter, r *http.Request) error {
+	user, err := h.currentUser(r)
+	if err != nil {
+		return err
+	}
+
+	if err := h.authService.RevokeSession(r.Context(), user.ID, chi.URLParam(r, "id")); err != nil {
+		return err
+	}
+
+	render.Status(w, http.StatusOK)
+	return nil
+}
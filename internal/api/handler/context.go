@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/pegov/fauth-backend-go/internal/token"
+)
+
+type contextKey int
+
+const userContextKey contextKey = iota
+
+var (
+	ErrNoToken   = errors.New("no token error")
+	ErrForbidden = errors.New("forbidden")
+)
+
+func ContextWithUser(ctx context.Context, user *token.User) context.Context {
+	return context.WithValue(ctx, userContextKey, user)
+}
+
+// UserFromContext returns user put into context by auth middleware.
+func UserFromContext(ctx context.Context) (*token.User, bool) {
+	user, ok := ctx.Value(userContextKey).(*token.User)
+	return user, ok
+}
+
+// AccessToken returns token from "Authorization: Bearer" header,
+// falling back to cookie.
+func AccessToken(r *http.Request, cookieName string) (string, error) {
+	return requestToken(r, cookieName)
+}
+
+// requestToken is used for both access and refresh tokens,
+// clients without cookies send the one that endpoint expects.
+func requestToken(r *http.Request, cookieName string) (string, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, value, ok := strings.Cut(header, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(value) == "" {
+			return "", ErrNoToken
+		}
+
+		return strings.TrimSpace(value), nil
+	}
+
+	v, err := r.Cookie(cookieName)
+	if err != nil || v.Value == "" {
+		return "", ErrNoToken
+	}
+
+	return v.Value, nil
+}
+
+const (
+	TokenDeliveryHeader = "X-Token-Delivery"
+	TokenDeliveryQuery  = "token_delivery"
+	TokenDeliveryBody   = "body"
+)
+
+// wantsTokensInBody reports whether client asked for tokens in response body
+// instead of cookies, with header or query flag.
+func wantsTokensInBody(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get(TokenDeliveryHeader), TokenDeliveryBody) ||
+		strings.EqualFold(r.URL.Query().Get(TokenDeliveryQuery), TokenDeliveryBody)
+}
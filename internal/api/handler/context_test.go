@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestToken(t *testing.T) {
+	tests := []struct {
+		name          string
+		authorization string
+		cookie        *http.Cookie
+		expected      string
+	}{
+		{"bearer", "Bearer token", nil, "token"},
+		{"scheme case insensitive", "bEARER token", nil, "token"},
+		{"spaces around token", "Bearer  token ", nil, "token"},
+		{"other scheme", "Basic token", nil, ""},
+		{"no scheme", "token", nil, ""},
+		{"empty token", "Bearer ", nil, ""},
+		{"cookie", "", &http.Cookie{Name: "access", Value: "cookie"}, "cookie"},
+		{"empty cookie", "", &http.Cookie{Name: "access", Value: ""}, ""},
+		{"cookie of other name", "", &http.Cookie{Name: "refresh", Value: "cookie"}, ""},
+		{"header preferred over cookie", "Bearer token", &http.Cookie{Name: "access", Value: "cookie"}, "token"},
+		// invalid header is not replaced with cookie
+		{"invalid header with cookie", "Bearer", &http.Cookie{Name: "access", Value: "cookie"}, ""},
+		{"nothing", "", nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			if tt.cookie != nil {
+				r.AddCookie(tt.cookie)
+			}
+
+			value, err := AccessToken(r, "access")
+			if tt.expected == "" {
+				require.ErrorIs(t, err, ErrNoToken)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, value)
+		})
+	}
+}
+
+func TestWantsTokensInBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		target   string
+		header   string
+		expected bool
+	}{
+		{"default", "/", "", false},
+		{"query", "/?token_delivery=body", "", true},
+		{"query case insensitive", "/?token_delivery=BODY", "", true},
+		{"query other value", "/?token_delivery=cookie", "", false},
+		{"other query key", "/?tokens=body", "", false},
+		{"header", "/", "body", true},
+		{"header case insensitive", "/", "Body", true},
+		{"header other value", "/", "cookie", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, tt.target, nil)
+			if tt.header != "" {
+				r.Header.Set(TokenDeliveryHeader, tt.header)
+			}
+
+			require.Equal(t, tt.expected, wantsTokensInBody(r))
+		})
+	}
+}
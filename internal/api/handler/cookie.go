@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/pegov/fauth-backend-go/internal/config"
+	"github.com/pegov/fauth-backend-go/internal/model"
+)
+
+const (
+	RefreshTokenRoute = "/token/refresh"
+	// RevokeTokenRoute is below refresh route, so refresh cookie scoped to
+	// it is sent to revoke as well.
+	RevokeTokenRoute = RefreshTokenRoute + "/revoke"
+)
+
+// RefreshTokenCookiePath limits refresh cookie to refresh endpoint (and
+// revoke below it), so it is not sent with every request.
+const RefreshTokenCookiePath = model.UsersPrefix + RefreshTokenRoute
+
+const (
+	hostCookiePrefix   = "__Host-"
+	secureCookiePrefix = "__Secure-"
+)
+
+var (
+	ErrInvalidSameSite       = errors.New("invalid same site, must be strict, lax or none")
+	ErrSameSiteNoneNotSecure = errors.New("same site none requires secure cookies")
+	ErrCookiePrefixNotSecure = errors.New("cookie prefix requires secure cookies")
+)
+
+func parseSameSite(value string) (http.SameSite, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	default:
+		return http.SameSiteDefaultMode, ErrInvalidSameSite
+	}
+}
+
+// CheckCookieConfig returns error for combinations that browsers reject.
+func CheckCookieConfig(cfg *config.Config) error {
+	sameSite, err := parseSameSite(cfg.HTTP.SameSite)
+	if err != nil {
+		return err
+	}
+
+	if sameSite == http.SameSiteNoneMode && !cfg.HTTP.Secure {
+		return ErrSameSiteNoneNotSecure
+	}
+
+	if cfg.HTTP.CookiePrefix && !cfg.HTTP.Secure {
+		return ErrCookiePrefixNotSecure
+	}
+
+	return nil
+}
+
+// AccessTokenCookieName has __Host- prefix if enabled, such cookie
+// is always host-only, secure and scoped to "/".
+func AccessTokenCookieName(cfg *config.Config) string {
+	if cfg.HTTP.CookiePrefix {
+		return hostCookiePrefix + cfg.App.AccessTokenCookieName
+	}
+
+	return cfg.App.AccessTokenCookieName
+}
+
+// RefreshTokenCookieName has __Secure- prefix if enabled, __Host- can't
+// be used since refresh cookie has its own path.
+func RefreshTokenCookieName(cfg *config.Config) string {
+	if cfg.HTTP.CookiePrefix {
+		return secureCookiePrefix + cfg.App.RefreshTokenCookieName
+	}
+
+	return cfg.App.RefreshTokenCookieName
+}
+
+type cookieOptions struct {
+	name   string
+	path   string
+	domain string
+	maxAge int
+}
+
+func accessCookieOptions(cfg *config.Config) cookieOptions {
+	options := cookieOptions{
+		name:   AccessTokenCookieName(cfg),
+		path:   "/",
+		domain: cfg.HTTP.Domain,
+		maxAge: cfg.App.AccessTokenExpiration,
+	}
+	if cfg.HTTP.CookiePrefix {
+		options.domain = ""
+	}
+
+	return options
+}
+
+func refreshCookieOptions(cfg *config.Config) cookieOptions {
+	return cookieOptions{
+		name:   RefreshTokenCookieName(cfg),
+		path:   RefreshTokenCookiePath,
+		domain: cfg.HTTP.Domain,
+		maxAge: cfg.App.RefreshTokenExpiration,
+	}
+}
+
+func setCookie(
+	w http.ResponseWriter,
+	cfg *config.Config,
+	options cookieOptions,
+	value string,
+) {
+	// config is checked on startup
+	sameSite, _ := parseSameSite(cfg.HTTP.SameSite)
+	http.SetCookie(w, &http.Cookie{
+		Name:     options.name,
+		Value:    value,
+		Path:     options.path,
+		Domain:   options.domain,
+		MaxAge:   options.maxAge,
+		Secure:   cfg.HTTP.Secure,
+		HttpOnly: true,
+		SameSite: sameSite,
+	})
+}
+
+func unsetCookie(w http.ResponseWriter, cfg *config.Config, options cookieOptions) {
+	options.maxAge = -1
+	setCookie(w, cfg, options, "")
+}
+
+// rootRefreshCookieOptions is refresh cookie as it used to be set, without
+// prefix and scoped to "/". Browsers would keep sending such cookie to
+// every endpoint next to the new one, so it is expired.
+func rootRefreshCookieOptions(cfg *config.Config) cookieOptions {
+	return cookieOptions{
+		name:   cfg.App.RefreshTokenCookieName,
+		path:   "/",
+		domain: cfg.HTTP.Domain,
+	}
+}
+
+func setTokenCookies(
+	w http.ResponseWriter,
+	cfg *config.Config,
+	accessToken,
+	refreshToken string,
+) {
+	setCookie(w, cfg, accessCookieOptions(cfg), accessToken)
+	setCookie(w, cfg, refreshCookieOptions(cfg), refreshToken)
+	unsetCookie(w, cfg, rootRefreshCookieOptions(cfg))
+}
+
+func unsetTokenCookies(w http.ResponseWriter, cfg *config.Config) {
+	unsetCookie(w, cfg, accessCookieOptions(cfg))
+	unsetCookie(w, cfg, refreshCookieOptions(cfg))
+	unsetCookie(w, cfg, rootRefreshCookieOptions(cfg))
+}
@@ -0,0 +1,32 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/pegov/fauth-backend-go/internal/http/render"
+	"github.com/pegov/fauth-backend-go/internal/token"
+)
+
+// JWKSMaxAge is how long resource servers may cache keys,
+// new signing key must be published at least that long before use.
+const JWKSMaxAge = 60 * 60
+
+type JWKSHandler interface {
+	JWKS(w http.ResponseWriter, r *http.Request) error
+}
+
+type jwksHandler struct {
+	tokenBackend token.JwtBackend
+}
+
+func NewJWKSHandler(tokenBackend token.JwtBackend) JWKSHandler {
+	return &jwksHandler{
+		tokenBackend: tokenBackend,
+	}
+}
+
+func (h *jwksHandler) JWKS(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", JWKSMaxAge))
+	return render.JSON(w, http.StatusOK, h.tokenBackend.JWKS())
+}
@@ -2,21 +2,155 @@ package handler
 
 import (
 	"net/http"
+	"net/url"
 
+	"github.com/go-chi/chi/v5"
+
+	"github.com/pegov/fauth-backend-go/internal/config"
+	"github.com/pegov/fauth-backend-go/internal/http/render"
 	"github.com/pegov/fauth-backend-go/internal/service"
 )
 
 type OAuthHandler interface {
 	Login(w http.ResponseWriter, r *http.Request) error
+	Link(w http.ResponseWriter, r *http.Request) error
+	Unlink(w http.ResponseWriter, r *http.Request) error
 	Callback(w http.ResponseWriter, r *http.Request) error
 }
 
 type oauthHandler struct {
+	cfg          *config.Config
+	authService  service.AuthService
 	oauthService service.OAuthService
 }
 
-func NewOAuthHandler(oauthService service.OAuthService) *oauthHandler {
+func NewOAuthHandler(
+	cfg *config.Config,
+	authService service.AuthService,
+	oauthService service.OAuthService,
+) *oauthHandler {
 	return &oauthHandler{
+		cfg:          cfg,
+		authService:  authService,
 		oauthService: oauthService,
 	}
 }
+
+// state is also kept in cookie to make sure that callback
+// is completed in the same browser where login was started
+const oauthStateCookieName = "oauth_state"
+
+func (h *oauthHandler) redirect(
+	w http.ResponseWriter,
+	r *http.Request,
+	uri, state string,
+) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookieName,
+		Value:    state,
+		Path:     "/",
+		Domain:   h.cfg.HTTP.Domain,
+		MaxAge:   10 * 60,
+		Secure:   h.cfg.HTTP.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, uri, http.StatusFound)
+}
+
+func (h *oauthHandler) Login(w http.ResponseWriter, r *http.Request) error {
+	provider := chi.URLParam(r, "provider")
+	uri, state, err := h.oauthService.Login(r.Context(), provider)
+	if err != nil {
+		return err
+	}
+
+	h.redirect(w, r, uri, state)
+	return nil
+}
+
+func (h *oauthHandler) Link(w http.ResponseWriter, r *http.Request) error {
+	user, err := getCurrentUser(r, h.cfg, h.authService)
+	if err != nil {
+		return err
+	}
+
+	provider := chi.URLParam(r, "provider")
+	uri, state, err := h.oauthService.Link(r.Context(), provider, user.ID)
+	if err != nil {
+		return err
+	}
+
+	h.redirect(w, r, uri, state)
+	return nil
+}
+
+func (h *oauthHandler) Unlink(w http.ResponseWriter, r *http.Request) error {
+	user, err := getCurrentUser(r, h.cfg, h.authService)
+	if err != nil {
+		return err
+	}
+
+	provider := chi.URLParam(r, "provider")
+	if err := h.oauthService.Unlink(r.Context(), provider, user.ID); err != nil {
+		return err
+	}
+
+	render.Status(w, http.StatusOK)
+	return nil
+}
+
+// OAuthMFATokenFragment is key of mfa token in fragment of frontend url,
+// frontend completes login with it at /login/2fa. Fragment is not sent to
+// servers and is not leaked in Referer.
+const OAuthMFATokenFragment = "mfa_token"
+
+func mfaRedirectURI(frontendURL, mfaToken string) (string, error) {
+	u, err := url.Parse(frontendURL)
+	if err != nil {
+		return "", err
+	}
+
+	u.Fragment = url.Values{OAuthMFATokenFragment: {mfaToken}}.Encode()
+	return u.String(), nil
+}
+
+func (h *oauthHandler) Callback(w http.ResponseWriter, r *http.Request) error {
+	provider := chi.URLParam(r, "provider")
+	state := r.URL.Query().Get("state")
+	code := r.URL.Query().Get("code")
+
+	v, err := r.Cookie(oauthStateCookieName)
+	if err != nil || state == "" || v.Value != state {
+		return service.ErrInvalidOAuthState
+	}
+	unsetCookie(w, h.cfg, cookieOptions{
+		name:   oauthStateCookieName,
+		path:   "/",
+		domain: h.cfg.HTTP.Domain,
+	})
+
+	result, err := h.oauthService.Callback(r.Context(), provider, state, code)
+	if err != nil {
+		return err
+	}
+
+	if result != nil && result.MFAToken != "" {
+		uri, err := mfaRedirectURI(h.cfg.App.FrontendURL, result.MFAToken)
+		if err != nil {
+			return err
+		}
+
+		http.Redirect(w, r, uri, http.StatusFound)
+		return nil
+	}
+
+	// nil when provider was linked
+	if result != nil {
+		setTokenCookies(w, h.cfg, result.Tokens.Access, result.Tokens.Refresh)
+	}
+
+	http.Redirect(w, r, h.cfg.App.FrontendURL, http.StatusFound)
+	return nil
+}
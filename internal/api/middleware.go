@@ -0,0 +1,264 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/pegov/fauth-backend-go/internal/api/handler"
+	"github.com/pegov/fauth-backend-go/internal/config"
+	"github.com/pegov/fauth-backend-go/internal/model"
+	"github.com/pegov/fauth-backend-go/internal/service"
+)
+
+var ErrInvalidTrustedProxy = errors.New("invalid trusted proxy, must be ip or cidr")
+
+func parseTrustedProxies(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		if prefix, err := netip.ParsePrefix(value); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidTrustedProxy, value)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+
+	return prefixes, nil
+}
+
+func checkTrustedProxies(cfg *config.Config) error {
+	_, err := parseTrustedProxies(cfg.HTTP.TrustedProxies)
+	return err
+}
+
+// NewRealIPMiddleware replaces RemoteAddr with client ip from
+// X-Real-IP or X-Forwarded-For, but only if request came from trusted
+// proxy, otherwise client could set any ip and bypass per-ip limits.
+// X-Forwarded-For is read from the right, the first address that is
+// not a trusted proxy is client. Behind reverse proxy HTTP.TrustedProxies
+// must be set, Prepare warns if login rate limit is used without it.
+func NewRealIPMiddleware(cfg *config.Config) func(http.Handler) http.Handler {
+	// checked on startup
+	trustedProxies, _ := parseTrustedProxies(cfg.HTTP.TrustedProxies)
+
+	isTrusted := func(value string) bool {
+		addr, err := netip.ParseAddr(strings.TrimSpace(value))
+		if err != nil {
+			return false
+		}
+
+		return slices.ContainsFunc(trustedProxies, func(prefix netip.Prefix) bool {
+			return prefix.Contains(addr.Unmap())
+		})
+	}
+
+	return func(next http.Handler) http.Handler {
+		if len(trustedProxies) == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			remote := r.RemoteAddr
+			if host, _, err := net.SplitHostPort(remote); err == nil {
+				remote = host
+			}
+
+			if isTrusted(remote) {
+				if ip := realIP(r, isTrusted); ip != "" {
+					r.RemoteAddr = ip
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func realIP(r *http.Request, isTrusted func(string) bool) string {
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
+		if addr, err := netip.ParseAddr(ip); err == nil {
+			return addr.String()
+		}
+	}
+
+	ips := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(ips) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(ips[i]))
+		if err != nil {
+			return ""
+		}
+
+		if !isTrusted(addr.String()) {
+			return addr.String()
+		}
+	}
+
+	return ""
+}
+
+// NewClientMiddleware puts client info into context, it must go
+// after NewRealIPMiddleware.
+func NewClientMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := r.RemoteAddr
+			if host, _, err := net.SplitHostPort(ip); err == nil {
+				ip = host
+			}
+
+			ctx := model.ContextWithClient(r.Context(), &model.Client{
+				IP:        ip,
+				UserAgent: r.UserAgent(),
+			})
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// NewAuthMiddleware puts user from access token into request context,
+// requests without valid token get 401.
+func NewAuthMiddleware(
+	cfg *config.Config,
+	logger *slog.Logger,
+	authService service.AuthService,
+) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return makeHandler(func(w http.ResponseWriter, r *http.Request) error {
+			accessToken, err := handler.AccessToken(r, handler.AccessTokenCookieName(cfg))
+			if err != nil {
+				return err
+			}
+
+			user, err := authService.Token(r.Context(), accessToken)
+			if err != nil {
+				return err
+			}
+
+			next.ServeHTTP(w, r.WithContext(handler.ContextWithUser(r.Context(), user)))
+			return nil
+		}, logger)
+	}
+}
+
+// NewPermissionMiddleware must go after auth middleware,
+// requests from users without permission in token get 403.
+func NewPermissionMiddleware(
+	logger *slog.Logger,
+	permission string,
+) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return makeHandler(func(w http.ResponseWriter, r *http.Request) error {
+			user, ok := handler.UserFromContext(r.Context())
+			if !ok {
+				return handler.ErrNoToken
+			}
+
+			if !slices.Contains(user.Permissions, permission) {
+				return handler.ErrForbidden
+			}
+
+			next.ServeHTTP(w, r)
+			return nil
+		}, logger)
+	}
+}
+
+var ErrCSRFInvalidOrigin = errors.New("csrf invalid origin")
+
+// NewCSRFMiddleware checks Origin (or Referer if there is no Origin)
+// of state-changing requests that carry token cookies. Requests with
+// "Authorization" header are exempt, browsers don't add it by themselves.
+// Without trusted origins in config api's own host and origins allowed
+// by cors are trusted, so cross-origin frontend is listed only once.
+func NewCSRFMiddleware(
+	cfg *config.Config,
+	logger *slog.Logger,
+) func(http.Handler) http.Handler {
+	origins := cfg.HTTP.TrustedOrigins
+	trustHost := len(origins) == 0
+	if trustHost {
+		// "*" is dropped by normalizeOrigin, it doesn't make any origin trusted
+		origins = cfg.HTTP.CORSAllowedOrigins
+	}
+
+	trustedOrigins := make([]string, 0, len(origins))
+	for _, origin := range origins {
+		if origin = normalizeOrigin(origin); origin != "" {
+			trustedOrigins = append(trustedOrigins, origin)
+		}
+	}
+
+	hasTokenCookie := func(r *http.Request) bool {
+		for _, name := range []string{
+			handler.AccessTokenCookieName(cfg),
+			handler.RefreshTokenCookieName(cfg),
+		} {
+			if _, err := r.Cookie(name); err == nil {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return func(next http.Handler) http.Handler {
+		return makeHandler(func(w http.ResponseWriter, r *http.Request) error {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				next.ServeHTTP(w, r)
+				return nil
+			}
+
+			if r.Header.Get("Authorization") != "" || !hasTokenCookie(r) {
+				next.ServeHTTP(w, r)
+				return nil
+			}
+
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				origin = r.Referer()
+			}
+			origin = normalizeOrigin(origin)
+			if origin == "" {
+				return ErrCSRFInvalidOrigin
+			}
+
+			if !slices.Contains(trustedOrigins, origin) {
+				u, _ := url.Parse(origin)
+				if !trustHost || !strings.EqualFold(u.Host, r.Host) {
+					return ErrCSRFInvalidOrigin
+				}
+			}
+
+			next.ServeHTTP(w, r)
+			return nil
+		}, logger)
+	}
+}
+
+// normalizeOrigin returns "scheme://host" of origin or url,
+// empty string if it is invalid or "null".
+func normalizeOrigin(origin string) string {
+	u, err := url.Parse(strings.TrimSpace(origin))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return ""
+	}
+
+	return strings.ToLower(u.Scheme + "://" + u.Host)
+}
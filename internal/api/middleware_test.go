@@ -0,0 +1,128 @@
+package api
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pegov/fauth-backend-go/internal/config"
+)
+
+func TestRealIPMiddleware(t *testing.T) {
+	tests := []struct {
+		name           string
+		trustedProxies []string
+		remoteAddr     string
+		realIP         string
+		forwardedFor   string
+		expected       string
+	}{
+		{"no trusted proxies", nil, "10.0.0.1:1234", "1.1.1.1", "", "10.0.0.1:1234"},
+		{"untrusted remote", []string{"10.0.0.0/8"}, "2.2.2.2:1234", "1.1.1.1", "", "2.2.2.2:1234"},
+		{"x-real-ip", []string{"10.0.0.0/8"}, "10.0.0.1:1234", "1.1.1.1", "", "1.1.1.1"},
+		{"x-forwarded-for", []string{"10.0.0.1"}, "10.0.0.1:1234", "", "3.3.3.3, 1.1.1.1", "1.1.1.1"},
+		{"x-forwarded-for proxies chain", []string{"10.0.0.0/8"}, "10.0.0.1:1234", "", "1.1.1.1, 10.0.0.2", "1.1.1.1"},
+		{"no headers", []string{"10.0.0.0/8"}, "10.0.0.1:1234", "", "", "10.0.0.1:1234"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{}
+			cfg.HTTP.TrustedProxies = tt.trustedProxies
+
+			var remoteAddr string
+			h := NewRealIPMiddleware(cfg)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				remoteAddr = r.RemoteAddr
+			}))
+
+			r := httptest.NewRequest(http.MethodPost, "/login", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if tt.forwardedFor != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), r)
+
+			require.Equal(t, tt.expected, remoteAddr)
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	_, err := parseTrustedProxies([]string{"10.0.0.0/8", "127.0.0.1", "::1"})
+	require.NoError(t, err)
+
+	_, err = parseTrustedProxies([]string{"proxy"})
+	require.ErrorIs(t, err, ErrInvalidTrustedProxy)
+}
+
+func TestCSRFMiddleware(t *testing.T) {
+	trusted := []string{"https://app.example.com"}
+	tests := []struct {
+		name           string
+		method         string
+		trustedOrigins []string
+		corsOrigins    []string
+		cookie         bool
+		authorization  string
+		origin         string
+		referer        string
+		expected       int
+	}{
+		{"get pass-through", http.MethodGet, trusted, nil, true, "", "https://evil.com", "", http.StatusOK},
+		{"trusted origin", http.MethodPost, trusted, nil, true, "", "https://app.example.com", "", http.StatusOK},
+		{"untrusted origin", http.MethodPost, trusted, nil, true, "", "https://evil.com", "", http.StatusForbidden},
+		{"referer fallback", http.MethodPost, trusted, nil, true, "", "", "https://app.example.com/login", http.StatusOK},
+		{"untrusted referer", http.MethodPost, trusted, nil, true, "", "", "https://evil.com/login", http.StatusForbidden},
+		{"no origin and referer", http.MethodPost, trusted, nil, true, "", "", "", http.StatusForbidden},
+		{"bearer exemption", http.MethodPost, trusted, nil, true, "Bearer token", "https://evil.com", "", http.StatusOK},
+		{"no cookie", http.MethodPost, trusted, nil, false, "", "https://evil.com", "", http.StatusOK},
+		{"same host", http.MethodPost, nil, nil, true, "", "http://example.com", "", http.StatusOK},
+		{"other host", http.MethodPost, nil, nil, true, "", "https://evil.com", "", http.StatusForbidden},
+		{"cors origin", http.MethodPost, nil, trusted, true, "", "https://app.example.com", "", http.StatusOK},
+		{"same host with cors", http.MethodPost, nil, trusted, true, "", "http://example.com", "", http.StatusOK},
+		{"other host with cors", http.MethodPost, nil, trusted, true, "", "https://evil.com", "", http.StatusForbidden},
+		{"cors wildcard", http.MethodPost, nil, []string{"*"}, true, "", "https://evil.com", "", http.StatusForbidden},
+		{
+			"trusted origins over cors", http.MethodPost, trusted, []string{"https://other.example.com"},
+			true, "", "https://other.example.com", "", http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig()
+			cfg.HTTP.TrustedOrigins = tt.trustedOrigins
+			cfg.HTTP.CORSAllowedOrigins = tt.corsOrigins
+
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			h := NewCSRFMiddleware(cfg, logger)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			r := httptest.NewRequest(tt.method, "/logout", nil)
+			if tt.cookie {
+				r.AddCookie(&http.Cookie{Name: cfg.App.AccessTokenCookieName, Value: "access"})
+			}
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.referer != "" {
+				r.Header.Set("Referer", tt.referer)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			require.Equal(t, tt.expected, w.Code)
+		})
+	}
+}
@@ -3,24 +3,31 @@ package api
 import (
 	"context"
 	"crypto/ed25519"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
+	"github.com/pegov/fauth-backend-go/internal/api/handler"
 	"github.com/pegov/fauth-backend-go/internal/captcha"
 	"github.com/pegov/fauth-backend-go/internal/config"
 	"github.com/pegov/fauth-backend-go/internal/email"
+	"github.com/pegov/fauth-backend-go/internal/oauth"
 	"github.com/pegov/fauth-backend-go/internal/password"
 	"github.com/pegov/fauth-backend-go/internal/repo"
 	"github.com/pegov/fauth-backend-go/internal/service"
+	"github.com/pegov/fauth-backend-go/internal/signer"
 	"github.com/pegov/fauth-backend-go/internal/storage"
 	"github.com/pegov/fauth-backend-go/internal/token"
+	"github.com/pegov/fauth-backend-go/internal/totp"
 )
 
 func PrepareForTest(
@@ -44,6 +51,9 @@ func PrepareForTest(
 	cache := storage.NewMemoryCache()
 
 	userRepo := repo.NewUserRepo(db, cache)
+	roleRepo := repo.NewRoleRepo(db)
+	sessionRepo := repo.NewSessionRepo(db)
+	userRoleAdapter := repo.NewUserRoleAdapter(db, cache)
 
 	passwordManager := password.NewPlainTextPasswordHasher()
 	captchaClient := captcha.NewDebugCaptchaClient("")
@@ -59,21 +69,40 @@ func PrepareForTest(
 
 	emailClient := email.NewMockEmailClient()
 
+	totpCipher, err := totp.NewAESSecretCipher([]byte(strings.Repeat("k", 32)))
+	if err != nil {
+		return nil, err
+	}
+
 	authService := service.NewAuthService(
+		cfg,
 		userRepo,
+		roleRepo,
+		sessionRepo,
 		captchaClient,
 		passwordManager,
 		tokenBackend,
 		emailClient,
+		totpCipher,
+		signer.NewHMACSigner([]byte("secret")),
 	)
 
-	adminService := service.NewAdminService(userRepo)
+	oauthService := service.NewOAuthService(
+		cfg,
+		userRepo,
+		authService,
+		map[string]oauth.OAuthProvider{},
+	)
+
+	adminService := service.NewAdminService(cfg, userRepo, roleRepo, userRoleAdapter)
 
 	srv := NewServer(
 		cfg,
 		logger,
 		authService,
+		oauthService,
 		adminService,
+		tokenBackend,
 	)
 
 	return srv, nil
@@ -83,7 +112,7 @@ func Prepare(
 	ctx context.Context,
 	cfg *config.Config,
 	logger *slog.Logger,
-) (http.Handler, error) {
+) (http.Handler, token.JwtBackend, error) {
 	if cfg.Flags.Verbose {
 		logger.Warn("verbose flag is ON")
 	}
@@ -92,6 +121,29 @@ func Prepare(
 		logger.Warn("debug flag is ON")
 	}
 
+	if err := handler.CheckCookieConfig(cfg); err != nil {
+		logger.Error("Invalid cookie config", slog.Any("err", err))
+		return nil, nil, err
+	}
+
+	if err := checkTrustedProxies(cfg); err != nil {
+		logger.Error("Invalid trusted proxies", slog.Any("err", err))
+		return nil, nil, err
+	}
+
+	// behind proxy every client would have ip of proxy and share one limit
+	if cfg.App.LoginRatelimit > 0 && len(cfg.HTTP.TrustedProxies) == 0 {
+		logger.Warn(
+			"Login rate limit is ON, but no trusted proxies are set, client ip is taken from connection. " +
+				"Set HTTP_TRUSTED_PROXIES if api is behind reverse proxy",
+		)
+	}
+
+	if err := checkCORSConfig(cfg); err != nil {
+		logger.Error("Invalid cors config", slog.Any("err", err))
+		return nil, nil, err
+	}
+
 	var (
 		db    storage.DB
 		cache storage.CacheOps
@@ -114,17 +166,20 @@ func Prepare(
 			slog.String("db", cfg.Database.URL),
 			slog.Any("err", err),
 		)
-		return nil, err
+		return nil, nil, err
 	}
 
 	cacheClient, err := storage.GetCache(ctx, logger, cfg.Cache.URL)
 	if err != nil {
 		logger.Error("Failed to connect to cache", slog.String("cache", cfg.Cache.URL))
-		return nil, err
+		return nil, nil, err
 	}
 	cache = storage.NewRedisCacheWrapper(cacheClient)
 
 	userRepo := repo.NewUserRepo(db, cache)
+	roleRepo := repo.NewRoleRepo(db)
+	sessionRepo := repo.NewSessionRepo(db)
+	userRoleAdapter := repo.NewUserRoleAdapter(db, cache)
 
 	var captchaClient captcha.CaptchaClient
 	if cfg.Flags.Debug {
@@ -135,28 +190,13 @@ func Prepare(
 
 	passwordManager := password.NewBcryptPasswordHasher()
 
-	privateKey, err := os.ReadFile(cfg.Flags.PrivateKeyPath)
+	keyring, err := token.LoadKeyring(keyringSource(cfg))
 	if err != nil {
-		logger.Error(
-			"Failed to read private key path",
-			slog.String("privateKeyPath", cfg.Flags.PrivateKeyPath),
-		)
-		return nil, err
+		logger.Error("Failed to load jwt keys", slog.Any("err", err))
+		return nil, nil, err
 	}
-	publicKey, err := os.ReadFile(cfg.Flags.PublicKeyPath)
-	if err != nil {
-		logger.Error(
-			"Failed to read public key path",
-			slog.String("publicKeyPath", cfg.Flags.PublicKeyPath),
-		)
-		return nil, err
-	}
-	cfg.Flags.JWTKID = strings.TrimSpace(cfg.Flags.JWTKID)
-	if cfg.Flags.JWTKID == "" {
-		logger.Error("jwt kid is empty!")
-		return nil, errors.New("jwt kid is empty")
-	}
-	tokenBackend := token.NewJwtBackend(privateKey, publicKey, cfg.Flags.JWTKID)
+	logger.Info("Loaded jwt keys", slog.Any("kids", keyring.Kids()))
+	tokenBackend := token.NewJwtBackend(keyring, claimsOptions(cfg))
 
 	emailClient := email.NewStdEmailClient(
 		cfg.SMTP.Username,
@@ -165,19 +205,110 @@ func Prepare(
 		cfg.SMTP.Port,
 	)
 
+	totpKey, err := hex.DecodeString(cfg.TOTP.EncryptionKey)
+	if err != nil {
+		logger.Error("Failed to decode totp encryption key", slog.Any("err", err))
+		return nil, nil, err
+	}
+	totpCipher, err := totp.NewAESSecretCipher(totpKey)
+	if err != nil {
+		logger.Error("Invalid totp encryption key", slog.Any("err", err))
+		return nil, nil, err
+	}
+
 	authService := service.NewAuthService(
+		cfg,
 		userRepo,
+		roleRepo,
+		sessionRepo,
 		captchaClient,
 		passwordManager,
 		tokenBackend,
 		emailClient,
+		totpCipher,
+		signer.NewHMACSigner([]byte(cfg.App.SecretKey)),
 	)
 
-	adminService := service.NewAdminService(userRepo)
+	oauthProviders, err := newOAuthProviders(cfg)
+	if err != nil {
+		logger.Error("Failed to create oauth providers", slog.Any("err", err))
+		return nil, nil, err
+	}
+	oauthService := service.NewOAuthService(cfg, userRepo, authService, oauthProviders)
 
-	srv := NewServer(cfg, logger, authService, adminService)
+	adminService := service.NewAdminService(cfg, userRepo, roleRepo, userRoleAdapter)
 
-	return srv, nil
+	srv := NewServer(cfg, logger, authService, oauthService, adminService, tokenBackend)
+
+	return srv, tokenBackend, nil
+}
+
+func keyringSource(cfg *config.Config) token.KeyringSource {
+	return token.KeyringSource{
+		PrivateKeyPath: cfg.Flags.PrivateKeyPath,
+		PublicKeyPath:  cfg.Flags.PublicKeyPath,
+		Kid:            strings.TrimSpace(cfg.Flags.JWTKID),
+		Algorithm:      cfg.Flags.JWTAlgorithm,
+		Dir:            cfg.Flags.JWTKeysDir,
+		VerifyKeys:     cfg.Flags.JWTVerifyKeys,
+	}
+}
+
+func claimsOptions(cfg *config.Config) token.ClaimsOptions {
+	audience := cfg.JWT.Audience
+	if len(audience) == 0 {
+		audience = []string{cfg.JWT.Issuer}
+	}
+
+	return token.ClaimsOptions{
+		Issuer:           cfg.JWT.Issuer,
+		Audience:         audience,
+		AllowedIssuers:   cfg.JWT.AllowedIssuers,
+		AllowedAudiences: cfg.JWT.AllowedAudiences,
+	}
+}
+
+var ErrOAuthCallbackBaseURL = errors.New("oauth callback base url must be absolute url when providers are enabled")
+
+// newOAuthProviders creates registry of providers enabled in config.
+// Redirect uri is built from callback base url, relative one is rejected
+// by providers, so it is required with any provider.
+func newOAuthProviders(cfg *config.Config) (map[string]oauth.OAuthProvider, error) {
+	providers := make(map[string]oauth.OAuthProvider, len(cfg.OAuth.Providers))
+	for _, name := range cfg.OAuth.Providers {
+		var provider oauth.OAuthProvider
+		switch strings.TrimSpace(name) {
+		case "google":
+			p := oauth.NewGoogleOAuthProvider(
+				cfg.OAuth.GoogleClientID,
+				cfg.OAuth.GoogleClientSecret,
+				false,
+			)
+			provider = &p
+		case "vk":
+			p := oauth.NewVKOAuthProvider(
+				cfg.OAuth.VKAppID,
+				cfg.OAuth.VKAppSecret,
+				false,
+			)
+			provider = &p
+		case "":
+			continue
+		default:
+			return nil, fmt.Errorf("unknown oauth provider: %s", name)
+		}
+
+		providers[provider.Name()] = provider
+	}
+
+	if len(providers) > 0 {
+		u, err := url.Parse(cfg.OAuth.CallbackBaseURL)
+		if err != nil || !u.IsAbs() || u.Host == "" {
+			return nil, ErrOAuthCallbackBaseURL
+		}
+	}
+
+	return providers, nil
 }
 
 func Run(
@@ -186,6 +317,7 @@ func Run(
 	logger *slog.Logger,
 	signals <-chan os.Signal,
 	handler http.Handler,
+	tokenBackend token.JwtBackend,
 ) error {
 	addr := net.JoinHostPort(cfg.Flags.Host, strconv.Itoa(cfg.Flags.Port))
 	httpServer := http.Server{
@@ -206,10 +338,8 @@ outer:
 		case sig := <-signals:
 			switch sig {
 			case syscall.SIGHUP:
-				logger.Warn(
-					"Received signal to reset file descriptors for log files",
-					slog.Any("sig", sig),
-				)
+				logger.Warn("Received signal to reload jwt keys", slog.Any("sig", sig))
+				reloadKeys(cfg, logger, tokenBackend)
 			case syscall.SIGTERM, syscall.SIGINT:
 				logger.Warn("Received exit signal", slog.Any("sig", sig))
 				break outer
@@ -231,3 +361,32 @@ outer:
 
 	return nil
 }
+
+var ErrSigningKeyChangedWithSameKid = errors.New("signing key changed but kid is the same")
+
+// reloadKeys keeps old keys if new ones can't be loaded. New signing key
+// under old kid is rejected too, otherwise all issued tokens of that kid
+// would fail verification.
+func reloadKeys(cfg *config.Config, logger *slog.Logger, tokenBackend token.JwtBackend) {
+	keyring, err := token.LoadKeyring(keyringSource(cfg))
+	if err == nil {
+		current := tokenBackend.Keyring().SigningKey()
+		signing := keyring.SigningKey()
+		if current.Kid == signing.Kid && !sameKey(current, signing) {
+			err = ErrSigningKeyChangedWithSameKid
+		}
+	}
+	if err != nil {
+		logger.Error("Failed to reload jwt keys, keeping old keys", slog.Any("err", err))
+		return
+	}
+
+	tokenBackend.SetKeyring(keyring)
+	logger.Info("Reloaded jwt keys", slog.Any("kids", keyring.Kids()))
+}
+
+func sameKey(a, b token.Key) bool {
+	thumbprintA, errA := token.Thumbprint(a.PublicKey)
+	thumbprintB, errB := token.Thumbprint(b.PublicKey)
+	return errA == nil && errB == nil && thumbprintA == thumbprintB
+}
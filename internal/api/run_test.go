@@ -0,0 +1,139 @@
+package api
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pegov/fauth-backend-go/internal/config"
+	"github.com/pegov/fauth-backend-go/internal/token"
+)
+
+func writeKeyFiles(t *testing.T, seed, privatePath, publicPath string) {
+	t.Helper()
+
+	privateKey := ed25519.NewKeyFromSeed([]byte(strings.Repeat(seed, ed25519.SeedSize)))
+
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	require.NoError(t, err)
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	require.NoError(t, os.WriteFile(privatePath, data, 0o600))
+
+	der, err = x509.MarshalPKIXPublicKey(privateKey.Public())
+	require.NoError(t, err)
+	data = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	require.NoError(t, os.WriteFile(publicPath, data, 0o644))
+}
+
+func newKeysConfig(t *testing.T) *config.Config {
+	t.Helper()
+
+	root := t.TempDir()
+	cfg := &config.Config{}
+	cfg.Flags.PrivateKeyPath = filepath.Join(root, "private.pem")
+	cfg.Flags.PublicKeyPath = filepath.Join(root, "public.pem")
+	cfg.Flags.JWTAlgorithm = token.AlgorithmEdDSA
+	cfg.Flags.JWTKeysDir = filepath.Join(root, "keys")
+	require.NoError(t, os.Mkdir(cfg.Flags.JWTKeysDir, 0o755))
+
+	return cfg
+}
+
+func TestReloadKeysRotation(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cfg := newKeysConfig(t)
+	writeKeyFiles(t, "a", cfg.Flags.PrivateKeyPath, cfg.Flags.PublicKeyPath)
+
+	keyring, err := token.LoadKeyring(keyringSource(cfg))
+	require.NoError(t, err)
+	backend := token.NewJwtBackend(keyring, token.DefaultClaimsOptions)
+	oldKid := keyring.SigningKey().Kid
+
+	payload := token.User{ID: 1, Username: "user"}
+	oldToken, err := backend.Encode(&payload, time.Minute, token.AccessTokenType)
+	require.NoError(t, err)
+
+	// keep old public key under its kid, then replace key files
+	oldPublicKey, err := os.ReadFile(cfg.Flags.PublicKeyPath)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(
+		filepath.Join(cfg.Flags.JWTKeysDir, oldKid+".pem"),
+		oldPublicKey,
+		0o644,
+	))
+	writeKeyFiles(t, "b", cfg.Flags.PrivateKeyPath, cfg.Flags.PublicKeyPath)
+
+	reloadKeys(cfg, logger, backend)
+
+	newKid := backend.Keyring().SigningKey().Kid
+	require.NotEqual(t, oldKid, newKid)
+	require.Equal(t, []string{newKid, oldKid}, backend.Keyring().Kids())
+
+	_, err = backend.Decode(oldToken, token.AccessTokenType)
+	require.NoError(t, err)
+
+	newToken, err := backend.Encode(&payload, time.Minute, token.AccessTokenType)
+	require.NoError(t, err)
+	_, err = backend.Decode(newToken, token.AccessTokenType)
+	require.NoError(t, err)
+}
+
+func TestReloadKeysSameKid(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cfg := newKeysConfig(t)
+	cfg.Flags.JWTKID = "1"
+	writeKeyFiles(t, "a", cfg.Flags.PrivateKeyPath, cfg.Flags.PublicKeyPath)
+
+	keyring, err := token.LoadKeyring(keyringSource(cfg))
+	require.NoError(t, err)
+	backend := token.NewJwtBackend(keyring, token.DefaultClaimsOptions)
+
+	payload := token.User{ID: 1, Username: "user"}
+	oldToken, err := backend.Encode(&payload, time.Minute, token.AccessTokenType)
+	require.NoError(t, err)
+
+	// new key under static kid would break all issued tokens
+	writeKeyFiles(t, "b", cfg.Flags.PrivateKeyPath, cfg.Flags.PublicKeyPath)
+	reloadKeys(cfg, logger, backend)
+
+	require.Same(t, keyring, backend.Keyring())
+	_, err = backend.Decode(oldToken, token.AccessTokenType)
+	require.NoError(t, err)
+}
+
+func TestNewOAuthProvidersCallbackBaseURL(t *testing.T) {
+	tests := []struct {
+		name            string
+		providers       []string
+		callbackBaseURL string
+		err             error
+	}{
+		{"no providers", nil, "", nil},
+		{"empty", []string{"google"}, "", ErrOAuthCallbackBaseURL},
+		{"relative", []string{"google"}, "/api", ErrOAuthCallbackBaseURL},
+		{"absolute", []string{"google", "vk"}, "https://api.example.com", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{}
+			cfg.OAuth.Providers = tt.providers
+			cfg.OAuth.CallbackBaseURL = tt.callbackBaseURL
+
+			providers, err := newOAuthProviders(cfg)
+			require.ErrorIs(t, err, tt.err)
+			if tt.err == nil {
+				require.Len(t, providers, len(tt.providers))
+			}
+		})
+	}
+}
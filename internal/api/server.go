@@ -10,17 +10,23 @@ import (
 
 	"github.com/pegov/fauth-backend-go/internal/api/handler"
 	"github.com/pegov/fauth-backend-go/internal/config"
+	"github.com/pegov/fauth-backend-go/internal/model"
 	"github.com/pegov/fauth-backend-go/internal/service"
+	"github.com/pegov/fauth-backend-go/internal/token"
 )
 
 func NewServer(
 	cfg *config.Config,
 	logger *slog.Logger,
 	authService service.AuthService,
+	oauthService service.OAuthService,
 	adminService service.AdminService,
+	tokenBackend token.JwtBackend,
 ) http.Handler {
 	r := chi.NewRouter()
-	r.Use(middleware.RealIP)
+	r.Use(NewRealIPMiddleware(cfg))
+	r.Use(NewClientMiddleware())
+	r.Use(NewCORSMiddleware(cfg))
 	r.Use(NewSlogMiddleware(logger))
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.Timeout(20 * time.Second))
@@ -29,34 +35,90 @@ func NewServer(
 		w.Write([]byte("pong"))
 	})
 
-	apiV1Router := chi.NewRouter()
-
 	localMakeHandler := func(handler HandlerFuncWithError) http.HandlerFunc {
 		return makeHandler(handler, logger)
 	}
 
+	jwksHandler := handler.NewJWKSHandler(tokenBackend)
+	r.Get("/.well-known/jwks.json", localMakeHandler(jwksHandler.JWKS))
+
+	apiV1Router := chi.NewRouter()
+	apiV1Router.Use(NewCSRFMiddleware(cfg, logger))
+
 	apiV1Router.Group(func(r chi.Router) {
 		authHandler := handler.NewAuthHandler(cfg, authService)
 		r.Post("/register", localMakeHandler(authHandler.Register))
 		r.Post("/login", localMakeHandler(authHandler.Login))
+		r.Post("/login/2fa", localMakeHandler(authHandler.LoginTOTP))
 		r.Post("/logout", localMakeHandler(authHandler.Logout))
+		r.Post(handler.RevokeTokenRoute, localMakeHandler(authHandler.Logout))
+		r.Post("/logout/all", localMakeHandler(authHandler.LogoutAll))
 		r.Post("/token", localMakeHandler(authHandler.Token))
-		r.Post("/token/refresh", localMakeHandler(authHandler.RefreshToken))
+		r.Post(handler.RefreshTokenRoute, localMakeHandler(authHandler.RefreshToken))
 		r.Post("/me", localMakeHandler(authHandler.Me))
+		r.Post("/2fa/setup", localMakeHandler(authHandler.SetupTOTP))
+		r.Post("/2fa/confirm", localMakeHandler(authHandler.ConfirmTOTP))
+		r.Post("/2fa/remove", localMakeHandler(authHandler.RemoveTOTP))
+		r.Post("/2fa/recovery_codes", localMakeHandler(authHandler.RegenerateRecoveryCodes))
+		r.Post("/email/verify/request", localMakeHandler(authHandler.RequestEmailVerification))
+		r.Post("/email/verify", localMakeHandler(authHandler.VerifyEmail))
+		r.Post("/email/change/request", localMakeHandler(authHandler.RequestEmailChange))
+		r.Post("/email/change/verify_old", localMakeHandler(authHandler.VerifyOldEmail))
+		r.Post("/email/change/verify_new", localMakeHandler(authHandler.VerifyNewEmail))
+		r.Post("/password/forgot", localMakeHandler(authHandler.ForgotPassword))
+		r.Post("/password/reset", localMakeHandler(authHandler.ResetPassword))
+		r.Get("/password/status", localMakeHandler(authHandler.GetPasswordStatus))
+		r.Post("/password/change", localMakeHandler(authHandler.ChangePassword))
+		r.Post("/password/set", localMakeHandler(authHandler.SetPassword))
+		r.Get("/sessions", localMakeHandler(authHandler.GetSessions))
+		r.Delete("/sessions/{id}", localMakeHandler(authHandler.RevokeSession))
 	})
 
 	apiV1Router.Group(func(r chi.Router) {
+		oauthHandler := handler.NewOAuthHandler(cfg, authService, oauthService)
+		r.Get("/oauth/{provider}/login", localMakeHandler(oauthHandler.Login))
+		r.Get("/oauth/{provider}/link", localMakeHandler(oauthHandler.Link))
+		r.Delete("/oauth/{provider}", localMakeHandler(oauthHandler.Unlink))
+		r.Get("/oauth/{provider}/callback", localMakeHandler(oauthHandler.Callback))
+	})
+
+	apiV1Router.Group(func(r chi.Router) {
+		r.Use(NewAuthMiddleware(cfg, logger, authService))
+
+		requirePermission := func(permission string) chi.Router {
+			return r.With(NewPermissionMiddleware(logger, permission))
+		}
+
 		adminHandler := handler.NewAdminHandler(adminService)
-		r.Get("/mass_logout", localMakeHandler(adminHandler.GetMassLogout))
-		r.Post("/mass_logout", localMakeHandler(adminHandler.ActivateMassLogout))
-		r.Delete("/mass_logout", localMakeHandler(adminHandler.DeactivateMassLogout))
-		r.Post("/{id}/ban", localMakeHandler(adminHandler.Ban))
-		r.Post("/{id}/unban", localMakeHandler(adminHandler.Unban))
-		r.Post("/{id}/kick", localMakeHandler(adminHandler.Kick))
-		r.Post("/{id}/unkick", localMakeHandler(adminHandler.Unkick))
+		requirePermission(model.PermissionUsersMassLogout).
+			Get("/mass_logout", localMakeHandler(adminHandler.GetMassLogout))
+		requirePermission(model.PermissionUsersMassLogout).
+			Post("/mass_logout", localMakeHandler(adminHandler.ActivateMassLogout))
+		requirePermission(model.PermissionUsersMassLogout).
+			Delete("/mass_logout", localMakeHandler(adminHandler.DeactivateMassLogout))
+		requirePermission(model.PermissionUsersBan).
+			Post("/{id}/ban", localMakeHandler(adminHandler.Ban))
+		requirePermission(model.PermissionUsersBan).
+			Post("/{id}/unban", localMakeHandler(adminHandler.Unban))
+		requirePermission(model.PermissionUsersKick).
+			Post("/{id}/kick", localMakeHandler(adminHandler.Kick))
+		requirePermission(model.PermissionUsersKick).
+			Post("/{id}/unkick", localMakeHandler(adminHandler.Unkick))
+		requirePermission(model.PermissionUsersRoles).
+			Put("/{id}/roles", localMakeHandler(adminHandler.UpdateUserRoles))
+		requirePermission(model.PermissionRolesRead).
+			Get("/roles", localMakeHandler(adminHandler.GetRoles))
+		requirePermission(model.PermissionRolesWrite).
+			Post("/roles", localMakeHandler(adminHandler.CreateRole))
+		requirePermission(model.PermissionRolesRead).
+			Get("/roles/{id}", localMakeHandler(adminHandler.GetRole))
+		requirePermission(model.PermissionRolesWrite).
+			Put("/roles/{id}", localMakeHandler(adminHandler.UpdateRole))
+		requirePermission(model.PermissionRolesWrite).
+			Delete("/roles/{id}", localMakeHandler(adminHandler.DeleteRole))
 	})
 
-	r.Mount("/api/v1/users", apiV1Router)
+	r.Mount(model.UsersPrefix, apiV1Router)
 
 	return r
 }
@@ -0,0 +1,259 @@
+package api
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/ovechkin-dm/mockio/v2/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pegov/fauth-backend-go/internal/api/handler"
+	"github.com/pegov/fauth-backend-go/internal/config"
+	"github.com/pegov/fauth-backend-go/internal/model"
+	"github.com/pegov/fauth-backend-go/internal/service"
+	"github.com/pegov/fauth-backend-go/internal/token"
+)
+
+func newTestConfig() *config.Config {
+	cfg := &config.Config{}
+	cfg.App.AccessTokenCookieName = "access"
+	cfg.App.RefreshTokenCookieName = "refresh"
+	return cfg
+}
+
+type testServer struct {
+	http.Handler
+	authService  service.AuthService
+	oauthService service.OAuthService
+	adminService service.AdminService
+}
+
+func newTestServer(t *testing.T, cfg *config.Config, logger *slog.Logger) *testServer {
+	ctrl := mock.NewMockController(t)
+	authService := mock.Mock[service.AuthService](ctrl)
+	oauthService := mock.Mock[service.OAuthService](ctrl)
+	adminService := mock.Mock[service.AdminService](ctrl)
+	tokenBackend := mock.Mock[token.JwtBackend](ctrl)
+
+	return &testServer{
+		Handler:      NewServer(cfg, logger, authService, oauthService, adminService, tokenBackend),
+		authService:  authService,
+		oauthService: oauthService,
+		adminService: adminService,
+	}
+}
+
+// browserRequest adds cookies from jar that browser would send to target.
+func browserRequest(jar http.CookieJar, method, target string) *http.Request {
+	r := httptest.NewRequest(method, "http://example.com"+target, nil)
+	r.Header.Set("Origin", "http://example.com")
+	for _, cookie := range jar.Cookies(r.URL) {
+		r.AddCookie(cookie)
+	}
+
+	return r
+}
+
+// newTestCookieJar stores cookies that server sets after refresh, cookie
+// names from skip are dropped as if they had expired.
+func newTestCookieJar(t *testing.T, srv *testServer, skip ...string) http.CookieJar {
+	mock.WhenDouble(srv.authService.RefreshToken(mock.AnyContext(), mock.Exact("seed"))).
+		ThenReturn(&service.Tokens{Access: "access", Refresh: "refresh"}, nil)
+
+	r := httptest.NewRequest(http.MethodPost, "http://example.com"+model.UsersPrefix+handler.RefreshTokenRoute, nil)
+	r.Header.Set("Origin", "http://example.com")
+	r.AddCookie(&http.Cookie{Name: "refresh", Value: "seed"})
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var cookies []*http.Cookie
+	for _, cookie := range w.Result().Cookies() {
+		if !slices.Contains(skip, cookie.Name) {
+			cookies = append(cookies, cookie)
+		}
+	}
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	jar.SetCookies(r.URL, cookies)
+
+	return jar
+}
+
+func TestRefreshTokenCookiePath(t *testing.T) {
+	cfg := newTestConfig()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	srv := newTestServer(t, cfg, logger)
+	mock.WhenDouble(srv.authService.RefreshToken(mock.AnyContext(), mock.Exact("refresh"))).
+		ThenReturn(nil, service.ErrTokenDecoding)
+	jar := newTestCookieJar(t, srv)
+
+	r := browserRequest(jar, http.MethodPost, model.UsersPrefix+handler.RefreshTokenRoute)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	mock.Verify(srv.authService, mock.Once()).RefreshToken(mock.AnyContext(), mock.Exact("refresh"))
+
+	// refresh cookie is not sent to other endpoints, token route included
+	for _, route := range []string{"/me", "/token", "/logout"} {
+		r = browserRequest(jar, http.MethodPost, model.UsersPrefix+route)
+		_, err := r.Cookie(handler.RefreshTokenCookieName(cfg))
+		require.ErrorIs(t, err, http.ErrNoCookie, route)
+	}
+}
+
+func TestRootRefreshCookieExpired(t *testing.T) {
+	cfg := newTestConfig()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	srv := newTestServer(t, cfg, logger)
+	mock.WhenDouble(srv.authService.RefreshToken(mock.AnyContext(), mock.Exact("seed"))).
+		ThenReturn(&service.Tokens{Access: "access", Refresh: "refresh"}, nil)
+
+	r := httptest.NewRequest(http.MethodPost, "http://example.com"+model.UsersPrefix+handler.RefreshTokenRoute, nil)
+	r.Header.Set("Origin", "http://example.com")
+	// cookie that browser got before refresh cookie was scoped
+	r.AddCookie(&http.Cookie{Name: "refresh", Value: "seed"})
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var root, scoped bool
+	for _, cookie := range w.Result().Cookies() {
+		switch {
+		case cookie.Name == "refresh" && cookie.Path == "/":
+			root = true
+			require.Negative(t, cookie.MaxAge)
+		case cookie.Name == "refresh":
+			scoped = true
+			require.Equal(t, handler.RefreshTokenCookiePath, cookie.Path)
+			require.Equal(t, "refresh", cookie.Value)
+		}
+	}
+	require.True(t, root)
+	require.True(t, scoped)
+}
+
+func TestLogoutReceivesRefreshCookie(t *testing.T) {
+	cfg := newTestConfig()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	srv := newTestServer(t, cfg, logger)
+	mock.WhenSingle(srv.authService.Logout(mock.AnyContext(), mock.AnyString())).
+		ThenReturn(nil)
+	// access cookie has expired, only refresh cookie is left
+	jar := newTestCookieJar(t, srv, handler.AccessTokenCookieName(cfg))
+
+	r := browserRequest(jar, http.MethodPost, model.UsersPrefix+handler.RevokeTokenRoute)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	mock.Verify(srv.authService, mock.Once()).Logout(mock.AnyContext(), mock.Exact("refresh"))
+	mock.Verify(srv.authService, mock.Never()).Token(mock.AnyContext(), mock.AnyString())
+}
+
+func TestLogoutRoute(t *testing.T) {
+	cfg := newTestConfig()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	srv := newTestServer(t, cfg, logger)
+	mock.WhenDouble(srv.authService.Token(mock.AnyContext(), mock.Exact("access"))).
+		ThenReturn(&token.User{ID: 1, SessionID: "session"}, nil)
+	mock.WhenSingle(srv.authService.RevokeSession(mock.AnyContext(), mock.Exact(int32(1)), mock.Exact("session"))).
+		ThenReturn(nil)
+	jar := newTestCookieJar(t, srv)
+
+	// clients of old route still log out, session is taken from access cookie
+	r := browserRequest(jar, http.MethodPost, model.UsersPrefix+"/logout")
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	mock.Verify(srv.authService, mock.Once()).RevokeSession(mock.AnyContext(), mock.Exact(int32(1)), mock.Exact("session"))
+	mock.Verify(srv.authService, mock.Never()).Logout(mock.AnyContext(), mock.AnyString())
+
+	jar.SetCookies(r.URL, w.Result().Cookies())
+	r = browserRequest(jar, http.MethodPost, model.UsersPrefix+handler.RefreshTokenRoute)
+	require.Empty(t, r.Cookies())
+}
+
+func TestOAuthCallbackMFA(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.App.FrontendURL = "https://app.example.com/login"
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	srv := newTestServer(t, cfg, logger)
+	mock.WhenDouble(srv.oauthService.Callback(
+		mock.AnyContext(),
+		mock.Exact("google"),
+		mock.Exact("state"),
+		mock.Exact("code"),
+	)).ThenReturn(&service.LoginResult{MFAToken: "mfa"}, nil)
+
+	r := httptest.NewRequest(http.MethodGet, model.UsersPrefix+"/oauth/google/callback?state=state&code=code", nil)
+	r.AddCookie(&http.Cookie{Name: "oauth_state", Value: "state"})
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+
+	// browser is sent back to frontend, tokens are not issued yet
+	require.Equal(t, http.StatusFound, w.Code)
+	require.Equal(t, "https://app.example.com/login#"+handler.OAuthMFATokenFragment+"=mfa", w.Header().Get("Location"))
+	for _, cookie := range w.Result().Cookies() {
+		require.NotEqual(t, handler.AccessTokenCookieName(cfg), cookie.Name)
+		require.NotEqual(t, handler.RefreshTokenCookieName(cfg), cookie.Name)
+	}
+}
+
+func TestAuthAndPermissionMiddleware(t *testing.T) {
+	tests := []struct {
+		name          string
+		authorization string
+		cookie        string
+		permissions   []string
+		expected      int
+	}{
+		{"no token", "", "", nil, http.StatusUnauthorized},
+		{"bad token", "Bearer bad", "", nil, http.StatusUnauthorized},
+		{"bad scheme", "Basic valid", "", nil, http.StatusUnauthorized},
+		{"no permission", "Bearer valid", "", []string{model.PermissionUsersBan}, http.StatusForbidden},
+		{"permission", "Bearer valid", "", []string{model.PermissionUsersMassLogout}, http.StatusOK},
+		{"permission in cookie", "", "valid", []string{model.PermissionUsersMassLogout}, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig()
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			srv := newTestServer(t, cfg, logger)
+			mock.WhenDouble(srv.authService.Token(mock.AnyContext(), mock.Exact("valid"))).
+				ThenReturn(&token.User{ID: 1, Username: "user", Permissions: tt.permissions}, nil)
+			mock.WhenDouble(srv.authService.Token(mock.AnyContext(), mock.Exact("bad"))).
+				ThenReturn(nil, service.ErrTokenDecoding)
+			mock.WhenDouble(srv.adminService.GetMassLogout(mock.AnyContext())).
+				ThenReturn(model.MassLogoutStatus{}, nil)
+
+			r := httptest.NewRequest(http.MethodGet, model.UsersPrefix+"/mass_logout", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: handler.AccessTokenCookieName(cfg), Value: tt.cookie})
+			}
+			w := httptest.NewRecorder()
+			srv.ServeHTTP(w, r)
+
+			require.Equal(t, tt.expected, w.Code)
+
+			// handler is reached only with permission
+			calls := mock.Never()
+			if tt.expected == http.StatusOK {
+				calls = mock.Once()
+			}
+			mock.Verify(srv.adminService, calls).GetMassLogout(mock.AnyContext())
+		})
+	}
+}
@@ -3,7 +3,9 @@ package api
 import (
 	"errors"
 	"log/slog"
+	"math"
 	"net/http"
+	"strconv"
 
 	"github.com/pegov/fauth-backend-go/internal/api/handler"
 	"github.com/pegov/fauth-backend-go/internal/http/bind"
@@ -28,32 +30,97 @@ func makeHandler(fn HandlerFuncWithError, logger *slog.Logger) http.HandlerFunc
 	return func(w http.ResponseWriter, r *http.Request) {
 		var validationError *model.ValidationError
 		var bindJSONError *bind.BindJSONError
+		var rateLimitError *service.RateLimitError
 		if err := fn(w, r); err != nil {
 			switch {
 			case errors.Is(err, handler.ErrInvalidPathParamType):
 				render.String(w, http.StatusBadRequest, err.Error())
 
-			case errors.Is(err, service.ErrUserNotFound):
+			case errors.Is(err, service.ErrUserNotFound),
+				errors.Is(err, service.ErrOAuthProviderNotFound):
 				render.String(w, http.StatusNotFound, "Not found")
 
+			case errors.Is(err, service.ErrRoleNotFound),
+				errors.Is(err, service.ErrSessionNotFound):
+				render.JSON(w, http.StatusNotFound, NewDetail(err.Error()))
+
 			case errors.Is(err, service.ErrInvalidCaptcha):
 				render.String(w, http.StatusBadRequest, err.Error())
 
+			case errors.As(err, &validationError):
+				render.JSON(
+					w,
+					http.StatusBadRequest,
+					NewDetail(validationError.Error()),
+				)
+
 			case errors.Is(err, service.ErrUserAlreadyExistsEmail),
 				errors.Is(err, service.ErrUserAlreadyExistsUsername),
 				errors.Is(err, service.ErrUserPasswordNotSet),
-				errors.As(err, &validationError):
+				errors.Is(err, service.ErrTOTPAlreadyEnabled),
+				errors.Is(err, service.ErrTOTPNotEnabled),
+				errors.Is(err, service.ErrTOTPNotSetUp),
+				errors.Is(err, service.ErrInvalidTOTPCode),
+				errors.Is(err, service.ErrEmailAlreadyVerified),
+				errors.Is(err, service.ErrInvalidLinkToken),
+				errors.Is(err, service.ErrEmailChangeNotFound),
+				errors.Is(err, service.ErrOldEmailNotConfirmed),
+				errors.Is(err, service.ErrOldEmailConfirmed),
+				errors.Is(err, service.ErrEmailChangeSameAddress),
+				errors.Is(err, service.ErrUserPasswordAlreadySet),
+				errors.Is(err, service.ErrInvalidOldPassword),
+				errors.Is(err, service.ErrInvalidOAuthState),
+				errors.Is(err, service.ErrOAuthUserData),
+				errors.Is(err, service.ErrOAuthAlreadyLinked),
+				errors.Is(err, service.ErrOAuthNotLinked),
+				errors.Is(err, service.ErrOAuthLastLoginMethod),
+				errors.Is(err, service.ErrRoleAlreadyExists),
+				errors.Is(err, service.ErrRoleBuiltIn),
+				errors.Is(err, service.ErrLastAdmin):
 				render.JSON(
 					w,
 					http.StatusBadRequest,
-					NewDetail(validationError.Error()),
+					NewDetail(err.Error()),
 				)
 
+			case errors.Is(err, service.ErrRefreshTokenReuse):
+				logger.Warn("Refresh token reuse detected, family revoked", slog.Any("err", err))
+				render.String(w, http.StatusUnauthorized, "Unauthorized")
+
+			case errors.Is(err, service.ErrRefreshTokenRotated):
+				render.JSON(w, http.StatusConflict, NewDetail(err.Error()))
+
 			case errors.Is(err, service.ErrUserNotActive),
+				errors.Is(err, service.ErrUserWasKicked),
+				errors.Is(err, service.ErrUserInMassLogout),
+				errors.Is(err, service.ErrRefreshTokenRevoked),
+				errors.Is(err, service.ErrSessionRevoked),
+				errors.Is(err, service.ErrMFATokenUsed),
 				errors.Is(err, service.ErrPasswordVerification),
-				errors.Is(err, handler.ErrNoTokenCookie):
+				errors.Is(err, service.ErrTokenDecoding),
+				errors.Is(err, handler.ErrNoToken):
 				render.String(w, http.StatusUnauthorized, "Unauthorized")
 
+			case errors.Is(err, handler.ErrForbidden):
+				render.String(w, http.StatusForbidden, "Forbidden")
+
+			case errors.Is(err, ErrCSRFInvalidOrigin):
+				logger.Warn(
+					"Rejected cross-site request",
+					slog.String("origin", r.Header.Get("Origin")),
+					slog.String("referer", r.Referer()),
+				)
+				render.String(w, http.StatusForbidden, "Forbidden")
+
+			case errors.As(err, &rateLimitError):
+				retryAfter := int(math.Ceil(rateLimitError.RetryAfter.Seconds()))
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+				render.JSON(
+					w,
+					http.StatusTooManyRequests,
+					NewDetail(rateLimitError.Error()),
+				)
+
 			case errors.As(err, &bindJSONError):
 				render.JSON(
 					w,
@@ -9,6 +9,8 @@ type Config struct {
 	SMTP     SMTP
 	Captcha  Captcha
 	OAuth    OAuth `flag:"oauth" env:"OAUTH"`
+	TOTP     TOTP
+	JWT      JWT
 	App      App
 	Flags    Flags `flag:"" env:""`
 }
@@ -25,8 +27,18 @@ type Cache struct {
 }
 
 type HTTP struct {
-	Domain string
-	Secure bool
+	Domain         string
+	Secure         bool
+	SameSite       string   `default:"lax" usage:"SameSite для cookie с токенами: strict, lax или none"`
+	CookiePrefix   bool     `cli:"optional" usage:"префиксы __Host- и __Secure- для cookie с токенами, требует secure"`
+	TrustedProxies []string `cli:"optional" usage:"ip или cidr прокси, которым можно передавать X-Real-IP и X-Forwarded-For, без них заголовки игнорируются, за reverse proxy обязательно для лимитов по ip и ip сессий"`
+	TrustedOrigins []string `cli:"optional" usage:"origin, с которых можно отправлять запросы с cookie, по умолчанию хост api и origin, разрешенные для cors"`
+
+	CORSAllowedOrigins   []string `cli:"optional" usage:"origin, которым разрешены кросс-доменные запросы, * разрешает все, пустой список отключает cors"`
+	CORSAllowCredentials bool     `cli:"optional" usage:"разрешить cookie в кросс-доменных запросах, нельзя вместе с *"`
+	CORSAllowedMethods   []string `default:"GET,POST,PUT,DELETE"`
+	CORSAllowedHeaders   []string `default:"Content-Type,Authorization,X-Token-Delivery"`
+	CORSMaxAge           int      `default:"600" usage:"сколько секунд можно кэшировать ответ на preflight"`
 }
 
 type SMTP struct {
@@ -34,6 +46,7 @@ type SMTP struct {
 	Password string
 	Host     string
 	Port     string
+	From     string
 }
 
 type Captcha struct {
@@ -46,22 +59,43 @@ type OAuth struct {
 	GoogleClientSecret string   `cli:"optional"`
 	VKAppID            string   `cli:"optional"`
 	VKAppSecret        string   `cli:"optional"`
+	CallbackBaseURL    string   `cli:"optional" usage:"публичный URL api для redirect uri oauth, обязателен при наличии провайдеров"`
+}
+
+type TOTP struct {
+	Issuer        string `default:"fauth"`
+	EncryptionKey string `usage:"ключ 32 байта в hex для шифрования секретов totp"`
+}
+
+type JWT struct {
+	Issuer           string   `default:"fauth" usage:"iss выдаваемых токенов"`
+	Audience         []string `cli:"optional" usage:"aud выдаваемых токенов, по умолчанию issuer"`
+	AllowedIssuers   []string `cli:"optional" usage:"допустимые iss токенов, по умолчанию issuer"`
+	AllowedAudiences []string `cli:"optional" usage:"допустимые aud токенов, по умолчанию audience"`
 }
 
 type App struct {
-	LoginRatelimit         int
+	LoginRatelimit         int    `usage:"максимум попыток входа в минуту с одного ip и для одного логина, 0 отключает, ip берется с учетом доверенных прокси"`
+	LoginLockoutThreshold  int    `default:"5" usage:"неудачных вводов пароля подряд до блокировки, 0 отключает"`
+	LoginLockoutDuration   int    `default:"60" usage:"длительность первой блокировки в секундах, удваивается при каждой следующей ошибке"`
 	AccessTokenCookieName  string `default:"access"`
 	RefreshTokenCookieName string `default:"refresh"`
 	AccessTokenExpiration  int
 	RefreshTokenExpiration int
+	SecretKey              string `usage:"секрет для подписи ссылок в письмах"`
+	FrontendURL            string `usage:"базовый URL для ссылок в письмах"`
 }
 
 type Flags struct {
-	Host                                  string `usage:"host for api server"`
-	Port                                  int    `default:"3000"`
-	Debug                                 bool   `env:"-"`
-	Verbose                               bool   `env:"-"`
-	Test                                  bool   `env:"-"`
-	AccessLog, ErrorLog                   string `cli:"optional"`
-	PrivateKeyPath, PublicKeyPath, JWTKID string
+	Host                          string `usage:"host for api server"`
+	Port                          int    `default:"3000"`
+	Debug                         bool   `env:"-"`
+	Verbose                       bool   `env:"-"`
+	Test                          bool   `env:"-"`
+	AccessLog, ErrorLog           string `cli:"optional"`
+	PrivateKeyPath, PublicKeyPath string
+	JWTKID                        string   `cli:"optional" usage:"kid ключа подписи, по умолчанию отпечаток ключа по RFC 7638, меняется вместе с ключом при перезагрузке"`
+	JWTAlgorithm                  string   `default:"EdDSA" usage:"EdDSA, RS256, PS256 или ES256, должен соответствовать ключу подписи"`
+	JWTKeysDir                    string   `cli:"optional" usage:"директория с публичными ключами только для проверки, имена <kid>.pem или <kid>.<alg>.pem"`
+	JWTVerifyKeys                 []string `cli:"optional" usage:"публичный ключ только для проверки в виде <kid>:<path> или <kid>:<alg>:<path>, можно повторять"`
 }
@@ -212,6 +212,7 @@ func parseField(
 
 			fo := flagOptions[[]string]{
 				flagOptionsCommon: foc,
+				Dest:              dst,
 			}
 
 			if opts.AlreadyHasDefaultValues && !configValueIsZero {
@@ -0,0 +1,8 @@
+package entity
+
+// EmailChange is pending email change request stored in cache.
+type EmailChange struct {
+	NewEmail     string `json:"new_email"`
+	Nonce        string `json:"nonce"`
+	OldConfirmed bool   `json:"old_confirmed"`
+}
@@ -0,0 +1,10 @@
+package entity
+
+import "time"
+
+type RecoveryCode struct {
+	ID     int32      `db:"id"`
+	UserID int32      `db:"user_id"`
+	Code   string     `db:"code"` // hashed
+	UsedAt *time.Time `db:"used_at"`
+}
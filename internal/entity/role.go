@@ -0,0 +1,10 @@
+package entity
+
+type Role struct {
+	ID          int32  `db:"id"`
+	Name        string `db:"name"`
+	Description string `db:"description"`
+
+	// loaded separately
+	Permissions []string `db:"-"`
+}
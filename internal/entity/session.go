@@ -0,0 +1,17 @@
+package entity
+
+import "time"
+
+// Session is created on login, its ID is shared by all refresh tokens
+// rotated from that login.
+type Session struct {
+	ID         string     `db:"id"`
+	UserID     int32      `db:"user_id"`
+	IP         string     `db:"ip"`
+	UserAgent  string     `db:"user_agent"`
+	Device     string     `db:"device"`
+	CreatedAt  time.Time  `db:"created_at"`
+	LastUsedAt time.Time  `db:"last_used_at"`
+	ExpiresAt  time.Time  `db:"expires_at"`
+	RevokedAt  *time.Time `db:"revoked_at"`
+}
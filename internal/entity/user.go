@@ -8,14 +8,18 @@ type User struct {
 	Username string  `db:"username"`
 	Password *string `db:"password"`
 
-	// Roles
-	// Permissions
-
 	Active   bool `db:"active"`
 	Verified bool `db:"verified"`
 
+	TOTPSecret  *string `db:"totp_secret"`
+	TOTPEnabled bool    `db:"totp_enabled"`
+
 	CreatedAt time.Time `db:"created_at"`
 	LastLogin time.Time `db:"last_login"`
 
-	// OAuth
+	// role names, permissions of these roles
+	// and linked oauth providers, loaded separately
+	Roles       []string `db:"-"`
+	Permissions []string `db:"-"`
+	OAuth       []string `db:"-"`
 }
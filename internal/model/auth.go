@@ -182,25 +182,116 @@ func validatePassword(password1 string, password2 string) error {
 	return nil
 }
 
+type EmailChangeRequest struct {
+	Email string `json:"email"`
+}
+
+func (r *EmailChangeRequest) Validate() error {
+	email, err := validateEmail(r.Email)
+	if err != nil {
+		return NewValidationError(err)
+	}
+	r.Email = email
+
+	return nil
+}
+
+type ForgotPasswordRequest struct {
+	Email   string `json:"email"`
+	Captcha string `json:"captcha"`
+}
+
+type ResetPasswordRequest struct {
+	Token     string `json:"token"`
+	Password1 string `json:"password1"`
+	Password2 string `json:"password2"`
+}
+
+func (r *ResetPasswordRequest) Validate() error {
+	if err := validatePassword(r.Password1, r.Password2); err != nil {
+		return NewValidationError(err)
+	}
+
+	return nil
+}
+
+type ChangePasswordRequest struct {
+	OldPassword string `json:"old_password"`
+	Password1   string `json:"password1"`
+	Password2   string `json:"password2"`
+}
+
+func (r *ChangePasswordRequest) Validate() error {
+	if err := validatePassword(r.Password1, r.Password2); err != nil {
+		return NewValidationError(err)
+	}
+
+	return nil
+}
+
+type SetPasswordRequest struct {
+	Password1 string `json:"password1"`
+	Password2 string `json:"password2"`
+}
+
+func (r *SetPasswordRequest) Validate() error {
+	if err := validatePassword(r.Password1, r.Password2); err != nil {
+		return NewValidationError(err)
+	}
+
+	return nil
+}
+
+type PasswordStatus struct {
+	HasPassword bool `json:"has_password"`
+}
+
 type LoginRequest struct {
 	Login    string `json:"login"`
 	Password string `json:"password"`
 }
 
+// TokensResponse is returned instead of cookies when client asks for it.
+type TokensResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
 type Me struct {
-	ID       int32  `json:"id"`
-	Email    string `json:"email"`
-	Username string `json:"username"`
-	Verified bool   `json:"verified"`
-	// Roles
-	// OAuth
+	ID          int32    `json:"id"`
+	Email       string   `json:"email"`
+	Username    string   `json:"username"`
+	Verified    bool     `json:"verified"`
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+	OAuth       []string `json:"oauth"`
 }
 
 func MeFromUser(user *entity.User) *Me {
+	roles := user.Roles
+	if roles == nil {
+		roles = []string{}
+	}
+
+	permissions := user.Permissions
+	if permissions == nil {
+		permissions = []string{}
+	}
+
+	oauth := user.OAuth
+	if oauth == nil {
+		oauth = []string{}
+	}
+
 	return &Me{
-		ID:       user.ID,
-		Email:    user.Email,
-		Username: user.Username,
-		Verified: user.Verified,
+		ID:          user.ID,
+		Email:       user.Email,
+		Username:    user.Username,
+		Verified:    user.Verified,
+		Roles:       roles,
+		Permissions: permissions,
+		OAuth:       oauth,
 	}
 }
@@ -0,0 +1,78 @@
+package model
+
+import (
+	"context"
+	"strings"
+)
+
+// Client describes where request came from, it is put into context
+// by api middleware.
+type Client struct {
+	IP        string
+	UserAgent string
+}
+
+type clientContextKey struct{}
+
+func ContextWithClient(ctx context.Context, client *Client) context.Context {
+	return context.WithValue(ctx, clientContextKey{}, client)
+}
+
+// ClientFromContext returns empty client if there is none in context.
+func ClientFromContext(ctx context.Context) *Client {
+	client, ok := ctx.Value(clientContextKey{}).(*Client)
+	if !ok {
+		return &Client{}
+	}
+
+	return client
+}
+
+var (
+	userAgentBrowsers = []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"YaBrowser/", "Yandex Browser"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+	}
+	userAgentSystems = []struct{ token, name string }{
+		{"Android", "Android"},
+		{"iPhone", "iOS"},
+		{"iPad", "iPadOS"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"Linux", "Linux"},
+	}
+)
+
+// Device returns short human readable description of user agent,
+// e.g. "Firefox on Linux".
+func (c *Client) Device() string {
+	var browser, system string
+	for _, b := range userAgentBrowsers {
+		if strings.Contains(c.UserAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+
+	for _, s := range userAgentSystems {
+		if strings.Contains(c.UserAgent, s.token) {
+			system = s.name
+			break
+		}
+	}
+
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case system != "":
+		return system
+	default:
+		return "Unknown"
+	}
+}
@@ -1,5 +1,9 @@
 package model
 
+// UsersPrefix is where users router is mounted, paths that are given
+// out of server (cookie path, oauth redirect uri) are built from it.
+const UsersPrefix = "/api/v1/users"
+
 type ValidationError struct {
 	Inner error
 }
@@ -11,3 +15,8 @@ func (err *ValidationError) Error() string {
 func NewValidationError(err error) error {
 	return &ValidationError{Inner: err}
 }
+
+// TokenRequest carries token from signed link.
+type TokenRequest struct {
+	Token string `json:"token"`
+}
@@ -0,0 +1,46 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	PermissionUsersMassLogout = "users:mass_logout"
+	PermissionUsersBan        = "users:ban"
+	PermissionUsersKick       = "users:kick"
+	PermissionUsersRoles      = "users:roles"
+	PermissionRolesRead       = "roles:read"
+	PermissionRolesWrite      = "roles:write"
+)
+
+// Permissions lists all permissions that can be attached to role.
+var Permissions = []string{
+	PermissionUsersMassLogout,
+	PermissionUsersBan,
+	PermissionUsersKick,
+	PermissionUsersRoles,
+	PermissionRolesRead,
+	PermissionRolesWrite,
+}
+
+var ErrPermissionUnknown = errors.New("unknown permission")
+
+func validatePermissions(permissions []string) ([]string, error) {
+	result := make([]string, 0, len(permissions))
+	for _, permission := range permissions {
+		permission = strings.TrimSpace(permission)
+		if !slices.Contains(Permissions, permission) {
+			return nil, fmt.Errorf("%w: %s", ErrPermissionUnknown, permission)
+		}
+
+		if !slices.Contains(result, permission) {
+			result = append(result, permission)
+		}
+	}
+
+	slices.Sort(result)
+	return result, nil
+}
@@ -0,0 +1,115 @@
+package model
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/pegov/fauth-backend-go/internal/entity"
+)
+
+// RoleAdmin is created by init.sql with all permissions, it can't be
+// renamed or deleted.
+const RoleAdmin = "admin"
+
+var roleNameRe = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+var (
+	ErrRoleNameWrong  = errors.New("role name wrong")
+	ErrRoleNameLength = errors.New("role name length")
+)
+
+const (
+	roleNameMaxLength        = 32
+	roleDescriptionMaxLength = 255
+)
+
+func validateRoleName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if len(name) == 0 || len(name) > roleNameMaxLength {
+		return "", ErrRoleNameLength
+	}
+
+	if !roleNameRe.MatchString(name) {
+		return "", ErrRoleNameWrong
+	}
+
+	return name, nil
+}
+
+var ErrRoleDescriptionLength = errors.New("role description length")
+
+// RoleCreate is used both for creating and updating role.
+type RoleCreate struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+func (r *RoleCreate) Validate() error {
+	name, err := validateRoleName(r.Name)
+	if err != nil {
+		return NewValidationError(err)
+	}
+	r.Name = name
+
+	r.Description = strings.TrimSpace(r.Description)
+	if len(r.Description) > roleDescriptionMaxLength {
+		return NewValidationError(ErrRoleDescriptionLength)
+	}
+
+	permissions, err := validatePermissions(r.Permissions)
+	if err != nil {
+		return NewValidationError(err)
+	}
+	r.Permissions = permissions
+
+	return nil
+}
+
+type Role struct {
+	ID          int32    `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+func RoleFromEntity(role *entity.Role) *Role {
+	permissions := role.Permissions
+	if permissions == nil {
+		permissions = []string{}
+	}
+
+	return &Role{
+		ID:          role.ID,
+		Name:        role.Name,
+		Description: role.Description,
+		Permissions: permissions,
+	}
+}
+
+func RolesFromEntities(roles []entity.Role) []*Role {
+	result := make([]*Role, 0, len(roles))
+	for i := range roles {
+		result = append(result, RoleFromEntity(&roles[i]))
+	}
+
+	return result
+}
+
+// UserRolesUpdate replaces all roles of user with roles listed by name.
+type UserRolesUpdate struct {
+	Roles []string `json:"roles"`
+}
+
+func (r *UserRolesUpdate) Validate() error {
+	for i, name := range r.Roles {
+		name, err := validateRoleName(name)
+		if err != nil {
+			return NewValidationError(err)
+		}
+		r.Roles[i] = name
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package model
+
+import (
+	"errors"
+	"os"
+	"regexp"
+	"slices"
+	"testing"
+)
+
+func TestValidatePermissions(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      []string
+		wantOutput []string
+		wantErr    error
+	}{
+		{"Permissions may be empty", []string{}, []string{}, nil},
+		{
+			"Permissions must be known",
+			[]string{PermissionUsersBan, "users:delete"},
+			nil,
+			ErrPermissionUnknown,
+		},
+		{
+			"Permissions are sorted and deduplicated",
+			[]string{PermissionUsersKick, " " + PermissionUsersBan, PermissionUsersKick},
+			[]string{PermissionUsersBan, PermissionUsersKick},
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output, err := validatePermissions(tt.input)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("%s: got err = %v, want = %v", tt.name, err, tt.wantErr)
+			}
+
+			if !slices.Equal(output, tt.wantOutput) {
+				t.Fatalf("%s: got output = %v, want = %v", tt.name, output, tt.wantOutput)
+			}
+		})
+	}
+}
+
+var adminSeedRe = regexp.MustCompile(`(?s)unnest\(ARRAY\[(.*?)\]\).*?WHERE r\.name = 'admin'`)
+
+// init.sql can't import Permissions, admin role there must get all of them.
+func TestAdminSeedHasAllPermissions(t *testing.T) {
+	data, err := os.ReadFile("../../resources/sql/init.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	match := adminSeedRe.FindSubmatch(data)
+	if match == nil {
+		t.Fatal("admin permissions not found in init.sql")
+	}
+
+	var seeded []string
+	for _, m := range regexp.MustCompile(`'([^']*)'`).FindAllSubmatch(match[1], -1) {
+		seeded = append(seeded, string(m[1]))
+	}
+
+	want := slices.Clone(Permissions)
+	slices.Sort(want)
+	slices.Sort(seeded)
+	if !slices.Equal(want, seeded) {
+		t.Fatalf("init.sql admin permissions: got = %v, want = %v", seeded, want)
+	}
+}
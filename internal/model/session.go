@@ -0,0 +1,29 @@
+package model
+
+import (
+	"time"
+
+	"github.com/pegov/fauth-backend-go/internal/entity"
+)
+
+type Session struct {
+	ID         string    `json:"id"`
+	Device     string    `json:"device"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	Current    bool      `json:"current"`
+}
+
+func SessionFromEntity(session *entity.Session, currentID string) *Session {
+	return &Session{
+		ID:         session.ID,
+		Device:     session.Device,
+		IP:         session.IP,
+		UserAgent:  session.UserAgent,
+		CreatedAt:  session.CreatedAt,
+		LastUsedAt: session.LastUsedAt,
+		Current:    session.ID == currentID,
+	}
+}
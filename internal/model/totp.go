@@ -0,0 +1,25 @@
+package model
+
+type TOTPSetup struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type TOTPCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// LoginTOTPRequest.Code is either totp code or one of recovery codes.
+type LoginTOTPRequest struct {
+	Token string `json:"token"`
+	Code  string `json:"code"`
+}
+
+type RecoveryCodes struct {
+	Codes []string `json:"codes"`
+}
+
+type MFAChallenge struct {
+	MFARequired bool   `json:"mfa_required"`
+	Token       string `json:"token"`
+}
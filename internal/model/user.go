@@ -8,6 +8,6 @@ type User struct {
 type UserCreate struct {
 	Email    string
 	Username string
-	Password string
+	Password *string // nil for oauth users
 	Verified bool
 }
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 
 	"github.com/golang-jwt/jwt/v5"
 )
@@ -42,11 +43,11 @@ func (p *GoogleOAuthProvider) CreateOAuthURI(redirectURI, state string) string {
 			"?scope=email%%20profile"+
 			"&response_type=code"+
 			"&state=%s"+
-			"redirect_uri=%s"+
+			"&redirect_uri=%s"+
 			"&client_id=%s",
-		state,
-		redirectURI,
-		p.ClientID,
+		url.QueryEscape(state),
+		url.QueryEscape(redirectURI),
+		url.QueryEscape(p.ClientID),
 	)
 }
 
@@ -86,7 +87,9 @@ func (p *GoogleOAuthProvider) GetUserData(redirectURI, code string) (*OAuthRespo
 		return nil, err
 	}
 
-	token, err := jwt.Parse(response.IDToken, nil, jwt.WithoutClaimsValidation())
+	// id_token is received directly from google over tls,
+	// so signature verification can be skipped
+	token, _, err := jwt.NewParser().ParseUnverified(response.IDToken, jwt.MapClaims{})
 	if err != nil {
 		return nil, err
 	}
@@ -96,17 +99,31 @@ func (p *GoogleOAuthProvider) GetUserData(redirectURI, code string) (*OAuthRespo
 		return nil, errors.New("failed to cast response to map")
 	}
 
-	sub, ok := claims["sub"]
-	if !ok {
+	return googleUserData(claims)
+}
+
+func googleUserData(claims jwt.MapClaims) (*OAuthResponse, error) {
+	sub, ok := claims["sub"].(string)
+	if !ok || sub == "" {
 		return nil, errors.New("failed to get \"sub\"")
 	}
-	email, ok := claims["email"]
-	if !ok {
+	email, ok := claims["email"].(string)
+	if !ok || email == "" {
 		return nil, errors.New("failed to get \"email\"")
 	}
 
+	// missing "email_verified" means that email is not verified
+	var emailVerified bool
+	switch v := claims["email_verified"].(type) {
+	case bool:
+		emailVerified = v
+	case string:
+		emailVerified = v == "true"
+	}
+
 	return &OAuthResponse{
-		SID:   sub.(string),
-		Email: email.(string),
+		SID:           sub,
+		Email:         email,
+		EmailVerified: emailVerified,
 	}, nil
 }
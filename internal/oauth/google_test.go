@@ -0,0 +1,54 @@
+package oauth
+
+import (
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGoogleUserData(t *testing.T) {
+	tests := []struct {
+		name     string
+		claims   jwt.MapClaims
+		expected *OAuthResponse
+	}{
+		{
+			"verified",
+			jwt.MapClaims{"sub": "1", "email": "user@example.com", "email_verified": true},
+			&OAuthResponse{SID: "1", Email: "user@example.com", EmailVerified: true},
+		},
+		{
+			"verified string",
+			jwt.MapClaims{"sub": "1", "email": "user@example.com", "email_verified": "true"},
+			&OAuthResponse{SID: "1", Email: "user@example.com", EmailVerified: true},
+		},
+		{
+			"not verified",
+			jwt.MapClaims{"sub": "1", "email": "user@example.com", "email_verified": false},
+			&OAuthResponse{SID: "1", Email: "user@example.com"},
+		},
+		{
+			"no email_verified",
+			jwt.MapClaims{"sub": "1", "email": "user@example.com"},
+			&OAuthResponse{SID: "1", Email: "user@example.com"},
+		},
+		{"no sub", jwt.MapClaims{"email": "user@example.com"}, nil},
+		{"sub not string", jwt.MapClaims{"sub": 1, "email": "user@example.com"}, nil},
+		{"no email", jwt.MapClaims{"sub": "1"}, nil},
+		{"email not string", jwt.MapClaims{"sub": "1", "email": nil}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := googleUserData(tt.claims)
+			if tt.expected == nil {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, data)
+		})
+	}
+}
@@ -1,8 +1,9 @@
 package oauth
 
 type OAuthResponse struct {
-	SID   string
-	Email string
+	SID           string
+	Email         string
+	EmailVerified bool
 }
 
 type OAuthProvider interface {
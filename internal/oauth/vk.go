@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 )
@@ -46,9 +47,9 @@ func (p *VKOAuthProvider) CreateOAuthURI(redirectURI, state string) string {
 			"&response_type=code"+
 			"&v=5.122"+
 			"&state=%s",
-		p.ClientID,
-		redirectURI,
-		state,
+		url.QueryEscape(p.ClientID),
+		url.QueryEscape(redirectURI),
+		url.QueryEscape(state),
 	)
 }
 
@@ -89,8 +90,10 @@ func (p *VKOAuthProvider) GetUserData(redirectURI, code string) (*OAuthResponse,
 		return nil, errors.New("email not found")
 	}
 
+	// vk gives out only confirmed emails
 	return &OAuthResponse{
-		SID:   strconv.FormatInt(response.UserID, 10),
-		Email: *response.Email,
+		SID:           strconv.FormatInt(response.UserID, 10),
+		Email:         *response.Email,
+		EmailVerified: true,
 	}, nil
 }
@@ -0,0 +1,232 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/pegov/fauth-backend-go/internal/entity"
+	"github.com/pegov/fauth-backend-go/internal/model"
+	"github.com/pegov/fauth-backend-go/internal/storage"
+)
+
+type RoleRepo interface {
+	Get(ctx context.Context, id int32) (*entity.Role, error)
+	GetByName(ctx context.Context, name string) (*entity.Role, error)
+	GetAll(ctx context.Context) ([]entity.Role, error)
+	Create(ctx context.Context, data *model.RoleCreate) (int32, error)
+	Update(ctx context.Context, id int32, data *model.RoleCreate) error
+	Delete(ctx context.Context, id int32) error
+	GetUserRoles(ctx context.Context, userID int32) ([]string, error)
+	SetUserRoles(ctx context.Context, userID int32, roleIDs []int32) error
+	LockRoleUsers(ctx context.Context, roleID int32) ([]int32, error)
+	GetPermissions(ctx context.Context, roleID int32) ([]string, error)
+	SetPermissions(ctx context.Context, roleID int32, permissions []string) error
+	GetUserPermissions(ctx context.Context, userID int32) ([]string, error)
+}
+
+type roleRepo struct {
+	db storage.DB
+}
+
+func NewRoleRepo(db storage.DB) RoleRepo {
+	return &roleRepo{db: db}
+}
+
+func (r *roleRepo) Get(ctx context.Context, id int32) (*entity.Role, error) {
+	var role entity.Role
+	if err := r.db.GetContext(
+		ctx,
+		&role,
+		"SELECT id, name, description FROM auth_role WHERE id = $1",
+		id,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return &role, nil
+}
+
+func (r *roleRepo) GetByName(ctx context.Context, name string) (*entity.Role, error) {
+	var role entity.Role
+	if err := r.db.GetContext(
+		ctx,
+		&role,
+		"SELECT id, name, description FROM auth_role WHERE name = $1",
+		name,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return &role, nil
+}
+
+func (r *roleRepo) GetAll(ctx context.Context) ([]entity.Role, error) {
+	roles := []entity.Role{}
+	if err := r.db.SelectContext(
+		ctx,
+		&roles,
+		"SELECT id, name, description FROM auth_role ORDER BY id",
+	); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+func (r *roleRepo) Create(ctx context.Context, data *model.RoleCreate) (int32, error) {
+	var id int32
+	if err := r.db.GetContext(
+		ctx,
+		&id,
+		"INSERT INTO auth_role(name, description) VALUES ($1, $2) RETURNING id",
+		data.Name,
+		data.Description,
+	); err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+func (r *roleRepo) Update(ctx context.Context, id int32, data *model.RoleCreate) error {
+	_, err := r.db.ExecContext(
+		ctx,
+		"UPDATE auth_role SET name = $1, description = $2 WHERE id = $3",
+		data.Name,
+		data.Description,
+		id,
+	)
+	return err
+}
+
+func (r *roleRepo) Delete(ctx context.Context, id int32) error {
+	_, err := r.db.ExecContext(ctx, "DELETE FROM auth_role WHERE id = $1", id)
+	return err
+}
+
+func (r *roleRepo) GetUserRoles(ctx context.Context, userID int32) ([]string, error) {
+	roles := []string{}
+	if err := r.db.SelectContext(
+		ctx,
+		&roles,
+		`
+		SELECT r.name
+		FROM auth_role r
+		JOIN auth_user_role ur ON ur.role_id = r.id
+		WHERE ur.user_id = $1
+		ORDER BY r.name
+		`,
+		userID,
+	); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// SetUserRoles replaces roles of user, should be called inside transaction.
+func (r *roleRepo) SetUserRoles(ctx context.Context, userID int32, roleIDs []int32) error {
+	if _, err := r.db.ExecContext(
+		ctx,
+		"DELETE FROM auth_user_role WHERE user_id = $1",
+		userID,
+	); err != nil {
+		return err
+	}
+
+	for _, roleID := range roleIDs {
+		if _, err := r.db.ExecContext(
+			ctx,
+			"INSERT INTO auth_user_role(user_id, role_id) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+			userID,
+			roleID,
+		); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LockRoleUsers returns users that have role, should be called inside
+// transaction, their rows stay locked until it ends.
+func (r *roleRepo) LockRoleUsers(ctx context.Context, roleID int32) ([]int32, error) {
+	userIDs := []int32{}
+	if err := r.db.SelectContext(
+		ctx,
+		&userIDs,
+		"SELECT user_id FROM auth_user_role WHERE role_id = $1 ORDER BY user_id FOR UPDATE",
+		roleID,
+	); err != nil {
+		return nil, err
+	}
+
+	return userIDs, nil
+}
+
+func (r *roleRepo) GetPermissions(ctx context.Context, roleID int32) ([]string, error) {
+	permissions := []string{}
+	if err := r.db.SelectContext(
+		ctx,
+		&permissions,
+		"SELECT permission FROM auth_role_permission WHERE role_id = $1 ORDER BY permission",
+		roleID,
+	); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+// SetPermissions replaces permissions of role, should be called inside transaction.
+func (r *roleRepo) SetPermissions(ctx context.Context, roleID int32, permissions []string) error {
+	if _, err := r.db.ExecContext(
+		ctx,
+		"DELETE FROM auth_role_permission WHERE role_id = $1",
+		roleID,
+	); err != nil {
+		return err
+	}
+
+	for _, permission := range permissions {
+		if _, err := r.db.ExecContext(
+			ctx,
+			"INSERT INTO auth_role_permission(role_id, permission) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+			roleID,
+			permission,
+		); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *roleRepo) GetUserPermissions(ctx context.Context, userID int32) ([]string, error) {
+	permissions := []string{}
+	if err := r.db.SelectContext(
+		ctx,
+		&permissions,
+		`
+		SELECT DISTINCT rp.permission
+		FROM auth_role_permission rp
+		JOIN auth_user_role ur ON ur.role_id = rp.role_id
+		WHERE ur.user_id = $1
+		ORDER BY rp.permission
+		`,
+		userID,
+	); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
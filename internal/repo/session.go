@@ -0,0 +1,139 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/pegov/fauth-backend-go/internal/entity"
+	"github.com/pegov/fauth-backend-go/internal/storage"
+)
+
+type SessionRepo interface {
+	Get(ctx context.Context, id string) (*entity.Session, error)
+	GetActiveByUser(ctx context.Context, userID int32) ([]entity.Session, error)
+	Create(ctx context.Context, session *entity.Session) error
+	Touch(ctx context.Context, id string, lastUsedAt, expiresAt time.Time) error
+	Revoke(ctx context.Context, id string) error
+}
+
+type sessionRepo struct {
+	db storage.DB
+}
+
+func NewSessionRepo(db storage.DB) SessionRepo {
+	return &sessionRepo{db: db}
+}
+
+func (r *sessionRepo) Get(ctx context.Context, id string) (*entity.Session, error) {
+	var session entity.Session
+	if err := r.db.GetContext(
+		ctx,
+		&session,
+		`
+		SELECT
+			id,
+			user_id,
+			ip,
+			user_agent,
+			device,
+			created_at,
+			last_used_at,
+			expires_at,
+			revoked_at
+		FROM auth_session WHERE id = $1
+		`,
+		id,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+// GetActiveByUser returns not revoked and not expired sessions, last used first.
+func (r *sessionRepo) GetActiveByUser(ctx context.Context, userID int32) ([]entity.Session, error) {
+	sessions := []entity.Session{}
+	if err := r.db.SelectContext(
+		ctx,
+		&sessions,
+		`
+		SELECT
+			id,
+			user_id,
+			ip,
+			user_agent,
+			device,
+			created_at,
+			last_used_at,
+			expires_at,
+			revoked_at
+		FROM auth_session
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > $2
+		ORDER BY last_used_at DESC
+		`,
+		userID,
+		time.Now().UTC(),
+	); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+func (r *sessionRepo) Create(ctx context.Context, session *entity.Session) error {
+	_, err := r.db.ExecContext(
+		ctx,
+		`
+		INSERT INTO auth_session(
+			id,
+			user_id,
+			ip,
+			user_agent,
+			device,
+			created_at,
+			last_used_at,
+			expires_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		`,
+		session.ID,
+		session.UserID,
+		session.IP,
+		session.UserAgent,
+		session.Device,
+		session.CreatedAt,
+		session.LastUsedAt,
+		session.ExpiresAt,
+	)
+	return err
+}
+
+func (r *sessionRepo) Touch(
+	ctx context.Context,
+	id string,
+	lastUsedAt, expiresAt time.Time,
+) error {
+	_, err := r.db.ExecContext(
+		ctx,
+		"UPDATE auth_session SET last_used_at = $1, expires_at = $2 WHERE id = $3",
+		lastUsedAt,
+		expiresAt,
+		id,
+	)
+	return err
+}
+
+func (r *sessionRepo) Revoke(ctx context.Context, id string) error {
+	_, err := r.db.ExecContext(
+		ctx,
+		"UPDATE auth_session SET revoked_at = $1 WHERE id = $2 AND revoked_at IS NULL",
+		time.Now().UTC(),
+		id,
+	)
+	return err
+}
@@ -1,7 +1,71 @@
 package repo
 
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/pegov/fauth-backend-go/internal/storage"
+)
+
+// withTx runs fn inside transaction, db must not be transaction already.
+func withTx(
+	ctx context.Context,
+	db storage.DB,
+	fn func(tx storage.DB) error,
+) (err error) {
+	sqlxDB, ok := db.(*sqlx.DB)
+	if !ok {
+		return errors.New("nested transactions are unsupported")
+	}
+
+	tx, err := sqlxDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("db.BeginTxx: %w", err)
+	}
+	defer func() {
+		if e := tx.Rollback(); e != nil && !errors.Is(e, sql.ErrTxDone) {
+			if err != nil {
+				err = fmt.Errorf("%w, tx.Rollback: %w", err, e)
+			} else {
+				err = fmt.Errorf("tx.Rollback: %w", e)
+			}
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		return fmt.Errorf("fn: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("tx.Commit: %w", err)
+	}
+
+	return nil
+}
+
 type UserRoleAdapter struct {
-	ur UserRepo
-	// rr RoleRepo
-	// TODO: with tx method
+	db    storage.DB
+	cache storage.CacheOps
+}
+
+func NewUserRoleAdapter(db storage.DB, cache storage.CacheOps) *UserRoleAdapter {
+	return &UserRoleAdapter{db: db, cache: cache}
+}
+
+// WithTx gives fn user and role repos that share one transaction.
+func (a *UserRoleAdapter) WithTx(
+	ctx context.Context,
+	fn func(context.Context, UserRepo, RoleRepo) error,
+) error {
+	return withTx(ctx, a.db, func(tx storage.DB) error {
+		return fn(ctx, NewUserRepo(tx, a.cache), NewRoleRepo(tx))
+	})
+}
+
+type UserRoleTransactor interface {
+	WithTx(ctx context.Context, fn func(context.Context, UserRepo, RoleRepo) error) error
 }
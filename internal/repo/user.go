@@ -3,13 +3,14 @@ package repo
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/jmoiron/sqlx"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/redis/go-redis/v9"
 
 	"github.com/pegov/fauth-backend-go/internal/entity"
@@ -19,20 +20,57 @@ import (
 
 type UserRepo interface {
 	Get(ctx context.Context, id int32) (*entity.User, error)
+	GetForUpdate(ctx context.Context, id int32) (*entity.User, error)
 	GetByEmail(ctx context.Context, email string) (*entity.User, error)
 	GetByUsername(ctx context.Context, username string) (*entity.User, error)
 	GetByLogin(ctx context.Context, login string) (*entity.User, error)
+	GetByOAuth(ctx context.Context, provider, sid string) (*entity.User, error)
+	CreateOAuth(ctx context.Context, userID int32, provider, sid string) error
+	DeleteOAuth(ctx context.Context, userID int32, provider string) error
+	GetOAuthProviders(ctx context.Context, userID int32) ([]string, error)
+	SetOAuthState(ctx context.Context, state, value string, expiration time.Duration) error
+	PopOAuthState(ctx context.Context, state string) (string, error)
 	Create(ctx context.Context, data *model.UserCreate) (int32, error)
 	UpdateLastLogin(ctx context.Context, id int32) error
+	UpdateTOTP(ctx context.Context, id int32, secret *string, enabled bool) error
+	UpdateVerified(ctx context.Context, id int32, verified bool) error
+	UpdateEmail(ctx context.Context, id int32, email string) error
+	UpdatePassword(ctx context.Context, id int32, password *string) error
+	SetPassword(ctx context.Context, id int32, password string) (bool, error)
+	SetPasswordResetNonce(ctx context.Context, id int32, nonce string, expiration time.Duration) error
+	UsePasswordResetNonce(ctx context.Context, id int32, nonce string) (bool, error)
+	GetEmailChange(ctx context.Context, id int32) (*entity.EmailChange, error)
+	SetEmailChange(ctx context.Context, id int32, change *entity.EmailChange, expiration time.Duration) error
+	DeleteEmailChange(ctx context.Context, id int32) error
+	StartCooldown(ctx context.Context, action string, id int32, duration time.Duration) (time.Duration, error)
+	HitRateLimit(ctx context.Context, key string, limit int, window time.Duration) (time.Duration, error)
+	AddLoginFailure(ctx context.Context, key string, expiration time.Duration) (int64, error)
+	LockLogin(ctx context.Context, key string, duration time.Duration) error
+	GetLoginLock(ctx context.Context, key string) (time.Duration, error)
+	ClearLoginFailures(ctx context.Context, key string) error
+	GetRecoveryCodes(ctx context.Context, userID int32) ([]entity.RecoveryCode, error)
+	CreateRecoveryCodes(ctx context.Context, userID int32, codes []string) error
+	DeleteRecoveryCodes(ctx context.Context, userID int32) error
+	UseRecoveryCode(ctx context.Context, id int32) (bool, error)
 	GetMassLogout(ctx context.Context) (*time.Time, error)
 	ActivateMassLogout(ctx context.Context, refreshTokenExpiration time.Duration) error
 	DeactivateMassLogout(ctx context.Context) error
 	Ban(ctx context.Context, id int32) error
 	Unban(ctx context.Context, id int32) error
-	Kick(ctx context.Context, id int32) error
+	Kick(ctx context.Context, id int32, refreshTokenExpiration time.Duration) error
 	Unkick(ctx context.Context, id int32) error
 	WasRecentlyBanned(ctx context.Context, id int32) (bool, error)
-	IsKicked(ctx context.Context, id int32) (bool, error)
+	GetKick(ctx context.Context, id int32) (*time.Time, error)
+	GetRefreshFamily(ctx context.Context, family string) (string, error)
+	SetRefreshFamily(ctx context.Context, family, jti string, expiration time.Duration) error
+	RotateRefreshFamily(ctx context.Context, family, oldJTI, newJTI string, expiration time.Duration) (bool, error)
+	GetRotatedRefreshFamily(ctx context.Context, family string) (string, error)
+	DeleteRefreshFamily(ctx context.Context, family string) error
+	DenySession(ctx context.Context, sessionID string, expiration time.Duration) error
+	IsSessionDenied(ctx context.Context, sessionID string) (bool, error)
+	UseMFAToken(ctx context.Context, jti string, expiration time.Duration) (bool, error)
+	IsMFATokenUsed(ctx context.Context, jti string) (bool, error)
+	UseTOTPStep(ctx context.Context, id int32, step uint64, expiration time.Duration) (bool, error)
 	WithTx(context.Context, func(context.Context, UserRepo) error) error
 }
 
@@ -45,37 +83,10 @@ func NewUserRepo(db storage.DB, cache storage.CacheOps) UserRepo {
 	return &userRepo{db: db, cache: cache}
 }
 
-func (r *userRepo) WithTx(ctx context.Context, fn func(context.Context, UserRepo) error) (err error) {
-	db, ok := r.db.(*sqlx.DB)
-	if !ok {
-		return errors.New("nested transactions are unsupported")
-	}
-
-	tx, err := db.BeginTxx(ctx, nil)
-	if err != nil {
-		return fmt.Errorf("db.BeginTxx: %w", err)
-	}
-	defer func() {
-		if e := tx.Rollback(); e != nil {
-			if err != nil {
-				err = fmt.Errorf("%w, tx.Rollback: %w", err, e)
-			} else {
-				err = fmt.Errorf("tx.Rollback: %w", e)
-			}
-		}
-	}()
-
-	txRepo := NewUserRepo(tx, r.cache)
-
-	if err := fn(ctx, txRepo); err != nil {
-		return fmt.Errorf("fn: %w", err)
-	}
-
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("tx.Commit: %w", err)
-	}
-
-	return nil
+func (r *userRepo) WithTx(ctx context.Context, fn func(context.Context, UserRepo) error) error {
+	return withTx(ctx, r.db, func(tx storage.DB) error {
+		return fn(ctx, NewUserRepo(tx, r.cache))
+	})
 }
 
 func (r *userRepo) Create(ctx context.Context, data *model.UserCreate) (int32, error) {
@@ -110,6 +121,16 @@ func (r *userRepo) Create(ctx context.Context, data *model.UserCreate) (int32, e
 }
 
 func (r *userRepo) Get(ctx context.Context, id int32) (*entity.User, error) {
+	return r.get(ctx, id, "")
+}
+
+// GetForUpdate locks user row until the end of transaction, should be
+// called inside transaction.
+func (r *userRepo) GetForUpdate(ctx context.Context, id int32) (*entity.User, error) {
+	return r.get(ctx, id, "FOR UPDATE")
+}
+
+func (r *userRepo) get(ctx context.Context, id int32, lock string) (*entity.User, error) {
 	var user entity.User
 	if err := r.db.GetContext(
 		ctx,
@@ -122,10 +143,12 @@ func (r *userRepo) Get(ctx context.Context, id int32) (*entity.User, error) {
 			password,
 			active,
 			verified,
+			totp_secret,
+			totp_enabled,
 			created_at,
 			last_login
 		FROM auth_user WHERE id = $1
-		`,
+		`+lock,
 		id,
 	); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -151,6 +174,8 @@ func (r *userRepo) GetByEmail(ctx context.Context, email string) (*entity.User,
 			password,
 			active,
 			verified,
+			totp_secret,
+			totp_enabled,
 			created_at,
 			last_login
 		FROM auth_user WHERE email = $1
@@ -180,6 +205,8 @@ func (r *userRepo) GetByUsername(ctx context.Context, username string) (*entity.
 			password,
 			active,
 			verified,
+			totp_secret,
+			totp_enabled,
 			created_at,
 			last_login
 		FROM auth_user WHERE username = $1
@@ -211,16 +238,454 @@ func (r *userRepo) GetByLogin(ctx context.Context, login string) (*entity.User,
 	return r.GetByUsername(ctx, login)
 }
 
+func (r *userRepo) GetByOAuth(
+	ctx context.Context,
+	provider, sid string,
+) (*entity.User, error) {
+	var user entity.User
+	if err := r.db.GetContext(
+		ctx,
+		&user,
+		`
+		SELECT
+			u.id,
+			u.email,
+			u.username,
+			u.password,
+			u.active,
+			u.verified,
+			u.totp_secret,
+			u.totp_enabled,
+			u.created_at,
+			u.last_login
+		FROM auth_user u
+		JOIN auth_oauth o ON o.user_id = u.id
+		WHERE o.provider = $1 AND o.sid = $2
+		`,
+		provider,
+		sid,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (r *userRepo) CreateOAuth(
+	ctx context.Context,
+	userID int32,
+	provider, sid string,
+) error {
+	_, err := r.db.ExecContext(
+		ctx,
+		"INSERT INTO auth_oauth(user_id, provider, sid) VALUES ($1, $2, $3)",
+		userID,
+		provider,
+		sid,
+	)
+	return err
+}
+
+func (r *userRepo) DeleteOAuth(ctx context.Context, userID int32, provider string) error {
+	_, err := r.db.ExecContext(
+		ctx,
+		"DELETE FROM auth_oauth WHERE user_id = $1 AND provider = $2",
+		userID,
+		provider,
+	)
+	return err
+}
+
+func (r *userRepo) GetOAuthProviders(ctx context.Context, userID int32) ([]string, error) {
+	providers := []string{}
+	if err := r.db.SelectContext(
+		ctx,
+		&providers,
+		"SELECT provider FROM auth_oauth WHERE user_id = $1 ORDER BY provider",
+		userID,
+	); err != nil {
+		return nil, err
+	}
+
+	return providers, nil
+}
+
+func (r *userRepo) SetOAuthState(
+	ctx context.Context,
+	state, value string,
+	expiration time.Duration,
+) error {
+	key := fmt.Sprintf("oauth:state:%s", state)
+	return r.cache.Set(ctx, key, value, expiration).Err()
+}
+
+// PopOAuthState returns empty string if state is unknown, state can be used once.
+func (r *userRepo) PopOAuthState(ctx context.Context, state string) (string, error) {
+	key := fmt.Sprintf("oauth:state:%s", state)
+	// only one of concurrent callbacks gets the value
+	s, err := r.cache.GetDel(ctx, key).Result()
+	if err != nil {
+		if isNil(err) {
+			return "", nil
+		}
+
+		return "", err
+	}
+
+	return s, nil
+}
+
 func (r *userRepo) UpdateLastLogin(ctx context.Context, id int32) error {
 	now := time.Now().UTC()
-	_, err := r.db.ExecContext(ctx, "UPDATE auth_user SET last_login = $1", now)
+	_, err := r.db.ExecContext(
+		ctx,
+		"UPDATE auth_user SET last_login = $1 WHERE id = $2",
+		now,
+		id,
+	)
+	return err
+}
+
+func (r *userRepo) UpdateTOTP(
+	ctx context.Context,
+	id int32,
+	secret *string,
+	enabled bool,
+) error {
+	_, err := r.db.ExecContext(
+		ctx,
+		"UPDATE auth_user SET totp_secret = $1, totp_enabled = $2 WHERE id = $3",
+		secret,
+		enabled,
+		id,
+	)
+	return err
+}
+
+func (r *userRepo) UpdateVerified(ctx context.Context, id int32, verified bool) error {
+	_, err := r.db.ExecContext(
+		ctx,
+		"UPDATE auth_user SET verified = $1 WHERE id = $2",
+		verified,
+		id,
+	)
+	return err
+}
+
+// UpdateEmail also marks new email as verified,
+// it must be confirmed before the update.
+func (r *userRepo) UpdateEmail(ctx context.Context, id int32, email string) error {
+	_, err := r.db.ExecContext(
+		ctx,
+		"UPDATE auth_user SET email = $1, verified = true WHERE id = $2",
+		email,
+		id,
+	)
+	// email could be taken after it was checked
+	return wrapUniqueViolation(err)
+}
+
+func (r *userRepo) UpdatePassword(ctx context.Context, id int32, password *string) error {
+	_, err := r.db.ExecContext(
+		ctx,
+		"UPDATE auth_user SET password = $1 WHERE id = $2",
+		password,
+		id,
+	)
 	return err
 }
 
+// SetPassword returns false if user already has password.
+func (r *userRepo) SetPassword(ctx context.Context, id int32, password string) (bool, error) {
+	res, err := r.db.ExecContext(
+		ctx,
+		"UPDATE auth_user SET password = $1 WHERE id = $2 AND password IS NULL",
+		password,
+		id,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+func (r *userRepo) SetPasswordResetNonce(
+	ctx context.Context,
+	id int32,
+	nonce string,
+	expiration time.Duration,
+) error {
+	key := fmt.Sprintf("users:password_reset:%d", id)
+	return r.cache.Set(ctx, key, nonce, expiration).Err()
+}
+
+// UsePasswordResetNonce returns false if reset was not requested, nonce
+// is not the current one or it was already used, nonce can be used once.
+func (r *userRepo) UsePasswordResetNonce(ctx context.Context, id int32, nonce string) (bool, error) {
+	key := fmt.Sprintf("users:password_reset:%d", id)
+	// nonce of newer link is left as is
+	return r.cache.CompareAndDelete(ctx, key, nonce).Result()
+}
+
+func (r *userRepo) GetEmailChange(
+	ctx context.Context,
+	id int32,
+) (*entity.EmailChange, error) {
+	key := fmt.Sprintf("users:email_change:%d", id)
+	s, err := r.cache.Get(ctx, key).Result()
+	if err != nil {
+		if isNil(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var change entity.EmailChange
+	if err := json.Unmarshal([]byte(s), &change); err != nil {
+		return nil, err
+	}
+
+	return &change, nil
+}
+
+func (r *userRepo) SetEmailChange(
+	ctx context.Context,
+	id int32,
+	change *entity.EmailChange,
+	expiration time.Duration,
+) error {
+	b, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("users:email_change:%d", id)
+	return r.cache.Set(ctx, key, string(b), expiration).Err()
+}
+
+func (r *userRepo) DeleteEmailChange(ctx context.Context, id int32) error {
+	key := fmt.Sprintf("users:email_change:%d", id)
+	return r.cache.Del(ctx, key).Err()
+}
+
+// StartCooldown returns remaining time if cooldown for action is still active,
+// otherwise starts new one and returns 0.
+func (r *userRepo) StartCooldown(
+	ctx context.Context,
+	action string,
+	id int32,
+	duration time.Duration,
+) (time.Duration, error) {
+	key := fmt.Sprintf("users:cooldown:%s:%d", action, id)
+	for {
+		now := time.Now().UTC()
+
+		// only one of concurrent requests starts cooldown
+		ok, err := r.cache.SetNX(ctx, key, now.Unix(), duration).Result()
+		if err != nil {
+			return 0, err
+		}
+
+		if ok {
+			return 0, nil
+		}
+
+		s, err := r.cache.Get(ctx, key).Result()
+		if err != nil {
+			// cooldown expired after SetNX, try again
+			if isNil(err) {
+				continue
+			}
+
+			return 0, err
+		}
+
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+
+		// start is stored in seconds, key may outlive it by less than a second
+		return max(time.Unix(v, 0).Add(duration).Sub(now), time.Second), nil
+	}
+}
+
+// HitRateLimit counts hit with sliding window: hits of previous window
+// are weighted by part of it that is still inside window. Returns time
+// until the end of current window if limit is exceeded, otherwise 0.
+func (r *userRepo) HitRateLimit(
+	ctx context.Context,
+	key string,
+	limit int,
+	window time.Duration,
+) (time.Duration, error) {
+	now := time.Now().UTC()
+	current := now.Truncate(window)
+	previous := current.Add(-window)
+
+	currentKey := fmt.Sprintf("users:ratelimit:%s:%d", key, current.Unix())
+	previousKey := fmt.Sprintf("users:ratelimit:%s:%d", key, previous.Unix())
+
+	// previous window is still needed during next one
+	count, err := r.cache.IncrExpire(ctx, currentKey, 2*window).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	var previousCount int64
+	s, err := r.cache.Get(ctx, previousKey).Result()
+	if err != nil && !isNil(err) {
+		return 0, err
+	}
+
+	if err == nil {
+		previousCount, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	elapsed := now.Sub(current)
+	weight := float64(window-elapsed) / float64(window)
+	if float64(previousCount)*weight+float64(count) > float64(limit) {
+		return window - elapsed, nil
+	}
+
+	return 0, nil
+}
+
+// AddLoginFailure returns number of consecutive failures for key
+// (user or unknown login), counter expires after expiration since the last one.
+func (r *userRepo) AddLoginFailure(
+	ctx context.Context,
+	key string,
+	expiration time.Duration,
+) (int64, error) {
+	cacheKey := fmt.Sprintf("users:login_failures:%s", key)
+	return r.cache.IncrExpire(ctx, cacheKey, expiration).Result()
+}
+
+func (r *userRepo) LockLogin(ctx context.Context, key string, duration time.Duration) error {
+	cacheKey := fmt.Sprintf("users:login_lock:%s", key)
+	until := time.Now().UTC().Add(duration)
+	return r.cache.Set(ctx, cacheKey, until.Unix(), duration).Err()
+}
+
+// GetLoginLock returns remaining time of lockout, 0 if key is not locked.
+func (r *userRepo) GetLoginLock(ctx context.Context, key string) (time.Duration, error) {
+	cacheKey := fmt.Sprintf("users:login_lock:%s", key)
+	s, err := r.cache.Get(ctx, cacheKey).Result()
+	if err != nil {
+		if isNil(err) {
+			return 0, nil
+		}
+
+		return 0, err
+	}
+
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return max(time.Until(time.Unix(v, 0)), 0), nil
+}
+
+func (r *userRepo) ClearLoginFailures(ctx context.Context, key string) error {
+	return r.cache.Del(
+		ctx,
+		fmt.Sprintf("users:login_failures:%s", key),
+		fmt.Sprintf("users:login_lock:%s", key),
+	).Err()
+}
+
+func (r *userRepo) GetRecoveryCodes(
+	ctx context.Context,
+	userID int32,
+) ([]entity.RecoveryCode, error) {
+	var codes []entity.RecoveryCode
+	if err := r.db.SelectContext(
+		ctx,
+		&codes,
+		`
+		SELECT
+			id,
+			user_id,
+			code,
+			used_at
+		FROM auth_recovery_code WHERE user_id = $1 AND used_at IS NULL
+		`,
+		userID,
+	); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+func (r *userRepo) CreateRecoveryCodes(
+	ctx context.Context,
+	userID int32,
+	codes []string,
+) error {
+	for _, code := range codes {
+		if _, err := r.db.ExecContext(
+			ctx,
+			"INSERT INTO auth_recovery_code(user_id, code) VALUES ($1, $2)",
+			userID,
+			code,
+		); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *userRepo) DeleteRecoveryCodes(ctx context.Context, userID int32) error {
+	_, err := r.db.ExecContext(
+		ctx,
+		"DELETE FROM auth_recovery_code WHERE user_id = $1",
+		userID,
+	)
+	return err
+}
+
+// UseRecoveryCode returns false if code was already used.
+func (r *userRepo) UseRecoveryCode(ctx context.Context, id int32) (bool, error) {
+	res, err := r.db.ExecContext(
+		ctx,
+		"UPDATE auth_recovery_code SET used_at = $1 WHERE id = $2 AND used_at IS NULL",
+		time.Now().UTC(),
+		id,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
 func (r *userRepo) GetMassLogout(ctx context.Context) (*time.Time, error) {
 	s, err := r.cache.Get(ctx, "users:mass_logout").Result()
 	if err != nil {
-		if errors.Is(err, redis.Nil) {
+		if isNil(err) {
 			return nil, nil
 		}
 
@@ -263,10 +728,12 @@ func (r *userRepo) Unban(ctx context.Context, id int32) error {
 	return err
 }
 
-func (r *userRepo) Kick(ctx context.Context, id int32) error {
+// Kick invalidates refresh tokens of user issued before now,
+// record lives as long as the longest refresh token.
+func (r *userRepo) Kick(ctx context.Context, id int32, refreshTokenExpiration time.Duration) error {
 	ts := time.Now().UTC().Unix()
 	key := fmt.Sprintf("users:kick:%d", id)
-	return r.cache.Set(ctx, key, ts, 60*60*6*time.Second).Err()
+	return r.cache.Set(ctx, key, ts, refreshTokenExpiration).Err()
 }
 
 func (r *userRepo) Unkick(ctx context.Context, id int32) error {
@@ -277,7 +744,7 @@ func (r *userRepo) Unkick(ctx context.Context, id int32) error {
 func (r *userRepo) WasRecentlyBanned(ctx context.Context, id int32) (bool, error) {
 	key := fmt.Sprintf("users:ban:%d", id)
 	if err := r.cache.Get(ctx, key).Err(); err != nil {
-		if errors.Is(err, redis.Nil) {
+		if isNil(err) {
 			return false, nil
 		}
 
@@ -287,10 +754,111 @@ func (r *userRepo) WasRecentlyBanned(ctx context.Context, id int32) (bool, error
 	return true, nil
 }
 
-func (r *userRepo) IsKicked(ctx context.Context, id int32) (bool, error) {
+func (r *userRepo) GetKick(ctx context.Context, id int32) (*time.Time, error) {
 	key := fmt.Sprintf("users:kick:%d", id)
+	s, err := r.cache.Get(ctx, key).Result()
+	if err != nil {
+		if isNil(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	t := time.Unix(v, 0)
+	return &t, nil
+}
+
+// GetRefreshFamily returns jti of the only refresh token of family
+// that can be used, empty string if family is unknown or revoked.
+func (r *userRepo) GetRefreshFamily(ctx context.Context, family string) (string, error) {
+	key := fmt.Sprintf("users:refresh_family:%s", family)
+	jti, err := r.cache.Get(ctx, key).Result()
+	if err != nil {
+		if isNil(err) {
+			return "", nil
+		}
+
+		return "", err
+	}
+
+	return jti, nil
+}
+
+func (r *userRepo) SetRefreshFamily(
+	ctx context.Context,
+	family, jti string,
+	expiration time.Duration,
+) error {
+	key := fmt.Sprintf("users:refresh_family:%s", family)
+	return r.cache.Set(ctx, key, jti, expiration).Err()
+}
+
+// RefreshFamilyRotationGrace is how long replaced jti of family is
+// remembered, so that concurrent request with it is not mistaken for reuse.
+const RefreshFamilyRotationGrace = 10 * time.Second
+
+// RotateRefreshFamily replaces jti of family only if it is still oldJTI,
+// returns false if family was rotated (or revoked) concurrently. oldJTI is
+// remembered before swap, see RefreshFamilyRotationGrace.
+func (r *userRepo) RotateRefreshFamily(
+	ctx context.Context,
+	family, oldJTI, newJTI string,
+	expiration time.Duration,
+) (bool, error) {
+	rotatedKey := fmt.Sprintf("users:refresh_family_rotated:%s", family)
+	if err := r.cache.Set(ctx, rotatedKey, oldJTI, RefreshFamilyRotationGrace).Err(); err != nil {
+		return false, err
+	}
+
+	key := fmt.Sprintf("users:refresh_family:%s", family)
+	return r.cache.CompareAndSwap(ctx, key, oldJTI, newJTI, expiration).Result()
+}
+
+// GetRotatedRefreshFamily returns jti of family that was replaced within
+// RefreshFamilyRotationGrace, empty string otherwise.
+func (r *userRepo) GetRotatedRefreshFamily(ctx context.Context, family string) (string, error) {
+	key := fmt.Sprintf("users:refresh_family_rotated:%s", family)
+	jti, err := r.cache.Get(ctx, key).Result()
+	if err != nil {
+		if isNil(err) {
+			return "", nil
+		}
+
+		return "", err
+	}
+
+	return jti, nil
+}
+
+func (r *userRepo) DeleteRefreshFamily(ctx context.Context, family string) error {
+	return r.cache.Del(
+		ctx,
+		fmt.Sprintf("users:refresh_family:%s", family),
+		fmt.Sprintf("users:refresh_family_rotated:%s", family),
+	).Err()
+}
+
+// DenySession puts session on denylist, expiration should be
+// remaining lifetime of its tokens.
+func (r *userRepo) DenySession(
+	ctx context.Context,
+	sessionID string,
+	expiration time.Duration,
+) error {
+	key := fmt.Sprintf("users:session_deny:%s", sessionID)
+	return r.cache.Set(ctx, key, "1", expiration).Err()
+}
+
+func (r *userRepo) IsSessionDenied(ctx context.Context, sessionID string) (bool, error) {
+	key := fmt.Sprintf("users:session_deny:%s", sessionID)
 	if err := r.cache.Get(ctx, key).Err(); err != nil {
-		if errors.Is(err, redis.Nil) {
+		if isNil(err) {
 			return false, nil
 		}
 
@@ -299,3 +867,55 @@ func (r *userRepo) IsKicked(ctx context.Context, id int32) (bool, error) {
 
 	return true, nil
 }
+
+// UseMFAToken returns false if token was already used.
+func (r *userRepo) UseMFAToken(
+	ctx context.Context,
+	jti string,
+	expiration time.Duration,
+) (bool, error) {
+	key := fmt.Sprintf("users:mfa_used:%s", jti)
+	return r.cache.SetNX(ctx, key, 1, expiration).Result()
+}
+
+func (r *userRepo) IsMFATokenUsed(ctx context.Context, jti string) (bool, error) {
+	key := fmt.Sprintf("users:mfa_used:%s", jti)
+	if err := r.cache.Get(ctx, key).Err(); err != nil {
+		if isNil(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+// UseTOTPStep returns false if code of this time step was already used.
+func (r *userRepo) UseTOTPStep(
+	ctx context.Context,
+	id int32,
+	step uint64,
+	expiration time.Duration,
+) (bool, error) {
+	key := fmt.Sprintf("users:totp_step:%d:%d", id, step)
+	return r.cache.SetNX(ctx, key, 1, expiration).Result()
+}
+
+func isNil(err error) bool {
+	return errors.Is(err, redis.Nil) || errors.Is(err, storage.ErrNil)
+}
+
+// ErrUniqueViolation is returned when value is already taken by another row.
+var ErrUniqueViolation = errors.New("unique violation")
+
+const uniqueViolationCode = "23505"
+
+func wrapUniqueViolation(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolationCode {
+		return fmt.Errorf("%w: %w", ErrUniqueViolation, err)
+	}
+
+	return err
+}
@@ -0,0 +1,278 @@
+package repo
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pegov/fauth-backend-go/internal/storage"
+)
+
+// cache-backed methods don't touch db
+func newCacheUserRepo() (UserRepo, storage.CacheOps) {
+	cache := storage.NewMemoryCache()
+	return NewUserRepo(nil, cache), cache
+}
+
+func TestHitRateLimit(t *testing.T) {
+	r, _ := newCacheUserRepo()
+
+	for range 3 {
+		retryAfter, err := r.HitRateLimit(t.Context(), "ip:1", 3, time.Hour)
+		require.NoError(t, err)
+		require.Zero(t, retryAfter)
+	}
+
+	retryAfter, err := r.HitRateLimit(t.Context(), "ip:1", 3, time.Hour)
+	require.NoError(t, err)
+	require.Positive(t, retryAfter)
+	require.LessOrEqual(t, retryAfter, time.Hour)
+
+	// keys are counted separately
+	retryAfter, err = r.HitRateLimit(t.Context(), "ip:2", 3, time.Hour)
+	require.NoError(t, err)
+	require.Zero(t, retryAfter)
+}
+
+func TestHitRateLimitPreviousWindow(t *testing.T) {
+	r, cache := newCacheUserRepo()
+
+	previous := time.Now().UTC().Truncate(time.Hour).Add(-time.Hour)
+	previousKey := fmt.Sprintf("users:ratelimit:%s:%d", "ip:1", previous.Unix())
+
+	// hits of previous window are weighted by the part of it that is still
+	// inside sliding window, big count exceeds limit at any moment
+	require.NoError(t, cache.Set(t.Context(), previousKey, int64(1)<<50, 0).Err())
+	retryAfter, err := r.HitRateLimit(t.Context(), "ip:1", 3, time.Hour)
+	require.NoError(t, err)
+	require.Positive(t, retryAfter)
+
+	// previous window without hits doesn't count
+	require.NoError(t, cache.Set(t.Context(), previousKey, 0, 0).Err())
+	retryAfter, err = r.HitRateLimit(t.Context(), "ip:1", 3, time.Hour)
+	require.NoError(t, err)
+	require.Zero(t, retryAfter)
+}
+
+func TestLoginFailures(t *testing.T) {
+	r, _ := newCacheUserRepo()
+
+	for want := range int64(3) {
+		count, err := r.AddLoginFailure(t.Context(), "user:1", time.Hour)
+		require.NoError(t, err)
+		require.Equal(t, want+1, count)
+	}
+
+	count, err := r.AddLoginFailure(t.Context(), "user:2", time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), count)
+
+	// counter expires after expiration since the last failure
+	_, err = r.AddLoginFailure(t.Context(), "user:1", time.Millisecond)
+	require.NoError(t, err)
+	time.Sleep(2 * time.Millisecond)
+	count, err = r.AddLoginFailure(t.Context(), "user:1", time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), count)
+}
+
+func TestLoginLock(t *testing.T) {
+	r, _ := newCacheUserRepo()
+
+	lock, err := r.GetLoginLock(t.Context(), "user:1")
+	require.NoError(t, err)
+	require.Zero(t, lock)
+
+	require.NoError(t, r.LockLogin(t.Context(), "user:1", time.Hour))
+	lock, err = r.GetLoginLock(t.Context(), "user:1")
+	require.NoError(t, err)
+	require.InDelta(t, time.Hour, lock, float64(time.Second))
+
+	lock, err = r.GetLoginLock(t.Context(), "user:2")
+	require.NoError(t, err)
+	require.Zero(t, lock)
+
+	_, err = r.AddLoginFailure(t.Context(), "user:1", time.Hour)
+	require.NoError(t, err)
+
+	// successful login clears both failures and lock
+	require.NoError(t, r.ClearLoginFailures(t.Context(), "user:1"))
+	lock, err = r.GetLoginLock(t.Context(), "user:1")
+	require.NoError(t, err)
+	require.Zero(t, lock)
+	count, err := r.AddLoginFailure(t.Context(), "user:1", time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), count)
+}
+
+func TestRotateRefreshFamily(t *testing.T) {
+	r, _ := newCacheUserRepo()
+	require.NoError(t, r.SetRefreshFamily(t.Context(), "family", "1", time.Hour))
+
+	ok, err := r.RotateRefreshFamily(t.Context(), "family", "1", "2", time.Hour)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// replaced jti is remembered for grace period
+	rotated, err := r.GetRotatedRefreshFamily(t.Context(), "family")
+	require.NoError(t, err)
+	require.Equal(t, "1", rotated)
+
+	ok, err = r.RotateRefreshFamily(t.Context(), "family", "1", "3", time.Hour)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	jti, err := r.GetRefreshFamily(t.Context(), "family")
+	require.NoError(t, err)
+	require.Equal(t, "2", jti)
+
+	// revoked family can't be rotated
+	require.NoError(t, r.DeleteRefreshFamily(t.Context(), "family"))
+	ok, err = r.RotateRefreshFamily(t.Context(), "family", "2", "3", time.Hour)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	jti, err = r.GetRefreshFamily(t.Context(), "family")
+	require.NoError(t, err)
+	require.Empty(t, jti)
+}
+
+func TestRotateRefreshFamilyConcurrent(t *testing.T) {
+	for range 100 {
+		r, _ := newCacheUserRepo()
+		require.NoError(t, r.SetRefreshFamily(t.Context(), "family", "1", time.Hour))
+
+		var (
+			wg      sync.WaitGroup
+			results [2]bool
+			start   = make(chan struct{})
+		)
+		for i := range results {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				ok, err := r.RotateRefreshFamily(t.Context(), "family", "1", fmt.Sprint(i+2), time.Hour)
+				assert.NoError(t, err)
+				results[i] = ok
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		// exactly one of requests with the same refresh token wins
+		require.NotEqual(t, results[0], results[1])
+
+		winner := "2"
+		if results[1] {
+			winner = "3"
+		}
+		jti, err := r.GetRefreshFamily(t.Context(), "family")
+		require.NoError(t, err)
+		require.Equal(t, winner, jti)
+	}
+}
+
+func TestUsePasswordResetNonce(t *testing.T) {
+	r, cache := newCacheUserRepo()
+
+	ok, err := r.UsePasswordResetNonce(t.Context(), 1, "nonce")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	require.NoError(t, r.SetPasswordResetNonce(t.Context(), 1, "nonce", time.Hour))
+
+	// nonce of older link doesn't consume the current one
+	ok, err = r.UsePasswordResetNonce(t.Context(), 1, "old")
+	require.NoError(t, err)
+	require.False(t, ok)
+	nonce, err := cache.Get(t.Context(), "users:password_reset:1").Result()
+	require.NoError(t, err)
+	require.Equal(t, "nonce", nonce)
+
+	ok, err = r.UsePasswordResetNonce(t.Context(), 1, "nonce")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok, err = r.UsePasswordResetNonce(t.Context(), 1, "nonce")
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestUsePasswordResetNonceConcurrent(t *testing.T) {
+	for range 100 {
+		r, _ := newCacheUserRepo()
+		require.NoError(t, r.SetPasswordResetNonce(t.Context(), 1, "nonce", time.Hour))
+
+		var (
+			wg    sync.WaitGroup
+			mu    sync.Mutex
+			used  int
+			start = make(chan struct{})
+		)
+		for range 2 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				ok, err := r.UsePasswordResetNonce(t.Context(), 1, "nonce")
+				assert.NoError(t, err)
+				if ok {
+					mu.Lock()
+					used++
+					mu.Unlock()
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		// link is single use even if submitted twice at once
+		require.Equal(t, 1, used)
+	}
+}
+
+func TestPopOAuthStateConcurrent(t *testing.T) {
+	for range 100 {
+		r, _ := newCacheUserRepo()
+		require.NoError(t, r.SetOAuthState(t.Context(), "state", "google", time.Hour))
+
+		var (
+			wg     sync.WaitGroup
+			values [2]string
+			start  = make(chan struct{})
+		)
+		for i := range values {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				value, err := r.PopOAuthState(t.Context(), "state")
+				assert.NoError(t, err)
+				values[i] = value
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		// only one callback gets the state
+		require.ElementsMatch(t, []string{"google", ""}, values[:])
+	}
+}
+
+func TestWrapUniqueViolation(t *testing.T) {
+	err := wrapUniqueViolation(&pgconn.PgError{Code: "23505", ConstraintName: "auth_user_email_key"})
+	require.ErrorIs(t, err, ErrUniqueViolation)
+
+	var pgErr *pgconn.PgError
+	require.ErrorAs(t, err, &pgErr)
+
+	// other errors are left as is
+	require.NotErrorIs(t, wrapUniqueViolation(&pgconn.PgError{Code: "23503"}), ErrUniqueViolation)
+	require.NoError(t, wrapUniqueViolation(nil))
+}
@@ -2,8 +2,13 @@ package service
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"slices"
 	"time"
 
+	"github.com/pegov/fauth-backend-go/internal/config"
+	"github.com/pegov/fauth-backend-go/internal/entity"
 	"github.com/pegov/fauth-backend-go/internal/model"
 	"github.com/pegov/fauth-backend-go/internal/repo"
 )
@@ -16,20 +21,42 @@ type AdminService interface {
 	Unban(ctx context.Context, id int32) error
 	Kick(ctx context.Context, id int32) error
 	Unkick(ctx context.Context, id int32) error
+	GetRoles(ctx context.Context) ([]*model.Role, error)
+	GetRole(ctx context.Context, id int32) (*model.Role, error)
+	CreateRole(ctx context.Context, request *model.RoleCreate) (*model.Role, error)
+	UpdateRole(ctx context.Context, id int32, request *model.RoleCreate) (*model.Role, error)
+	DeleteRole(ctx context.Context, id int32) error
+	UpdateUserRoles(ctx context.Context, id int32, request *model.UserRolesUpdate) error
 }
 
 type adminService struct {
-	userRepo repo.UserRepo
+	cfg        *config.Config
+	userRepo   repo.UserRepo
+	roleRepo   repo.RoleRepo
+	transactor repo.UserRoleTransactor
 }
 
 func NewAdminService(
+	cfg *config.Config,
 	userRepo repo.UserRepo,
+	roleRepo repo.RoleRepo,
+	transactor repo.UserRoleTransactor,
 ) AdminService {
 	return &adminService{
-		userRepo: userRepo,
+		cfg:        cfg,
+		userRepo:   userRepo,
+		roleRepo:   roleRepo,
+		transactor: transactor,
 	}
 }
 
+var (
+	ErrRoleNotFound      = errors.New("role not found")
+	ErrRoleAlreadyExists = errors.New("role already exists")
+	ErrRoleBuiltIn       = errors.New("built-in role can't be renamed, deleted or lose permissions")
+	ErrLastAdmin         = errors.New("admin role can't be taken from the last admin")
+)
+
 func (s *adminService) GetMassLogout(ctx context.Context) (model.MassLogoutStatus, error) {
 	date, err := s.userRepo.GetMassLogout(ctx)
 	if err != nil {
@@ -46,8 +73,12 @@ func (s *adminService) GetMassLogout(ctx context.Context) (model.MassLogoutStatu
 	}, nil
 }
 
+func (s *adminService) refreshTokenExpiration() time.Duration {
+	return time.Duration(s.cfg.App.RefreshTokenExpiration) * time.Second
+}
+
 func (s *adminService) ActivateMassLogout(ctx context.Context) error {
-	return s.userRepo.ActivateMassLogout(ctx, 60*60*24*31*time.Second)
+	return s.userRepo.ActivateMassLogout(ctx, s.refreshTokenExpiration())
 }
 
 func (s *adminService) DeactivateMassLogout(ctx context.Context) error {
@@ -84,9 +115,255 @@ func (s *adminService) Unban(ctx context.Context, id int32) error {
 }
 
 func (s *adminService) Kick(ctx context.Context, id int32) error {
-	return s.actionOnID(ctx, id, s.userRepo.Kick)
+	return s.actionOnID(ctx, id, func(ctx context.Context, id int32) error {
+		return s.userRepo.Kick(ctx, id, s.refreshTokenExpiration())
+	})
 }
 
 func (s *adminService) Unkick(ctx context.Context, id int32) error {
 	return s.actionOnID(ctx, id, s.userRepo.Unkick)
 }
+
+func (s *adminService) getRole(ctx context.Context, id int32) (*entity.Role, error) {
+	role, err := s.roleRepo.Get(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get role by id: %w", err)
+	}
+
+	if role == nil {
+		return nil, ErrRoleNotFound
+	}
+
+	role.Permissions, err = s.roleRepo.GetPermissions(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get role permissions: %w", err)
+	}
+
+	return role, nil
+}
+
+func (s *adminService) GetRoles(ctx context.Context) ([]*model.Role, error) {
+	roles, err := s.roleRepo.GetAll(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get roles: %w", err)
+	}
+
+	for i := range roles {
+		roles[i].Permissions, err = s.roleRepo.GetPermissions(ctx, roles[i].ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get role permissions: %w", err)
+		}
+	}
+
+	return model.RolesFromEntities(roles), nil
+}
+
+func (s *adminService) GetRole(ctx context.Context, id int32) (*model.Role, error) {
+	role, err := s.getRole(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return model.RoleFromEntity(role), nil
+}
+
+// checkRoleName returns ErrRoleAlreadyExists if name is taken by role other than id.
+func (s *adminService) checkRoleName(ctx context.Context, id int32, name string) error {
+	existing, err := s.roleRepo.GetByName(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to get role by name: %w", err)
+	}
+
+	if existing != nil && existing.ID != id {
+		return ErrRoleAlreadyExists
+	}
+
+	return nil
+}
+
+func (s *adminService) CreateRole(
+	ctx context.Context,
+	request *model.RoleCreate,
+) (*model.Role, error) {
+	if err := request.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkRoleName(ctx, 0, request.Name); err != nil {
+		return nil, err
+	}
+
+	var id int32
+	if err := s.transactor.WithTx(ctx, func(
+		ctx context.Context,
+		_ repo.UserRepo,
+		roleRepo repo.RoleRepo,
+	) (err error) {
+		id, err = roleRepo.Create(ctx, request)
+		if err != nil {
+			return fmt.Errorf("failed to create role: %w", err)
+		}
+
+		if err := roleRepo.SetPermissions(ctx, id, request.Permissions); err != nil {
+			return fmt.Errorf("failed to set role permissions: %w", err)
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return s.GetRole(ctx, id)
+}
+
+func (s *adminService) UpdateRole(
+	ctx context.Context,
+	id int32,
+	request *model.RoleCreate,
+) (*model.Role, error) {
+	if err := request.Validate(); err != nil {
+		return nil, err
+	}
+
+	role, err := s.getRole(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// like deleted admin, admin without some permission could lock out
+	// everyone from managing it
+	if role.Name == model.RoleAdmin &&
+		(request.Name != role.Name || !hasAllPermissions(request.Permissions)) {
+		return nil, ErrRoleBuiltIn
+	}
+
+	if err := s.checkRoleName(ctx, id, request.Name); err != nil {
+		return nil, err
+	}
+
+	if err := s.transactor.WithTx(ctx, func(
+		ctx context.Context,
+		_ repo.UserRepo,
+		roleRepo repo.RoleRepo,
+	) error {
+		if err := roleRepo.Update(ctx, id, request); err != nil {
+			return fmt.Errorf("failed to update role: %w", err)
+		}
+
+		if err := roleRepo.SetPermissions(ctx, id, request.Permissions); err != nil {
+			return fmt.Errorf("failed to set role permissions: %w", err)
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return s.GetRole(ctx, id)
+}
+
+// hasAllPermissions expects validated (sorted, unique) permissions.
+func hasAllPermissions(permissions []string) bool {
+	all := slices.Clone(model.Permissions)
+	slices.Sort(all)
+	return slices.Equal(all, permissions)
+}
+
+func (s *adminService) DeleteRole(ctx context.Context, id int32) error {
+	role, err := s.getRole(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	// nobody could manage roles again without admin
+	if role.Name == model.RoleAdmin {
+		return ErrRoleBuiltIn
+	}
+
+	if err := s.roleRepo.Delete(ctx, id); err != nil {
+		return fmt.Errorf("failed to delete role: %w", err)
+	}
+
+	return nil
+}
+
+// UpdateUserRoles replaces roles of user, new roles and permissions get into tokens
+// on next login or refresh.
+func (s *adminService) UpdateUserRoles(
+	ctx context.Context,
+	id int32,
+	request *model.UserRolesUpdate,
+) error {
+	if err := request.Validate(); err != nil {
+		return err
+	}
+
+	return s.transactor.WithTx(ctx, func(
+		ctx context.Context,
+		userRepo repo.UserRepo,
+		roleRepo repo.RoleRepo,
+	) error {
+		user, err := userRepo.Get(ctx, id)
+		if err != nil {
+			return fmt.Errorf("failed to get user by id: %w", err)
+		}
+
+		if user == nil {
+			return ErrUserNotFound
+		}
+
+		roleIDs := make([]int32, 0, len(request.Roles))
+		for _, name := range request.Roles {
+			role, err := roleRepo.GetByName(ctx, name)
+			if err != nil {
+				return fmt.Errorf("failed to get role by name: %w", err)
+			}
+
+			if role == nil {
+				return fmt.Errorf("%w: %s", ErrRoleNotFound, name)
+			}
+
+			roleIDs = append(roleIDs, role.ID)
+		}
+
+		if err := s.checkLastAdmin(ctx, roleRepo, id, roleIDs); err != nil {
+			return err
+		}
+
+		if err := roleRepo.SetUserRoles(ctx, id, roleIDs); err != nil {
+			return fmt.Errorf("failed to set user roles: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// checkLastAdmin returns ErrLastAdmin if user is the only admin and roleIDs
+// don't have admin role. Must be called inside transaction, admins stay
+// locked, so concurrent updates can't take the role from each other.
+func (s *adminService) checkLastAdmin(
+	ctx context.Context,
+	roleRepo repo.RoleRepo,
+	id int32,
+	roleIDs []int32,
+) error {
+	admin, err := roleRepo.GetByName(ctx, model.RoleAdmin)
+	if err != nil {
+		return fmt.Errorf("failed to get role by name: %w", err)
+	}
+
+	if admin == nil || slices.Contains(roleIDs, admin.ID) {
+		return nil
+	}
+
+	admins, err := roleRepo.LockRoleUsers(ctx, admin.ID)
+	if err != nil {
+		return fmt.Errorf("failed to lock role users: %w", err)
+	}
+
+	if len(admins) == 1 && admins[0] == id {
+		return ErrLastAdmin
+	}
+
+	return nil
+}
@@ -0,0 +1,299 @@
+package service_test
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/ovechkin-dm/mockio/v2/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pegov/fauth-backend-go/internal/config"
+	"github.com/pegov/fauth-backend-go/internal/entity"
+	"github.com/pegov/fauth-backend-go/internal/model"
+	"github.com/pegov/fauth-backend-go/internal/repo"
+	"github.com/pegov/fauth-backend-go/internal/service"
+)
+
+// roleStore keeps roles, their permissions and roles of users in memory.
+type roleStore struct {
+	roles     map[int32]*entity.Role
+	userRoles map[int32][]int32
+	lastID    int32
+}
+
+func stubRoleStore(repoM repo.UserRepo, roleRepoM repo.RoleRepo, transactorM repo.UserRoleTransactor) *roleStore {
+	store := &roleStore{
+		roles:     map[int32]*entity.Role{},
+		userRoles: map[int32][]int32{},
+	}
+
+	mock.WhenSingle(transactorM.WithTx(
+		mock.AnyContext(),
+		mock.Any[func(context.Context, repo.UserRepo, repo.RoleRepo) error](),
+	)).ThenAnswer(func(args []any) error {
+		fn := args[1].(func(context.Context, repo.UserRepo, repo.RoleRepo) error)
+		return fn(args[0].(context.Context), repoM, roleRepoM)
+	})
+	mock.WhenDouble(roleRepoM.Get(mock.AnyContext(), mock.Any[int32]())).
+		ThenAnswer(func(args []any) (*entity.Role, error) {
+			role, ok := store.roles[args[1].(int32)]
+			if !ok {
+				return nil, nil
+			}
+			return &entity.Role{ID: role.ID, Name: role.Name, Description: role.Description}, nil
+		})
+	mock.WhenDouble(roleRepoM.GetByName(mock.AnyContext(), mock.AnyString())).
+		ThenAnswer(func(args []any) (*entity.Role, error) {
+			for _, role := range store.roles {
+				if role.Name == args[1].(string) {
+					return &entity.Role{ID: role.ID, Name: role.Name, Description: role.Description}, nil
+				}
+			}
+			return nil, nil
+		})
+	mock.WhenDouble(roleRepoM.GetAll(mock.AnyContext())).
+		ThenAnswer(func(args []any) ([]entity.Role, error) {
+			var roles []entity.Role
+			for id := range store.lastID + 1 {
+				if role, ok := store.roles[id]; ok {
+					roles = append(roles, entity.Role{ID: role.ID, Name: role.Name, Description: role.Description})
+				}
+			}
+			return roles, nil
+		})
+	mock.WhenDouble(roleRepoM.Create(mock.AnyContext(), mock.Any[*model.RoleCreate]())).
+		ThenAnswer(func(args []any) (int32, error) {
+			data := args[1].(*model.RoleCreate)
+			store.lastID++
+			id := store.lastID
+			store.roles[id] = &entity.Role{ID: id, Name: data.Name, Description: data.Description}
+			return id, nil
+		})
+	mock.WhenSingle(roleRepoM.Update(mock.AnyContext(), mock.Any[int32](), mock.Any[*model.RoleCreate]())).
+		ThenAnswer(func(args []any) error {
+			data := args[2].(*model.RoleCreate)
+			role := store.roles[args[1].(int32)]
+			role.Name, role.Description = data.Name, data.Description
+			return nil
+		})
+	mock.WhenSingle(roleRepoM.Delete(mock.AnyContext(), mock.Any[int32]())).
+		ThenAnswer(func(args []any) error {
+			delete(store.roles, args[1].(int32))
+			return nil
+		})
+	mock.WhenSingle(roleRepoM.SetPermissions(mock.AnyContext(), mock.Any[int32](), mock.Any[[]string]())).
+		ThenAnswer(func(args []any) error {
+			store.roles[args[1].(int32)].Permissions = args[2].([]string)
+			return nil
+		})
+	mock.WhenDouble(roleRepoM.GetPermissions(mock.AnyContext(), mock.Any[int32]())).
+		ThenAnswer(func(args []any) ([]string, error) {
+			return store.roles[args[1].(int32)].Permissions, nil
+		})
+	mock.WhenSingle(roleRepoM.SetUserRoles(mock.AnyContext(), mock.Any[int32](), mock.Any[[]int32]())).
+		ThenAnswer(func(args []any) error {
+			store.userRoles[args[1].(int32)] = args[2].([]int32)
+			return nil
+		})
+	mock.WhenDouble(roleRepoM.LockRoleUsers(mock.AnyContext(), mock.Any[int32]())).
+		ThenAnswer(func(args []any) ([]int32, error) {
+			var userIDs []int32
+			for userID, roleIDs := range store.userRoles {
+				if slices.Contains(roleIDs, args[1].(int32)) {
+					userIDs = append(userIDs, userID)
+				}
+			}
+			slices.Sort(userIDs)
+			return userIDs, nil
+		})
+	mock.WhenDouble(roleRepoM.GetUserRoles(mock.AnyContext(), mock.Any[int32]())).
+		ThenAnswer(func(args []any) ([]string, error) {
+			var names []string
+			for _, id := range store.userRoles[args[1].(int32)] {
+				names = append(names, store.roles[id].Name)
+			}
+			return names, nil
+		})
+	mock.WhenDouble(roleRepoM.GetUserPermissions(mock.AnyContext(), mock.Any[int32]())).
+		ThenAnswer(func(args []any) ([]string, error) {
+			var permissions []string
+			for _, id := range store.userRoles[args[1].(int32)] {
+				permissions = append(permissions, store.roles[id].Permissions...)
+			}
+			return permissions, nil
+		})
+
+	return store
+}
+
+func TestRoles(t *testing.T) {
+	ctrl := mock.NewMockController(t)
+	repoM := mock.Mock[repo.UserRepo](ctrl)
+	roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+	transactorM := mock.Mock[repo.UserRoleTransactor](ctrl)
+
+	s := service.NewAdminService(&config.Config{}, repoM, roleRepoM, transactorM)
+	store := stubRoleStore(repoM, roleRepoM, transactorM)
+
+	editor, err := s.CreateRole(t.Context(), &model.RoleCreate{
+		Name:        " editor ",
+		Permissions: []string{model.PermissionRolesRead},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "editor", editor.Name)
+	require.Equal(t, []string{model.PermissionRolesRead}, editor.Permissions)
+
+	_, err = s.CreateRole(t.Context(), &model.RoleCreate{Name: "editor"})
+	require.ErrorIs(t, err, service.ErrRoleAlreadyExists)
+	require.Len(t, store.roles, 1)
+
+	viewer, err := s.CreateRole(t.Context(), &model.RoleCreate{Name: "viewer"})
+	require.NoError(t, err)
+	require.Empty(t, viewer.Permissions)
+
+	// name of another role can't be taken, own name can be kept
+	_, err = s.UpdateRole(t.Context(), viewer.ID, &model.RoleCreate{Name: "editor"})
+	require.ErrorIs(t, err, service.ErrRoleAlreadyExists)
+	viewer, err = s.UpdateRole(t.Context(), viewer.ID, &model.RoleCreate{
+		Name:        "viewer",
+		Description: "read only",
+		Permissions: []string{model.PermissionRolesRead},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "read only", viewer.Description)
+	require.Equal(t, []string{model.PermissionRolesRead}, viewer.Permissions)
+
+	_, err = s.UpdateRole(t.Context(), 100, &model.RoleCreate{Name: "unknown"})
+	require.ErrorIs(t, err, service.ErrRoleNotFound)
+
+	roles, err := s.GetRoles(t.Context())
+	require.NoError(t, err)
+	require.Equal(t, []*model.Role{editor, viewer}, roles)
+
+	require.NoError(t, s.DeleteRole(t.Context(), editor.ID))
+	_, err = s.GetRole(t.Context(), editor.ID)
+	require.ErrorIs(t, err, service.ErrRoleNotFound)
+	require.ErrorIs(t, s.DeleteRole(t.Context(), editor.ID), service.ErrRoleNotFound)
+
+	// name of deleted role is free
+	_, err = s.CreateRole(t.Context(), &model.RoleCreate{Name: "editor"})
+	require.NoError(t, err)
+
+	admin, err := s.CreateRole(t.Context(), &model.RoleCreate{
+		Name:        model.RoleAdmin,
+		Permissions: model.Permissions,
+	})
+	require.NoError(t, err)
+
+	// built-in admin role can't be renamed, deleted or lose permissions
+	_, err = s.UpdateRole(t.Context(), admin.ID, &model.RoleCreate{
+		Name:        "root",
+		Permissions: model.Permissions,
+	})
+	require.ErrorIs(t, err, service.ErrRoleBuiltIn)
+	_, err = s.UpdateRole(t.Context(), admin.ID, &model.RoleCreate{
+		Name:        model.RoleAdmin,
+		Permissions: []string{model.PermissionRolesRead},
+	})
+	require.ErrorIs(t, err, service.ErrRoleBuiltIn)
+	require.ErrorIs(t, s.DeleteRole(t.Context(), admin.ID), service.ErrRoleBuiltIn)
+	require.Equal(t, model.RoleAdmin, store.roles[admin.ID].Name)
+	require.ElementsMatch(t, model.Permissions, store.roles[admin.ID].Permissions)
+
+	// description can be changed, order of permissions doesn't matter
+	permissions := slices.Clone(model.Permissions)
+	slices.Reverse(permissions)
+	admin, err = s.UpdateRole(t.Context(), admin.ID, &model.RoleCreate{
+		Name:        model.RoleAdmin,
+		Description: "Administrator",
+		Permissions: permissions,
+	})
+	require.NoError(t, err)
+	require.Equal(t, "Administrator", admin.Description)
+}
+
+func TestUpdateUserRoles(t *testing.T) {
+	ctrl := mock.NewMockController(t)
+	repoM := mock.Mock[repo.UserRepo](ctrl)
+	roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+	sessionRepoM := mock.Mock[repo.SessionRepo](ctrl)
+	transactorM := mock.Mock[repo.UserRoleTransactor](ctrl)
+
+	s := service.NewAdminService(&config.Config{}, repoM, roleRepoM, transactorM)
+	authService, _ := newAuthService(t, repoM, roleRepoM, sessionRepoM)
+	store := stubRoleStore(repoM, roleRepoM, transactorM)
+
+	pass := "pass"
+	res := entity.User{ID: 1, Username: "user", Password: &pass, Active: true}
+	mock.WhenDouble(repoM.GetByLogin(mock.AnyContext(), mock.Exact(res.Username))).ThenReturn(&res, nil)
+	mock.WhenDouble(repoM.Get(mock.AnyContext(), mock.Exact(res.ID))).ThenReturn(&res, nil)
+
+	_, err := s.CreateRole(t.Context(), &model.RoleCreate{
+		Name:        "moderator",
+		Permissions: []string{model.PermissionUsersBan, model.PermissionUsersKick},
+	})
+	require.NoError(t, err)
+
+	err = s.UpdateUserRoles(t.Context(), res.ID, &model.UserRolesUpdate{Roles: []string{"moderator", "unknown"}})
+	require.ErrorIs(t, err, service.ErrRoleNotFound)
+	require.Empty(t, store.userRoles)
+
+	err = s.UpdateUserRoles(t.Context(), 2, &model.UserRolesUpdate{Roles: []string{"moderator"}})
+	require.ErrorIs(t, err, service.ErrUserNotFound)
+	require.Empty(t, store.userRoles)
+
+	require.NoError(t, s.UpdateUserRoles(t.Context(), res.ID, &model.UserRolesUpdate{Roles: []string{"moderator"}}))
+
+	// new roles get into token on next login
+	result, err := authService.Login(t.Context(), &model.LoginRequest{Login: res.Username, Password: pass})
+	require.NoError(t, err)
+	user, err := authService.Token(t.Context(), result.Tokens.Access)
+	require.NoError(t, err)
+	require.Equal(t, []string{"moderator"}, user.Roles)
+	require.Equal(t, []string{model.PermissionUsersBan, model.PermissionUsersKick}, user.Permissions)
+
+	require.NoError(t, s.UpdateUserRoles(t.Context(), res.ID, &model.UserRolesUpdate{Roles: []string{}}))
+	result, err = authService.Login(t.Context(), &model.LoginRequest{Login: res.Username, Password: pass})
+	require.NoError(t, err)
+	user, err = authService.Token(t.Context(), result.Tokens.Access)
+	require.NoError(t, err)
+	require.Empty(t, user.Roles)
+	require.Empty(t, user.Permissions)
+}
+
+func TestUpdateUserRolesLastAdmin(t *testing.T) {
+	ctrl := mock.NewMockController(t)
+	repoM := mock.Mock[repo.UserRepo](ctrl)
+	roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+	transactorM := mock.Mock[repo.UserRoleTransactor](ctrl)
+
+	s := service.NewAdminService(&config.Config{}, repoM, roleRepoM, transactorM)
+	store := stubRoleStore(repoM, roleRepoM, transactorM)
+
+	for _, id := range []int32{1, 2} {
+		mock.WhenDouble(repoM.Get(mock.AnyContext(), mock.Exact(id))).ThenReturn(&entity.User{ID: id}, nil)
+	}
+
+	admin, err := s.CreateRole(t.Context(), &model.RoleCreate{Name: model.RoleAdmin, Permissions: model.Permissions})
+	require.NoError(t, err)
+	moderator, err := s.CreateRole(t.Context(), &model.RoleCreate{Name: "moderator"})
+	require.NoError(t, err)
+
+	admins := &model.UserRolesUpdate{Roles: []string{model.RoleAdmin}}
+	require.NoError(t, s.UpdateUserRoles(t.Context(), 1, admins))
+	require.NoError(t, s.UpdateUserRoles(t.Context(), 2, admins))
+
+	// admin can drop own role while there is another admin
+	require.NoError(t, s.UpdateUserRoles(t.Context(), 1, &model.UserRolesUpdate{Roles: []string{}}))
+
+	err = s.UpdateUserRoles(t.Context(), 2, &model.UserRolesUpdate{Roles: []string{"moderator"}})
+	require.ErrorIs(t, err, service.ErrLastAdmin)
+	require.Equal(t, []int32{admin.ID}, store.userRoles[2])
+
+	// the last admin can get other roles while keeping admin
+	require.NoError(t, s.UpdateUserRoles(t.Context(), 2, &model.UserRolesUpdate{
+		Roles: []string{model.RoleAdmin, "moderator"},
+	}))
+	require.Equal(t, []int32{admin.ID, moderator.ID}, store.userRoles[2])
+}
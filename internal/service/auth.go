@@ -5,44 +5,83 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/pegov/fauth-backend-go/internal/captcha"
+	"github.com/pegov/fauth-backend-go/internal/config"
 	"github.com/pegov/fauth-backend-go/internal/email"
+	"github.com/pegov/fauth-backend-go/internal/entity"
 	"github.com/pegov/fauth-backend-go/internal/model"
 	"github.com/pegov/fauth-backend-go/internal/password"
 	"github.com/pegov/fauth-backend-go/internal/repo"
+	"github.com/pegov/fauth-backend-go/internal/signer"
 	"github.com/pegov/fauth-backend-go/internal/token"
+	"github.com/pegov/fauth-backend-go/internal/totp"
 )
 
 type AuthService interface {
 	Register(ctx context.Context, request *model.RegisterRequest) (*Tokens, error)
-	Login(ctx context.Context, request *model.LoginRequest) (*Tokens, error)
+	Login(ctx context.Context, request *model.LoginRequest) (*LoginResult, error)
+	LoginTOTP(ctx context.Context, request *model.LoginTOTPRequest) (*Tokens, error)
 	Token(ctx context.Context, accessToken string) (*token.User, error)
-	RefreshToken(ctx context.Context, refreshToken string) (string, error)
+	RefreshToken(ctx context.Context, refreshToken string) (*Tokens, error)
 	Me(ctx context.Context, id int32) (*model.Me, error)
+	SetupTOTP(ctx context.Context, id int32) (*model.TOTPSetup, error)
+	ConfirmTOTP(ctx context.Context, id int32, request *model.TOTPCodeRequest) (*model.RecoveryCodes, error)
+	RemoveTOTP(ctx context.Context, id int32, request *model.TOTPCodeRequest) error
+	RegenerateRecoveryCodes(ctx context.Context, id int32, request *model.TOTPCodeRequest) (*model.RecoveryCodes, error)
+	RequestEmailVerification(ctx context.Context, id int32) error
+	VerifyEmail(ctx context.Context, request *model.TokenRequest) error
+	RequestEmailChange(ctx context.Context, id int32, request *model.EmailChangeRequest) error
+	ForgotPassword(ctx context.Context, request *model.ForgotPasswordRequest) error
+	ResetPassword(ctx context.Context, request *model.ResetPasswordRequest) error
+	GetPasswordStatus(ctx context.Context, id int32) (*model.PasswordStatus, error)
+	ChangePassword(ctx context.Context, id int32, request *model.ChangePasswordRequest) error
+	SetPassword(ctx context.Context, id int32, request *model.SetPasswordRequest) error
+	VerifyOldEmail(ctx context.Context, request *model.TokenRequest) error
+	VerifyNewEmail(ctx context.Context, request *model.TokenRequest) error
+	Logout(ctx context.Context, refreshOrAccessToken string) error
+	LogoutAll(ctx context.Context, id int32) error
+	GetSessions(ctx context.Context, id int32, currentSessionID string) ([]*model.Session, error)
+	RevokeSession(ctx context.Context, id int32, sessionID string) error
 }
 
 type authService struct {
+	cfg            *config.Config
 	userRepo       repo.UserRepo
+	roleRepo       repo.RoleRepo
+	sessionRepo    repo.SessionRepo
 	captchaClient  captcha.CaptchaClient
 	passwordHasher password.PasswordManager
 	tokenBackend   token.JwtBackend
 	emailClient    email.EmailClient
+	totpCipher     totp.SecretCipher
+	signer         signer.Signer
 }
 
 func NewAuthService(
+	cfg *config.Config,
 	userRepo repo.UserRepo,
+	roleRepo repo.RoleRepo,
+	sessionRepo repo.SessionRepo,
 	captchaClient captcha.CaptchaClient,
 	passwordHasher password.PasswordManager,
 	tokenBackend token.JwtBackend,
 	emailClient email.EmailClient,
+	totpCipher totp.SecretCipher,
+	signer signer.Signer,
 ) *authService {
 	return &authService{
+		cfg:            cfg,
 		userRepo:       userRepo,
+		roleRepo:       roleRepo,
+		sessionRepo:    sessionRepo,
 		captchaClient:  captchaClient,
 		passwordHasher: passwordHasher,
 		tokenBackend:   tokenBackend,
 		emailClient:    emailClient,
+		totpCipher:     totpCipher,
+		signer:         signer,
 	}
 }
 
@@ -58,11 +97,129 @@ var (
 	ErrUserInMassLogout          = errors.New("user in mass logout")
 )
 
+// RateLimitError is returned when action must not be repeated for RetryAfter.
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return "too many requests"
+}
+
 type Tokens struct {
 	Access  string
 	Refresh string
 }
 
+// LoginResult contains either Tokens or MFAToken if user has 2fa enabled.
+type LoginResult struct {
+	Tokens   *Tokens
+	MFAToken string
+}
+
+const mfaTokenExpiration = 5 * time.Minute
+
+// tokenUser resolves roles and permissions of user for token payload.
+func (s *authService) tokenUser(ctx context.Context, user *entity.User) (*token.User, error) {
+	roles, err := s.roleRepo.GetUserRoles(ctx, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user roles: %w", err)
+	}
+
+	if roles == nil {
+		roles = []string{}
+	}
+
+	permissions, err := s.roleRepo.GetUserPermissions(ctx, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user permissions: %w", err)
+	}
+
+	return &token.User{
+		ID:          user.ID,
+		Username:    user.Username,
+		Roles:       roles,
+		Permissions: permissions,
+	}, nil
+}
+
+// createTokens starts new session for client from context.
+func (s *authService) createTokens(ctx context.Context, user *entity.User) (*Tokens, error) {
+	sessionID, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	client := model.ClientFromContext(ctx)
+	now := time.Now().UTC()
+	if err := s.sessionRepo.Create(ctx, &entity.Session{
+		ID:         sessionID,
+		UserID:     user.ID,
+		IP:         client.IP,
+		UserAgent:  client.UserAgent,
+		Device:     client.Device(),
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  now.Add(s.refreshTokenExpiration()),
+	}); err != nil {
+		return nil, fmt.Errorf("failed to create session: %w", err)
+	}
+
+	return s.createSessionTokens(ctx, user, sessionID)
+}
+
+func (s *authService) refreshTokenExpiration() time.Duration {
+	return time.Duration(s.cfg.App.RefreshTokenExpiration) * time.Second
+}
+
+// createSessionTokens issues access and refresh tokens of session, refresh
+// token becomes the only one of session's family that can be used.
+func (s *authService) createSessionTokens(
+	ctx context.Context,
+	user *entity.User,
+	sessionID string,
+) (*Tokens, error) {
+	tokens, jti, err := s.encodeSessionTokens(ctx, user, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.userRepo.SetRefreshFamily(ctx, sessionID, jti, s.refreshTokenExpiration()); err != nil {
+		return nil, fmt.Errorf("failed to set refresh family: %w", err)
+	}
+
+	return tokens, nil
+}
+
+// encodeSessionTokens returns tokens of session and jti of refresh token.
+func (s *authService) encodeSessionTokens(
+	ctx context.Context,
+	user *entity.User,
+	sessionID string,
+) (*Tokens, string, error) {
+	payload, err := s.tokenUser(ctx, user)
+	if err != nil {
+		return nil, "", err
+	}
+	payload.SessionID = sessionID
+
+	a, err := s.tokenBackend.Encode(
+		payload,
+		time.Duration(s.cfg.App.AccessTokenExpiration)*time.Second,
+		token.AccessTokenType,
+	)
+	if err != nil {
+		return nil, "", err
+	}
+
+	r, jti, err := s.tokenBackend.EncodeRefresh(payload, s.refreshTokenExpiration())
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &Tokens{a, r}, jti, nil
+}
+
 func (s *authService) Register(
 	ctx context.Context,
 	request *model.RegisterRequest,
@@ -98,10 +255,11 @@ func (s *authService) Register(
 		return nil, fmt.Errorf("unexpected err: %w", err) // if password > 72 bytes (per bcrypt docs)
 	}
 
+	password := string(passwordHash)
 	userCreate := model.UserCreate{
 		Email:    request.Email,
 		Username: request.Username,
-		Password: string(passwordHash),
+		Password: &password,
 		Verified: false,
 	}
 
@@ -116,33 +274,55 @@ func (s *authService) Register(
 		return nil, fmt.Errorf("failed to get user by id: %w", err)
 	}
 
+	return s.createTokens(ctx, user)
+}
+
+// mfaChallenge is returned instead of tokens to users with 2fa enabled,
+// login is completed with LoginTOTP.
+func (s *authService) mfaChallenge(user *entity.User) (*LoginResult, error) {
 	payload := token.User{
 		ID:       user.ID,
 		Username: user.Username,
-		Roles:    []string{},
-	}
-	a, err := s.tokenBackend.Encode(&payload, 60*60*6, token.AccessTokenType)
-	if err != nil {
-		return nil, err
 	}
-	r, err := s.tokenBackend.Encode(&payload, 60*60*24*31, token.RefreshTokenType)
+	mfaToken, err := s.tokenBackend.Encode(
+		&payload,
+		mfaTokenExpiration,
+		token.MFATokenType,
+	)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Tokens{a, r}, nil
+	return &LoginResult{MFAToken: mfaToken}, nil
 }
 
 func (s *authService) Login(
 	ctx context.Context,
 	request *model.LoginRequest,
-) (*Tokens, error) {
+) (*LoginResult, error) {
 	login := strings.TrimSpace(request.Login)
+	if err := s.checkLoginRateLimit(ctx, login); err != nil {
+		return nil, err
+	}
+
 	user, err := s.userRepo.GetByLogin(ctx, login)
-	if err != nil {
+	if err != nil || user == nil {
+		key := loginLimitKey(login)
+		if err := s.checkLoginLock(ctx, key); err != nil {
+			return nil, err
+		}
+
+		if err := s.addLoginFailure(ctx, key); err != nil {
+			return nil, err
+		}
+
 		return nil, ErrUserNotFound
 	}
 
+	if err := s.checkLoginLock(ctx, userLimitKey(user.ID)); err != nil {
+		return nil, err
+	}
+
 	if !user.Active {
 		return nil, ErrUserNotActive
 	}
@@ -155,30 +335,98 @@ func (s *authService) Login(
 		[]byte(*user.Password),
 		[]byte(request.Password),
 	) != nil {
+		if err := s.addLoginFailure(ctx, userLimitKey(user.ID)); err != nil {
+			return nil, err
+		}
+
 		return nil, ErrPasswordVerification
 	}
 
+	if user.TOTPEnabled {
+		return s.mfaChallenge(user)
+	}
+
 	s.userRepo.UpdateLastLogin(ctx, user.ID)
 
-	payload := token.User{
-		ID:       user.ID,
-		Username: user.Username,
-		Roles:    []string{},
+	tokens, err := s.createTokens(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	// cleared only when login succeeded, not after password step of 2fa
+	if err := s.clearLoginFailures(ctx, user.ID); err != nil {
+		return nil, err
+	}
+
+	return &LoginResult{Tokens: tokens}, nil
+}
+
+func (s *authService) LoginTOTP(
+	ctx context.Context,
+	request *model.LoginTOTPRequest,
+) (*Tokens, error) {
+	claims, err := s.tokenBackend.Decode(request.Token, token.MFATokenType)
+	if err != nil {
+		return nil, ErrTokenDecoding
+	}
+
+	used, err := s.userRepo.IsMFATokenUsed(ctx, claims.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check mfa token: %w", err)
+	}
+
+	if used {
+		return nil, ErrMFATokenUsed
 	}
-	a, err := s.tokenBackend.Encode(&payload, 60*60*6, token.AccessTokenType)
+
+	user, err := s.getUser(ctx, claims.UserID)
 	if err != nil {
 		return nil, err
 	}
-	r, err := s.tokenBackend.Encode(&payload, 60*60*24*31, token.RefreshTokenType)
+
+	if !user.Active {
+		return nil, ErrUserNotActive
+	}
+
+	if !user.TOTPEnabled {
+		return nil, ErrTOTPNotEnabled
+	}
+
+	if err := s.verifySecondFactorLimited(ctx, user, request.Code); err != nil {
+		return nil, err
+	}
+
+	// token is single use, the second request with it loses here
+	ok, err := s.userRepo.UseMFAToken(ctx, claims.ID, mfaTokenExpiration)
 	if err != nil {
+		return nil, fmt.Errorf("failed to use mfa token: %w", err)
+	}
+
+	if !ok {
+		return nil, ErrMFATokenUsed
+	}
+
+	s.userRepo.UpdateLastLogin(ctx, user.ID)
+
+	tokens, err := s.createTokens(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.clearLoginFailures(ctx, user.ID); err != nil {
 		return nil, err
 	}
 
-	return &Tokens{a, r}, nil
+	return tokens, nil
 }
 
 var (
-	ErrTokenDecoding = errors.New("token decoding error")
+	ErrTokenDecoding       = errors.New("token decoding error")
+	ErrRefreshTokenRevoked = errors.New("refresh token revoked")
+	ErrRefreshTokenReuse   = errors.New("refresh token reuse")
+	ErrRefreshTokenRotated = errors.New("refresh token was just rotated")
+	ErrSessionRevoked      = errors.New("session revoked")
+	ErrMFATokenUsed        = errors.New("2fa token already used")
 )
 
 func (s *authService) Token(
@@ -190,72 +438,177 @@ func (s *authService) Token(
 		return nil, ErrTokenDecoding
 	}
 
+	if user.SessionID != "" {
+		denied, err := s.userRepo.IsSessionDenied(ctx, user.SessionID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check session denylist: %w", err)
+		}
+
+		if denied {
+			return nil, ErrSessionRevoked
+		}
+	}
+
 	return token.UserPayloadFromUserClaims(user), nil
 }
 
+// RefreshToken rotates refresh token. Refresh token that was already
+// rotated means that it was stolen (or client failed to store new one),
+// so the whole family is revoked.
 func (s *authService) RefreshToken(
 	ctx context.Context,
 	refreshToken string,
-) (string, error) {
+) (*Tokens, error) {
 	refreshTokenClaims, err := s.tokenBackend.Decode(
 		refreshToken,
-		token.AccessTokenType,
+		token.RefreshTokenType,
 	)
+	if err != nil || refreshTokenClaims.SessionID == "" {
+		return nil, ErrTokenDecoding
+	}
+
+	id := refreshTokenClaims.UserID
+	family := refreshTokenClaims.SessionID
+	denied, err := s.userRepo.IsSessionDenied(ctx, family)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check session denylist: %w", err)
+	}
+
+	if denied {
+		return nil, ErrRefreshTokenRevoked
+	}
+
+	current, err := s.userRepo.GetRefreshFamily(ctx, family)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get refresh family: %w", err)
+	}
+
+	if current == "" {
+		return nil, ErrRefreshTokenRevoked
+	}
+
+	if current != refreshTokenClaims.ID {
+		// concurrent refresh with the same token (e.g. from several tabs),
+		// client should retry with the new one
+		rotated, err := s.userRepo.GetRotatedRefreshFamily(ctx, family)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get rotated refresh family: %w", err)
+		}
+
+		if rotated == refreshTokenClaims.ID {
+			return nil, ErrRefreshTokenRotated
+		}
+
+		if err := s.revokeSession(ctx, family, refreshTokenClaims.ExpiresAt.Time); err != nil {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("%w: user %d, family %s", ErrRefreshTokenReuse, id, family)
+	}
+
+	session, err := s.sessionRepo.Get(ctx, family)
 	if err != nil {
-		return "", ErrTokenDecoding
+		return nil, fmt.Errorf("failed to get session: %w", err)
+	}
+
+	if session == nil || session.RevokedAt != nil {
+		return nil, ErrRefreshTokenRevoked
 	}
 
-	id := refreshTokenClaims.ID
 	yes, err := s.userRepo.WasRecentlyBanned(ctx, id)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if yes {
-		return "", ErrUserNotActive
+		return nil, ErrUserNotActive
 	}
 
-	yes, err = s.userRepo.IsKicked(ctx, id)
+	kick, err := s.userRepo.GetKick(ctx, id)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	if yes {
-		return "", ErrUserWasKicked
+	if kick != nil && refreshTokenClaims.IssuedAt.Unix() <= kick.Unix() {
+		return nil, ErrUserWasKicked
 	}
 
 	ml, err := s.userRepo.GetMassLogout(ctx)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	if refreshTokenClaims.Iat <= ml.Unix() {
-		return "", ErrUserInMassLogout
+	if ml != nil && refreshTokenClaims.IssuedAt.Unix() <= ml.Unix() {
+		return nil, ErrUserInMassLogout
 	}
 
-	user, err := s.userRepo.Get(ctx, refreshTokenClaims.ID)
+	user, err := s.getUser(ctx, id)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	payload := token.User{
-		ID:       user.ID,
-		Username: user.Username,
-		Roles:    []string{},
+	if !user.Active {
+		return nil, ErrUserNotActive
+	}
+
+	now := time.Now().UTC()
+	if err := s.sessionRepo.Touch(ctx, family, now, now.Add(s.refreshTokenExpiration())); err != nil {
+		return nil, fmt.Errorf("failed to update session: %w", err)
+	}
+
+	tokens, jti, err := s.encodeSessionTokens(ctx, user, family)
+	if err != nil {
+		return nil, err
 	}
-	a, err := s.tokenBackend.Encode(&payload, 60*60*6, token.AccessTokenType)
+
+	ok, err := s.userRepo.RotateRefreshFamily(
+		ctx,
+		family,
+		refreshTokenClaims.ID,
+		jti,
+		s.refreshTokenExpiration(),
+	)
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("failed to rotate refresh family: %w", err)
+	}
+
+	if !ok {
+		return nil, ErrRefreshTokenRotated
 	}
 
-	return a, nil
+	return tokens, nil
 }
 
-func (s *authService) Me(ctx context.Context, id int32) (*model.Me, error) {
+func (s *authService) getUser(ctx context.Context, id int32) (*entity.User, error) {
 	user, err := s.userRepo.Get(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user by id: %w", err)
+	}
+
+	if user == nil {
+		return nil, ErrUserNotFound
+	}
+
+	return user, nil
+}
+
+func (s *authService) Me(ctx context.Context, id int32) (*model.Me, error) {
+	user, err := s.getUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	user.OAuth, err = s.userRepo.GetOAuthProviders(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get oauth providers: %w", err)
+	}
+
+	payload, err := s.tokenUser(ctx, user)
 	if err != nil {
 		return nil, err
 	}
+	user.Roles = payload.Roles
+	user.Permissions = payload.Permissions
 
 	return model.MeFromUser(user), nil
 }
@@ -1,7 +1,11 @@
 package service_test
 
 import (
+	"context"
 	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -10,19 +14,248 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/pegov/fauth-backend-go/internal/captcha"
+	"github.com/pegov/fauth-backend-go/internal/config"
 	"github.com/pegov/fauth-backend-go/internal/email"
 	"github.com/pegov/fauth-backend-go/internal/entity"
 	"github.com/pegov/fauth-backend-go/internal/model"
+	"github.com/pegov/fauth-backend-go/internal/oauth"
 	"github.com/pegov/fauth-backend-go/internal/password"
 	"github.com/pegov/fauth-backend-go/internal/repo"
 	"github.com/pegov/fauth-backend-go/internal/service"
+	"github.com/pegov/fauth-backend-go/internal/signer"
+	"github.com/pegov/fauth-backend-go/internal/storage"
 	"github.com/pegov/fauth-backend-go/internal/token"
+	"github.com/pegov/fauth-backend-go/internal/totp"
 )
 
+func newAuthService(
+	t *testing.T,
+	userRepo repo.UserRepo,
+	roleRepo repo.RoleRepo,
+	sessionRepo repo.SessionRepo,
+) (service.AuthService, totp.SecretCipher) {
+	s, _, totpCipher := newServices(t, userRepo, roleRepo, sessionRepo, nil)
+	return s, totpCipher
+}
+
+func newServices(
+	t *testing.T,
+	userRepo repo.UserRepo,
+	roleRepo repo.RoleRepo,
+	sessionRepo repo.SessionRepo,
+	providers map[string]oauth.OAuthProvider,
+) (service.AuthService, service.OAuthService, totp.SecretCipher) {
+	generateKeys := func(seed []byte) ([]byte, []byte) {
+		private := ed25519.NewKeyFromSeed(seed)
+		public := private.Public().(ed25519.PublicKey)
+		return private, public
+	}
+	privateKey, publicKey := generateKeys([]byte(strings.Repeat("a", ed25519.SeedSize)))
+	tokenBackend := token.NewJwtBackendRaw(privateKey, publicKey, "1")
+
+	totpCipher, err := totp.NewAESSecretCipher([]byte(strings.Repeat("k", 32)))
+	require.NoError(t, err)
+
+	cfg := config.Config{
+		App: config.App{
+			AccessTokenExpiration:  60 * 60 * 6,
+			RefreshTokenExpiration: 60 * 60 * 24 * 31,
+			LoginRatelimit:         10,
+			LoginLockoutThreshold:  3,
+			LoginLockoutDuration:   60,
+		},
+		OAuth: config.OAuth{
+			CallbackBaseURL: "https://example.com/",
+		},
+	}
+
+	s := service.NewAuthService(
+		&cfg,
+		userRepo,
+		roleRepo,
+		sessionRepo,
+		captcha.NewDebugCaptchaClient(""),
+		password.NewPlainTextPasswordHasher(),
+		tokenBackend,
+		email.NewMockEmailClient(),
+		totpCipher,
+		signer.NewHMACSigner([]byte("secret")),
+	)
+
+	return s, service.NewOAuthService(&cfg, userRepo, s, providers), totpCipher
+}
+
+// cacheUserRepo serves cache-backed methods of UserRepo with real repo
+// over MemoryCache, db methods are left to mock.
+type cacheUserRepo struct {
+	repo.UserRepo
+	cached repo.UserRepo
+	cache  storage.CacheOps
+}
+
+func newCacheUserRepo(repoM repo.UserRepo) *cacheUserRepo {
+	cache := storage.NewMemoryCache()
+	return &cacheUserRepo{
+		UserRepo: repoM,
+		cached:   repo.NewUserRepo(nil, cache),
+		cache:    cache,
+	}
+}
+
+// WithTx runs fn without transaction, so that cache-backed methods
+// are served by cacheUserRepo inside of it too.
+func (r *cacheUserRepo) WithTx(ctx context.Context, fn func(context.Context, repo.UserRepo) error) error {
+	return fn(ctx, r)
+}
+
+func (r *cacheUserRepo) HitRateLimit(
+	ctx context.Context,
+	key string,
+	limit int,
+	window time.Duration,
+) (time.Duration, error) {
+	return r.cached.HitRateLimit(ctx, key, limit, window)
+}
+
+func (r *cacheUserRepo) AddLoginFailure(ctx context.Context, key string, expiration time.Duration) (int64, error) {
+	return r.cached.AddLoginFailure(ctx, key, expiration)
+}
+
+func (r *cacheUserRepo) LockLogin(ctx context.Context, key string, duration time.Duration) error {
+	return r.cached.LockLogin(ctx, key, duration)
+}
+
+func (r *cacheUserRepo) GetLoginLock(ctx context.Context, key string) (time.Duration, error) {
+	return r.cached.GetLoginLock(ctx, key)
+}
+
+func (r *cacheUserRepo) ClearLoginFailures(ctx context.Context, key string) error {
+	return r.cached.ClearLoginFailures(ctx, key)
+}
+
+func (r *cacheUserRepo) UseMFAToken(ctx context.Context, jti string, expiration time.Duration) (bool, error) {
+	return r.cached.UseMFAToken(ctx, jti, expiration)
+}
+
+func (r *cacheUserRepo) IsMFATokenUsed(ctx context.Context, jti string) (bool, error) {
+	return r.cached.IsMFATokenUsed(ctx, jti)
+}
+
+func (r *cacheUserRepo) UseTOTPStep(
+	ctx context.Context,
+	id int32,
+	step uint64,
+	expiration time.Duration,
+) (bool, error) {
+	return r.cached.UseTOTPStep(ctx, id, step, expiration)
+}
+
+func (r *cacheUserRepo) SetPasswordResetNonce(
+	ctx context.Context,
+	id int32,
+	nonce string,
+	expiration time.Duration,
+) error {
+	return r.cached.SetPasswordResetNonce(ctx, id, nonce, expiration)
+}
+
+func (r *cacheUserRepo) UsePasswordResetNonce(ctx context.Context, id int32, nonce string) (bool, error) {
+	return r.cached.UsePasswordResetNonce(ctx, id, nonce)
+}
+
+func (r *cacheUserRepo) Kick(ctx context.Context, id int32, refreshTokenExpiration time.Duration) error {
+	return r.cached.Kick(ctx, id, refreshTokenExpiration)
+}
+
+func (r *cacheUserRepo) GetKick(ctx context.Context, id int32) (*time.Time, error) {
+	return r.cached.GetKick(ctx, id)
+}
+
+func (r *cacheUserRepo) GetRefreshFamily(ctx context.Context, family string) (string, error) {
+	return r.cached.GetRefreshFamily(ctx, family)
+}
+
+func (r *cacheUserRepo) SetRefreshFamily(ctx context.Context, family, jti string, expiration time.Duration) error {
+	return r.cached.SetRefreshFamily(ctx, family, jti, expiration)
+}
+
+func (r *cacheUserRepo) RotateRefreshFamily(
+	ctx context.Context,
+	family, oldJTI, newJTI string,
+	expiration time.Duration,
+) (bool, error) {
+	return r.cached.RotateRefreshFamily(ctx, family, oldJTI, newJTI, expiration)
+}
+
+func (r *cacheUserRepo) GetRotatedRefreshFamily(ctx context.Context, family string) (string, error) {
+	return r.cached.GetRotatedRefreshFamily(ctx, family)
+}
+
+func (r *cacheUserRepo) DeleteRefreshFamily(ctx context.Context, family string) error {
+	return r.cached.DeleteRefreshFamily(ctx, family)
+}
+
+func (r *cacheUserRepo) DenySession(ctx context.Context, sessionID string, expiration time.Duration) error {
+	return r.cached.DenySession(ctx, sessionID, expiration)
+}
+
+func (r *cacheUserRepo) IsSessionDenied(ctx context.Context, sessionID string) (bool, error) {
+	return r.cached.IsSessionDenied(ctx, sessionID)
+}
+
+// loginFailures returns current number of failures of key without adding one.
+func (r *cacheUserRepo) loginFailures(t *testing.T, key string) int64 {
+	s, err := r.cache.Get(t.Context(), "users:login_failures:"+key).Result()
+	if errors.Is(err, storage.ErrNil) {
+		return 0
+	}
+	require.NoError(t, err)
+
+	count, err := strconv.ParseInt(s, 10, 64)
+	require.NoError(t, err)
+	return count
+}
+
+// requireLoginLock checks lockout of key, lock is stored in seconds.
+func (r *cacheUserRepo) requireLoginLock(t *testing.T, key string, expected time.Duration) {
+	lock, err := r.cached.GetLoginLock(t.Context(), key)
+	require.NoError(t, err)
+	require.InDelta(t, expected, lock, float64(time.Second))
+}
+
+func (r *cacheUserRepo) expireLoginLock(t *testing.T, key string) {
+	require.NoError(t, r.cache.Del(t.Context(), "users:login_lock:"+key).Err())
+}
+
+// expireTOTPSteps forgets used steps around now, so that code can be reused.
+func (r *cacheUserRepo) expireTOTPSteps(t *testing.T, id int32) {
+	step := uint64(time.Now().Unix()) / totp.Period
+	for i := step - 2; i <= step+2; i++ {
+		require.NoError(t, r.cache.Del(t.Context(), fmt.Sprintf("users:totp_step:%d:%d", id, i)).Err())
+	}
+}
+
+func (r *cacheUserRepo) refreshFamily(t *testing.T, family string) string {
+	jti, err := r.cached.GetRefreshFamily(t.Context(), family)
+	require.NoError(t, err)
+	return jti
+}
+
+func (r *cacheUserRepo) expireRotatedRefreshFamily(t *testing.T, family string) {
+	require.NoError(t, r.cache.Del(t.Context(), "users:refresh_family_rotated:"+family).Err())
+}
+
+func (r *cacheUserRepo) sessionDenied(t *testing.T, sessionID string) bool {
+	denied, err := r.cached.IsSessionDenied(t.Context(), sessionID)
+	require.NoError(t, err)
+	return denied
+}
+
 func TestLogin(t *testing.T) {
 	ctrl := mock.NewMockController(t)
 	repoM := mock.Mock[repo.UserRepo](ctrl)
-	ph := password.NewPlainTextPasswordHasher()
+	roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+	sessionRepoM := mock.Mock[repo.SessionRepo](ctrl)
 
 	req := model.LoginRequest{
 		Login:    "user",
@@ -40,26 +273,1300 @@ func TestLogin(t *testing.T) {
 	}
 
 	mock.WhenDouble(repoM.GetByLogin(mock.AnyContext(), mock.Exact(req.Login))).ThenReturn(&res, nil)
+	mock.WhenDouble(roleRepoM.GetUserRoles(mock.AnyContext(), mock.Exact(res.ID))).ThenReturn([]string{"admin"}, nil)
+	mock.WhenDouble(roleRepoM.GetUserPermissions(mock.AnyContext(), mock.Exact(res.ID))).
+		ThenReturn([]string{model.PermissionUsersBan}, nil)
 
-	generateKeys := func(seed []byte) ([]byte, []byte) {
-		private := ed25519.NewKeyFromSeed(seed)
-		public := private.Public().(ed25519.PublicKey)
-		return private, public
+	s, _ := newAuthService(t, repoM, roleRepoM, sessionRepoM)
+
+	result, err := s.Login(t.Context(), &req)
+	require.NoError(t, err)
+
+	require.Empty(t, result.MFAToken)
+	require.NotEmpty(t, result.Tokens.Access)
+	require.NotEmpty(t, result.Tokens.Refresh)
+
+	user, err := s.Token(t.Context(), result.Tokens.Access)
+	require.NoError(t, err)
+	require.Equal(t, []string{"admin"}, user.Roles)
+	require.Equal(t, []string{model.PermissionUsersBan}, user.Permissions)
+}
+
+func TestLoginTOTP(t *testing.T) {
+	ctrl := mock.NewMockController(t)
+	repoM := mock.Mock[repo.UserRepo](ctrl)
+	cached := newCacheUserRepo(repoM)
+	roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+	sessionRepoM := mock.Mock[repo.SessionRepo](ctrl)
+
+	s, totpCipher := newAuthService(t, cached, roleRepoM, sessionRepoM)
+
+	secret, err := totp.GenerateSecret()
+	require.NoError(t, err)
+	encryptedSecret, err := totpCipher.Encrypt(secret)
+	require.NoError(t, err)
+
+	req := model.LoginRequest{
+		Login:    "user",
+		Password: "pass",
+	}
+	res := entity.User{
+		ID:          1,
+		Username:    req.Login,
+		Password:    &req.Password,
+		Active:      true,
+		Verified:    true,
+		TOTPSecret:  &encryptedSecret,
+		TOTPEnabled: true,
 	}
-	privateKey, publicKey := generateKeys([]byte(strings.Repeat("a", ed25519.SeedSize)))
-	tokenBackend := token.NewJwtBackendRaw(privateKey, publicKey, "1")
 
-	s := service.NewAuthService(
-		repoM,
-		captcha.NewDebugCaptchaClient(""),
-		ph,
-		tokenBackend,
-		email.NewMockEmailClient(),
-	)
+	mock.WhenDouble(repoM.GetByLogin(mock.AnyContext(), mock.Exact(req.Login))).ThenReturn(&res, nil)
+	mock.WhenDouble(repoM.Get(mock.AnyContext(), mock.Exact(res.ID))).ThenReturn(&res, nil)
+
+	result, err := s.Login(t.Context(), &req)
+	require.NoError(t, err)
+	require.Nil(t, result.Tokens)
+	require.NotEmpty(t, result.MFAToken)
+
+	_, err = s.Token(t.Context(), result.MFAToken)
+	require.ErrorIs(t, err, service.ErrTokenDecoding)
+
+	_, err = s.LoginTOTP(t.Context(), &model.LoginTOTPRequest{
+		Token: result.MFAToken,
+		Code:  "000000x",
+	})
+	require.ErrorIs(t, err, service.ErrInvalidTOTPCode)
 
-	tokens, err := s.Login(t.Context(), &req)
+	code, err := totp.GenerateCode(secret, time.Now())
 	require.NoError(t, err)
 
+	tokens, err := s.LoginTOTP(t.Context(), &model.LoginTOTPRequest{
+		Token: result.MFAToken,
+		Code:  code,
+	})
+	require.NoError(t, err)
 	require.NotEmpty(t, tokens.Access)
 	require.NotEmpty(t, tokens.Refresh)
+
+	// mfa token is single use
+	_, err = s.LoginTOTP(t.Context(), &model.LoginTOTPRequest{
+		Token: result.MFAToken,
+		Code:  code,
+	})
+	require.ErrorIs(t, err, service.ErrMFATokenUsed)
+
+	// code can't be replayed with new mfa token
+	result, err = s.Login(t.Context(), &req)
+	require.NoError(t, err)
+	_, err = s.LoginTOTP(t.Context(), &model.LoginTOTPRequest{
+		Token: result.MFAToken,
+		Code:  code,
+	})
+	require.ErrorIs(t, err, service.ErrInvalidTOTPCode)
+}
+
+func TestLoginTOTPLockout(t *testing.T) {
+	ctrl := mock.NewMockController(t)
+	repoM := mock.Mock[repo.UserRepo](ctrl)
+	cached := newCacheUserRepo(repoM)
+	roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+	sessionRepoM := mock.Mock[repo.SessionRepo](ctrl)
+
+	s, totpCipher := newAuthService(t, cached, roleRepoM, sessionRepoM)
+
+	secret, err := totp.GenerateSecret()
+	require.NoError(t, err)
+	encryptedSecret, err := totpCipher.Encrypt(secret)
+	require.NoError(t, err)
+
+	pass := "pass"
+	res := entity.User{
+		ID:          1,
+		Username:    "user",
+		Password:    &pass,
+		Active:      true,
+		TOTPSecret:  &encryptedSecret,
+		TOTPEnabled: true,
+	}
+
+	mock.WhenDouble(repoM.GetByLogin(mock.AnyContext(), mock.Exact(res.Username))).ThenReturn(&res, nil)
+	mock.WhenDouble(repoM.Get(mock.AnyContext(), mock.Exact(res.ID))).ThenReturn(&res, nil)
+
+	// every guess with new mfa token is still counted
+	for range 5 {
+		result, err := s.Login(t.Context(), &model.LoginRequest{Login: res.Username, Password: pass})
+		require.NoError(t, err)
+
+		_, err = s.LoginTOTP(t.Context(), &model.LoginTOTPRequest{
+			Token: result.MFAToken,
+			Code:  "000000",
+		})
+		require.Error(t, err)
+	}
+	cached.requireLoginLock(t, "mfa:1", 15*time.Minute)
+
+	code, err := totp.GenerateCode(secret, time.Now())
+	require.NoError(t, err)
+	result, err := s.Login(t.Context(), &model.LoginRequest{Login: res.Username, Password: pass})
+	require.NoError(t, err)
+	_, err = s.LoginTOTP(t.Context(), &model.LoginTOTPRequest{
+		Token: result.MFAToken,
+		Code:  code,
+	})
+	var rateLimitError *service.RateLimitError
+	require.ErrorAs(t, err, &rateLimitError)
+
+	// lockout expired, successful login clears failures
+	cached.expireLoginLock(t, "mfa:1")
+	_, err = s.LoginTOTP(t.Context(), &model.LoginTOTPRequest{
+		Token: result.MFAToken,
+		Code:  code,
+	})
+	require.NoError(t, err)
+	require.Zero(t, cached.loginFailures(t, "mfa:1"))
+}
+
+func TestLoginTOTPRecoveryCode(t *testing.T) {
+	ctrl := mock.NewMockController(t)
+	repoM := mock.Mock[repo.UserRepo](ctrl)
+	cached := newCacheUserRepo(repoM)
+	roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+	sessionRepoM := mock.Mock[repo.SessionRepo](ctrl)
+
+	s, _ := newAuthService(t, cached, roleRepoM, sessionRepoM)
+
+	pass := "pass"
+	secret := "secret"
+	res := entity.User{
+		ID:          1,
+		Username:    "user",
+		Password:    &pass,
+		Active:      true,
+		TOTPSecret:  &secret,
+		TOTPEnabled: true,
+	}
+	codes := []entity.RecoveryCode{
+		{ID: 10, UserID: res.ID, Code: "aaaaa-bbbbb"},
+	}
+
+	mock.WhenDouble(repoM.GetByLogin(mock.AnyContext(), mock.Exact(res.Username))).ThenReturn(&res, nil)
+	mock.WhenDouble(repoM.Get(mock.AnyContext(), mock.Exact(res.ID))).ThenReturn(&res, nil)
+	mock.WhenDouble(repoM.GetRecoveryCodes(mock.AnyContext(), mock.Exact(res.ID))).ThenReturn(codes, nil)
+	mock.WhenDouble(repoM.UseRecoveryCode(mock.AnyContext(), mock.Exact(int32(10)))).ThenReturn(true, nil)
+
+	result, err := s.Login(t.Context(), &model.LoginRequest{Login: res.Username, Password: pass})
+	require.NoError(t, err)
+
+	_, err = s.LoginTOTP(t.Context(), &model.LoginTOTPRequest{
+		Token: result.MFAToken,
+		Code:  "aaaaa-ccccc",
+	})
+	require.ErrorIs(t, err, service.ErrInvalidTOTPCode)
+
+	tokens, err := s.LoginTOTP(t.Context(), &model.LoginTOTPRequest{
+		Token: result.MFAToken,
+		Code:  " AAAAA-BBBBB ",
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, tokens.Access)
+}
+
+// totpStore keeps 2fa settings of user and recovery codes in memory.
+type totpStore struct {
+	codes []entity.RecoveryCode
+}
+
+func stubTOTPStore(repoM repo.UserRepo, user *entity.User) *totpStore {
+	store := &totpStore{}
+
+	mock.WhenSingle(repoM.UpdateTOTP(
+		mock.AnyContext(),
+		mock.Exact(user.ID),
+		mock.Any[*string](),
+		mock.Any[bool](),
+	)).ThenAnswer(func(args []any) error {
+		user.TOTPSecret = args[2].(*string)
+		user.TOTPEnabled = args[3].(bool)
+		return nil
+	})
+	mock.WhenSingle(repoM.CreateRecoveryCodes(mock.AnyContext(), mock.Exact(user.ID), mock.Any[[]string]())).
+		ThenAnswer(func(args []any) error {
+			for _, code := range args[2].([]string) {
+				store.codes = append(store.codes, entity.RecoveryCode{
+					ID:     int32(len(store.codes) + 1),
+					UserID: user.ID,
+					Code:   code,
+				})
+			}
+			return nil
+		})
+	mock.WhenSingle(repoM.DeleteRecoveryCodes(mock.AnyContext(), mock.Exact(user.ID))).
+		ThenAnswer(func(args []any) error {
+			store.codes = nil
+			return nil
+		})
+	mock.WhenDouble(repoM.GetRecoveryCodes(mock.AnyContext(), mock.Exact(user.ID))).
+		ThenAnswer(func(args []any) ([]entity.RecoveryCode, error) {
+			var codes []entity.RecoveryCode
+			for _, code := range store.codes {
+				if code.UsedAt == nil {
+					codes = append(codes, code)
+				}
+			}
+			return codes, nil
+		})
+	mock.WhenDouble(repoM.UseRecoveryCode(mock.AnyContext(), mock.Any[int32]())).
+		ThenAnswer(func(args []any) (bool, error) {
+			for i := range store.codes {
+				if store.codes[i].ID == args[1].(int32) && store.codes[i].UsedAt == nil {
+					now := time.Now()
+					store.codes[i].UsedAt = &now
+					return true, nil
+				}
+			}
+			return false, nil
+		})
+
+	return store
+}
+
+func TestTOTPSettings(t *testing.T) {
+	ctrl := mock.NewMockController(t)
+	repoM := mock.Mock[repo.UserRepo](ctrl)
+	cached := newCacheUserRepo(repoM)
+	roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+	sessionRepoM := mock.Mock[repo.SessionRepo](ctrl)
+
+	s, _ := newAuthService(t, cached, roleRepoM, sessionRepoM)
+
+	res := entity.User{ID: 1, Username: "user", Active: true}
+	store := stubTOTPStore(repoM, &res)
+	mock.WhenDouble(repoM.Get(mock.AnyContext(), mock.Exact(res.ID))).ThenReturn(&res, nil)
+
+	_, err := s.ConfirmTOTP(t.Context(), res.ID, &model.TOTPCodeRequest{Code: "000000"})
+	require.ErrorIs(t, err, service.ErrTOTPNotSetUp)
+
+	setup, err := s.SetupTOTP(t.Context(), res.ID)
+	require.NoError(t, err)
+	require.NotNil(t, res.TOTPSecret)
+	require.NotEqual(t, setup.Secret, *res.TOTPSecret)
+	require.False(t, res.TOTPEnabled)
+
+	_, err = s.ConfirmTOTP(t.Context(), res.ID, &model.TOTPCodeRequest{Code: "000000x"})
+	require.ErrorIs(t, err, service.ErrInvalidTOTPCode)
+	require.False(t, res.TOTPEnabled)
+
+	code, err := totp.GenerateCode(setup.Secret, time.Now())
+	require.NoError(t, err)
+	codes, err := s.ConfirmTOTP(t.Context(), res.ID, &model.TOTPCodeRequest{Code: code})
+	require.NoError(t, err)
+	require.True(t, res.TOTPEnabled)
+	require.Len(t, codes.Codes, totp.RecoveryCodesCount)
+	require.Len(t, store.codes, totp.RecoveryCodesCount)
+
+	_, err = s.ConfirmTOTP(t.Context(), res.ID, &model.TOTPCodeRequest{Code: code})
+	require.ErrorIs(t, err, service.ErrTOTPAlreadyEnabled)
+
+	_, err = s.SetupTOTP(t.Context(), res.ID)
+	require.ErrorIs(t, err, service.ErrTOTPAlreadyEnabled)
+
+	// code of used step can't remove 2fa
+	err = s.RemoveTOTP(t.Context(), res.ID, &model.TOTPCodeRequest{Code: code})
+	require.ErrorIs(t, err, service.ErrInvalidTOTPCode)
+	require.True(t, res.TOTPEnabled)
+
+	cached.expireTOTPSteps(t, res.ID)
+	require.NoError(t, s.RemoveTOTP(t.Context(), res.ID, &model.TOTPCodeRequest{Code: code}))
+	require.False(t, res.TOTPEnabled)
+	require.Nil(t, res.TOTPSecret)
+	require.Empty(t, store.codes)
+
+	err = s.RemoveTOTP(t.Context(), res.ID, &model.TOTPCodeRequest{Code: code})
+	require.ErrorIs(t, err, service.ErrTOTPNotEnabled)
+}
+
+func TestTOTPSettingsLockout(t *testing.T) {
+	ctrl := mock.NewMockController(t)
+	repoM := mock.Mock[repo.UserRepo](ctrl)
+	cached := newCacheUserRepo(repoM)
+	roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+	sessionRepoM := mock.Mock[repo.SessionRepo](ctrl)
+
+	s, totpCipher := newAuthService(t, cached, roleRepoM, sessionRepoM)
+
+	secret, err := totp.GenerateSecret()
+	require.NoError(t, err)
+	encryptedSecret, err := totpCipher.Encrypt(secret)
+	require.NoError(t, err)
+
+	res := entity.User{ID: 1, Username: "user", Active: true, TOTPSecret: &encryptedSecret}
+	stubTOTPStore(repoM, &res)
+	mock.WhenDouble(repoM.Get(mock.AnyContext(), mock.Exact(res.ID))).ThenReturn(&res, nil)
+
+	code, err := totp.GenerateCode(secret, time.Now())
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		call   func(code string) error
+		enable bool
+	}{
+		{"confirm", func(code string) error {
+			_, err := s.ConfirmTOTP(t.Context(), res.ID, &model.TOTPCodeRequest{Code: code})
+			return err
+		}, false},
+		{"remove", func(code string) error {
+			return s.RemoveTOTP(t.Context(), res.ID, &model.TOTPCodeRequest{Code: code})
+		}, true},
+		{"regenerate recovery codes", func(code string) error {
+			_, err := s.RegenerateRecoveryCodes(t.Context(), res.ID, &model.TOTPCodeRequest{Code: code})
+			return err
+		}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res.TOTPEnabled = tt.enable
+			cached.expireTOTPSteps(t, res.ID)
+			require.NoError(t, cached.ClearLoginFailures(t.Context(), "mfa:1"))
+
+			for range 5 {
+				require.ErrorIs(t, tt.call("000000x"), service.ErrInvalidTOTPCode)
+			}
+			cached.requireLoginLock(t, "mfa:1", 15*time.Minute)
+
+			var rateLimitError *service.RateLimitError
+			require.ErrorAs(t, tt.call(code), &rateLimitError)
+			require.Equal(t, tt.enable, res.TOTPEnabled)
+		})
+	}
+}
+
+func TestRegenerateRecoveryCodes(t *testing.T) {
+	ctrl := mock.NewMockController(t)
+	repoM := mock.Mock[repo.UserRepo](ctrl)
+	cached := newCacheUserRepo(repoM)
+	roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+	sessionRepoM := mock.Mock[repo.SessionRepo](ctrl)
+
+	s, _ := newAuthService(t, cached, roleRepoM, sessionRepoM)
+
+	pass := "pass"
+	res := entity.User{ID: 1, Username: "user", Password: &pass, Active: true}
+	stubTOTPStore(repoM, &res)
+	stubSessionStore(sessionRepoM)
+	mock.WhenDouble(repoM.GetByLogin(mock.AnyContext(), mock.Exact(res.Username))).ThenReturn(&res, nil)
+	mock.WhenDouble(repoM.Get(mock.AnyContext(), mock.Exact(res.ID))).ThenReturn(&res, nil)
+
+	_, err := s.RegenerateRecoveryCodes(t.Context(), res.ID, &model.TOTPCodeRequest{Code: "000000"})
+	require.ErrorIs(t, err, service.ErrTOTPNotEnabled)
+
+	setup, err := s.SetupTOTP(t.Context(), res.ID)
+	require.NoError(t, err)
+	code, err := totp.GenerateCode(setup.Secret, time.Now())
+	require.NoError(t, err)
+	oldCodes, err := s.ConfirmTOTP(t.Context(), res.ID, &model.TOTPCodeRequest{Code: code})
+	require.NoError(t, err)
+
+	_, err = s.RegenerateRecoveryCodes(t.Context(), res.ID, &model.TOTPCodeRequest{Code: "000000x"})
+	require.ErrorIs(t, err, service.ErrInvalidTOTPCode)
+
+	cached.expireTOTPSteps(t, res.ID)
+	newCodes, err := s.RegenerateRecoveryCodes(t.Context(), res.ID, &model.TOTPCodeRequest{Code: code})
+	require.NoError(t, err)
+	require.Len(t, newCodes.Codes, totp.RecoveryCodesCount)
+
+	loginTOTP := func(code string) error {
+		result, err := s.Login(t.Context(), &model.LoginRequest{Login: res.Username, Password: pass})
+		require.NoError(t, err)
+		_, err = s.LoginTOTP(t.Context(), &model.LoginTOTPRequest{Token: result.MFAToken, Code: code})
+		return err
+	}
+
+	// codes shown before regeneration are replaced
+	require.ErrorIs(t, loginTOTP(oldCodes.Codes[0]), service.ErrInvalidTOTPCode)
+	require.NoError(t, loginTOTP(newCodes.Codes[0]))
+
+	// user without device manages 2fa with recovery codes
+	lastCodes, err := s.RegenerateRecoveryCodes(t.Context(), res.ID, &model.TOTPCodeRequest{Code: newCodes.Codes[1]})
+	require.NoError(t, err)
+	_, err = s.RegenerateRecoveryCodes(t.Context(), res.ID, &model.TOTPCodeRequest{Code: newCodes.Codes[2]})
+	require.ErrorIs(t, err, service.ErrInvalidTOTPCode)
+
+	require.NoError(t, s.RemoveTOTP(t.Context(), res.ID, &model.TOTPCodeRequest{Code: lastCodes.Codes[0]}))
+	require.False(t, res.TOTPEnabled)
+}
+
+// sessionStore keeps sessions of SessionRepo in memory.
+type sessionStore struct {
+	sessions map[string]*entity.Session
+}
+
+func stubSessionStore(sessionRepoM repo.SessionRepo) *sessionStore {
+	store := &sessionStore{
+		sessions: map[string]*entity.Session{},
+	}
+
+	mock.WhenSingle(sessionRepoM.Create(mock.AnyContext(), mock.Any[*entity.Session]())).
+		ThenAnswer(func(args []any) error {
+			session := args[1].(*entity.Session)
+			store.sessions[session.ID] = session
+			return nil
+		})
+	mock.WhenDouble(sessionRepoM.Get(mock.AnyContext(), mock.AnyString())).
+		ThenAnswer(func(args []any) (*entity.Session, error) {
+			return store.sessions[args[1].(string)], nil
+		})
+	mock.WhenSingle(sessionRepoM.Revoke(mock.AnyContext(), mock.AnyString())).
+		ThenAnswer(func(args []any) error {
+			now := time.Now()
+			store.sessions[args[1].(string)].RevokedAt = &now
+			return nil
+		})
+	mock.WhenDouble(sessionRepoM.GetActiveByUser(mock.AnyContext(), mock.Any[int32]())).
+		ThenAnswer(func(args []any) ([]entity.Session, error) {
+			var sessions []entity.Session
+			for _, session := range store.sessions {
+				if session.UserID == args[1].(int32) && session.RevokedAt == nil {
+					sessions = append(sessions, *session)
+				}
+			}
+			return sessions, nil
+		})
+
+	return store
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	ctrl := mock.NewMockController(t)
+	repoM := mock.Mock[repo.UserRepo](ctrl)
+	cached := newCacheUserRepo(repoM)
+	roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+	sessionRepoM := mock.Mock[repo.SessionRepo](ctrl)
+
+	s, _ := newAuthService(t, cached, roleRepoM, sessionRepoM)
+
+	pass := "pass"
+	res := entity.User{
+		ID:       1,
+		Username: "user",
+		Password: &pass,
+		Active:   true,
+	}
+
+	store := stubSessionStore(sessionRepoM)
+	mock.WhenDouble(repoM.GetByLogin(mock.AnyContext(), mock.Exact(res.Username))).ThenReturn(&res, nil)
+	mock.WhenDouble(repoM.Get(mock.AnyContext(), mock.Exact(res.ID))).ThenReturn(&res, nil)
+
+	ctx := model.ContextWithClient(t.Context(), &model.Client{
+		IP:        "127.0.0.1",
+		UserAgent: "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0",
+	})
+	result, err := s.Login(ctx, &model.LoginRequest{Login: res.Username, Password: pass})
+	require.NoError(t, err)
+	require.Len(t, store.sessions, 1)
+	var sessionID string
+	for _, session := range store.sessions {
+		sessionID = session.ID
+		require.Equal(t, "127.0.0.1", session.IP)
+		require.Equal(t, "Firefox on Linux", session.Device)
+	}
+	require.NotEmpty(t, cached.refreshFamily(t, sessionID))
+
+	_, err = s.RefreshToken(t.Context(), result.Tokens.Access)
+	require.ErrorIs(t, err, service.ErrTokenDecoding)
+
+	tokens, err := s.RefreshToken(t.Context(), result.Tokens.Refresh)
+	require.NoError(t, err)
+	require.NotEqual(t, result.Tokens.Refresh, tokens.Refresh)
+
+	// concurrent refresh within grace period doesn't revoke family
+	_, err = s.RefreshToken(t.Context(), result.Tokens.Refresh)
+	require.ErrorIs(t, err, service.ErrRefreshTokenRotated)
+	require.NotEmpty(t, cached.refreshFamily(t, sessionID))
+
+	// old refresh token is reused after grace period, family is revoked
+	cached.expireRotatedRefreshFamily(t, sessionID)
+	_, err = s.RefreshToken(t.Context(), result.Tokens.Refresh)
+	require.ErrorIs(t, err, service.ErrRefreshTokenReuse)
+	require.Empty(t, cached.refreshFamily(t, sessionID))
+	require.NotNil(t, store.sessions[sessionID].RevokedAt)
+
+	_, err = s.RefreshToken(t.Context(), tokens.Refresh)
+	require.ErrorIs(t, err, service.ErrRefreshTokenRevoked)
+}
+
+func TestRefreshTokenConcurrentRotation(t *testing.T) {
+	ctrl := mock.NewMockController(t)
+	repoM := mock.Mock[repo.UserRepo](ctrl)
+	cached := newCacheUserRepo(repoM)
+	roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+	sessionRepoM := mock.Mock[repo.SessionRepo](ctrl)
+
+	s, _ := newAuthService(t, cached, roleRepoM, sessionRepoM)
+
+	pass := "pass"
+	res := entity.User{
+		ID:       1,
+		Username: "user",
+		Password: &pass,
+		Active:   true,
+	}
+
+	store := stubSessionStore(sessionRepoM)
+	mock.WhenDouble(repoM.GetByLogin(mock.AnyContext(), mock.Exact(res.Username))).ThenReturn(&res, nil)
+	mock.WhenDouble(repoM.Get(mock.AnyContext(), mock.Exact(res.ID))).ThenReturn(&res, nil)
+
+	result, err := s.Login(t.Context(), &model.LoginRequest{Login: res.Username, Password: pass})
+	require.NoError(t, err)
+
+	// family is rotated by another request between read and swap
+	mock.WhenSingle(sessionRepoM.Touch(
+		mock.AnyContext(),
+		mock.AnyString(),
+		mock.Any[time.Time](),
+		mock.Any[time.Time](),
+	)).ThenAnswer(func(args []any) error {
+		return cached.SetRefreshFamily(args[0].(context.Context), args[1].(string), "other", time.Hour)
+	})
+
+	_, err = s.RefreshToken(t.Context(), result.Tokens.Refresh)
+	require.ErrorIs(t, err, service.ErrRefreshTokenRotated)
+	for sessionID, session := range store.sessions {
+		require.Equal(t, "other", cached.refreshFamily(t, sessionID))
+		require.Nil(t, session.RevokedAt)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	ctrl := mock.NewMockController(t)
+	repoM := mock.Mock[repo.UserRepo](ctrl)
+	cached := newCacheUserRepo(repoM)
+	roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+	sessionRepoM := mock.Mock[repo.SessionRepo](ctrl)
+
+	s, _ := newAuthService(t, cached, roleRepoM, sessionRepoM)
+
+	pass := "pass"
+	res := entity.User{
+		ID:       1,
+		Username: "user",
+		Password: &pass,
+		Active:   true,
+	}
+
+	store := stubSessionStore(sessionRepoM)
+	mock.WhenDouble(repoM.GetByLogin(mock.AnyContext(), mock.Exact(res.Username))).ThenReturn(&res, nil)
+	mock.WhenDouble(repoM.Get(mock.AnyContext(), mock.Exact(res.ID))).ThenReturn(&res, nil)
+
+	result, err := s.Login(t.Context(), &model.LoginRequest{Login: res.Username, Password: pass})
+	require.NoError(t, err)
+
+	_, err = s.Token(t.Context(), result.Tokens.Access)
+	require.NoError(t, err)
+
+	require.NoError(t, s.Logout(t.Context(), result.Tokens.Refresh))
+	for sessionID := range store.sessions {
+		require.True(t, cached.sessionDenied(t, sessionID))
+	}
+
+	_, err = s.Token(t.Context(), result.Tokens.Access)
+	require.ErrorIs(t, err, service.ErrSessionRevoked)
+
+	_, err = s.RefreshToken(t.Context(), result.Tokens.Refresh)
+	require.ErrorIs(t, err, service.ErrRefreshTokenRevoked)
+
+	// invalid token is ignored
+	require.NoError(t, s.Logout(t.Context(), "invalid"))
+}
+
+func TestLogoutAccessToken(t *testing.T) {
+	ctrl := mock.NewMockController(t)
+	repoM := mock.Mock[repo.UserRepo](ctrl)
+	cached := newCacheUserRepo(repoM)
+	roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+	sessionRepoM := mock.Mock[repo.SessionRepo](ctrl)
+
+	s, _ := newAuthService(t, cached, roleRepoM, sessionRepoM)
+
+	pass := "pass"
+	res := entity.User{
+		ID:       1,
+		Username: "user",
+		Password: &pass,
+		Active:   true,
+	}
+
+	store := stubSessionStore(sessionRepoM)
+	mock.WhenDouble(repoM.GetByLogin(mock.AnyContext(), mock.Exact(res.Username))).ThenReturn(&res, nil)
+	mock.WhenDouble(repoM.Get(mock.AnyContext(), mock.Exact(res.ID))).ThenReturn(&res, nil)
+
+	result, err := s.Login(t.Context(), &model.LoginRequest{Login: res.Username, Password: pass})
+	require.NoError(t, err)
+
+	// bearer clients may send access token to logout
+	require.NoError(t, s.Logout(t.Context(), result.Tokens.Access))
+	for sessionID, session := range store.sessions {
+		require.True(t, cached.sessionDenied(t, sessionID))
+		require.Empty(t, cached.refreshFamily(t, sessionID))
+		require.NotNil(t, session.RevokedAt)
+	}
+
+	_, err = s.Token(t.Context(), result.Tokens.Access)
+	require.ErrorIs(t, err, service.ErrSessionRevoked)
+
+	_, err = s.RefreshToken(t.Context(), result.Tokens.Refresh)
+	require.ErrorIs(t, err, service.ErrRefreshTokenRevoked)
+
+	// already revoked session is ignored
+	require.NoError(t, s.Logout(t.Context(), result.Tokens.Access))
+}
+
+func TestSessions(t *testing.T) {
+	ctrl := mock.NewMockController(t)
+	repoM := mock.Mock[repo.UserRepo](ctrl)
+	cached := newCacheUserRepo(repoM)
+	roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+	sessionRepoM := mock.Mock[repo.SessionRepo](ctrl)
+
+	s, _ := newAuthService(t, cached, roleRepoM, sessionRepoM)
+
+	pass := "pass"
+	res := entity.User{ID: 1, Username: "user", Password: &pass, Active: true}
+	other := entity.User{ID: 2, Username: "other", Password: &pass, Active: true}
+
+	stubSessionStore(sessionRepoM)
+	for _, user := range []*entity.User{&res, &other} {
+		mock.WhenDouble(repoM.GetByLogin(mock.AnyContext(), mock.Exact(user.Username))).ThenReturn(user, nil)
+		mock.WhenDouble(repoM.Get(mock.AnyContext(), mock.Exact(user.ID))).ThenReturn(user, nil)
+	}
+
+	login := func(user *entity.User) (string, string) {
+		result, err := s.Login(t.Context(), &model.LoginRequest{Login: user.Username, Password: pass})
+		require.NoError(t, err)
+		payload, err := s.Token(t.Context(), result.Tokens.Access)
+		require.NoError(t, err)
+		return result.Tokens.Access, payload.SessionID
+	}
+	access, sessionID := login(&res)
+	currentAccess, currentSessionID := login(&res)
+	_, otherSessionID := login(&other)
+
+	sessions, err := s.GetSessions(t.Context(), res.ID, currentSessionID)
+	require.NoError(t, err)
+	require.Len(t, sessions, 2)
+	for _, session := range sessions {
+		require.Equal(t, session.ID == currentSessionID, session.Current)
+	}
+
+	// sessions of other users look like missing ones
+	for _, id := range []string{otherSessionID, "unknown"} {
+		require.ErrorIs(t, s.RevokeSession(t.Context(), res.ID, id), service.ErrSessionNotFound)
+	}
+	sessions, err = s.GetSessions(t.Context(), other.ID, "")
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+
+	require.NoError(t, s.RevokeSession(t.Context(), res.ID, sessionID))
+	require.ErrorIs(t, s.RevokeSession(t.Context(), res.ID, sessionID), service.ErrSessionNotFound)
+
+	_, err = s.Token(t.Context(), access)
+	require.ErrorIs(t, err, service.ErrSessionRevoked)
+	_, err = s.Token(t.Context(), currentAccess)
+	require.NoError(t, err)
+
+	sessions, err = s.GetSessions(t.Context(), res.ID, currentSessionID)
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	require.True(t, sessions[0].Current)
+}
+
+func TestLogoutAll(t *testing.T) {
+	ctrl := mock.NewMockController(t)
+	repoM := mock.Mock[repo.UserRepo](ctrl)
+	cached := newCacheUserRepo(repoM)
+	roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+	sessionRepoM := mock.Mock[repo.SessionRepo](ctrl)
+
+	s, _ := newAuthService(t, cached, roleRepoM, sessionRepoM)
+
+	pass := "pass"
+	res := entity.User{ID: 1, Username: "user", Password: &pass, Active: true}
+	store := stubSessionStore(sessionRepoM)
+	mock.WhenDouble(repoM.GetByLogin(mock.AnyContext(), mock.Exact(res.Username))).ThenReturn(&res, nil)
+	mock.WhenDouble(repoM.Get(mock.AnyContext(), mock.Exact(res.ID))).ThenReturn(&res, nil)
+
+	login := func() *service.Tokens {
+		result, err := s.Login(t.Context(), &model.LoginRequest{Login: res.Username, Password: pass})
+		require.NoError(t, err)
+		return result.Tokens
+	}
+	devices := []*service.Tokens{login(), login()}
+
+	require.NoError(t, s.LogoutAll(t.Context(), res.ID))
+	for _, tokens := range devices {
+		_, err := s.Token(t.Context(), tokens.Access)
+		require.ErrorIs(t, err, service.ErrSessionRevoked)
+		_, err = s.RefreshToken(t.Context(), tokens.Refresh)
+		require.ErrorIs(t, err, service.ErrRefreshTokenRevoked)
+	}
+	for _, session := range store.sessions {
+		require.NotNil(t, session.RevokedAt)
+	}
+
+	// login in the same second as logout works
+	tokens := login()
+	_, err := s.Token(t.Context(), tokens.Access)
+	require.NoError(t, err)
+	_, err = s.RefreshToken(t.Context(), tokens.Refresh)
+	require.NoError(t, err)
+}
+
+func TestLoginLockout(t *testing.T) {
+	ctrl := mock.NewMockController(t)
+	repoM := mock.Mock[repo.UserRepo](ctrl)
+	cached := newCacheUserRepo(repoM)
+	roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+	sessionRepoM := mock.Mock[repo.SessionRepo](ctrl)
+
+	s, _ := newAuthService(t, cached, roleRepoM, sessionRepoM)
+
+	pass := "pass"
+	res := entity.User{
+		ID:       1,
+		Email:    "user@example.com",
+		Username: "user",
+		Password: &pass,
+		Active:   true,
+	}
+
+	mock.WhenDouble(repoM.GetByLogin(mock.AnyContext(), mock.AnyString())).ThenReturn(&res, nil)
+	mock.WhenDouble(repoM.Get(mock.AnyContext(), mock.Exact(res.ID))).ThenReturn(&res, nil)
+
+	// email and username of one user share failures
+	for _, login := range []string{res.Email, res.Username} {
+		_, err := s.Login(t.Context(), &model.LoginRequest{Login: login, Password: "wrong"})
+		require.ErrorIs(t, err, service.ErrPasswordVerification)
+	}
+	require.Equal(t, int64(2), cached.loginFailures(t, "user:1"))
+	cached.requireLoginLock(t, "user:1", 0)
+
+	// lockout doubles with every failure after it expires
+	wrong := &model.LoginRequest{Login: res.Email, Password: "wrong"}
+	for _, lockout := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute} {
+		cached.expireLoginLock(t, "user:1")
+		_, err := s.Login(t.Context(), wrong)
+		require.ErrorIs(t, err, service.ErrPasswordVerification)
+		cached.requireLoginLock(t, "user:1", lockout)
+	}
+
+	// locked user is rejected even with valid password
+	_, err := s.Login(t.Context(), &model.LoginRequest{Login: res.Username, Password: pass})
+	var rateLimitError *service.RateLimitError
+	require.ErrorAs(t, err, &rateLimitError)
+	require.InDelta(t, 4*time.Minute, rateLimitError.RetryAfter, float64(time.Second))
+
+	// successful login after lockout expired clears failures
+	cached.expireLoginLock(t, "user:1")
+	_, err = s.Login(t.Context(), &model.LoginRequest{Login: res.Username, Password: pass})
+	require.NoError(t, err)
+	require.Zero(t, cached.loginFailures(t, "user:1"))
+	cached.requireLoginLock(t, "user:1", 0)
+}
+
+func TestLoginLockoutUnknownLogin(t *testing.T) {
+	ctrl := mock.NewMockController(t)
+	repoM := mock.Mock[repo.UserRepo](ctrl)
+	cached := newCacheUserRepo(repoM)
+	roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+	sessionRepoM := mock.Mock[repo.SessionRepo](ctrl)
+
+	s, _ := newAuthService(t, cached, roleRepoM, sessionRepoM)
+
+	mock.WhenDouble(repoM.GetByLogin(mock.AnyContext(), mock.AnyString())).ThenReturn(nil, nil)
+
+	for range 3 {
+		_, err := s.Login(t.Context(), &model.LoginRequest{Login: "Unknown", Password: "wrong"})
+		require.ErrorIs(t, err, service.ErrUserNotFound)
+	}
+	cached.requireLoginLock(t, "login:unknown", time.Minute)
+
+	_, err := s.Login(t.Context(), &model.LoginRequest{Login: "unknown", Password: "wrong"})
+	var rateLimitError *service.RateLimitError
+	require.ErrorAs(t, err, &rateLimitError)
+}
+
+func TestLoginLockoutNotClearedBeforeTOTP(t *testing.T) {
+	ctrl := mock.NewMockController(t)
+	repoM := mock.Mock[repo.UserRepo](ctrl)
+	cached := newCacheUserRepo(repoM)
+	roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+	sessionRepoM := mock.Mock[repo.SessionRepo](ctrl)
+
+	s, _ := newAuthService(t, cached, roleRepoM, sessionRepoM)
+
+	pass := "pass"
+	res := entity.User{
+		ID:          1,
+		Username:    "user",
+		Password:    &pass,
+		Active:      true,
+		TOTPEnabled: true,
+	}
+
+	mock.WhenDouble(repoM.GetByLogin(mock.AnyContext(), mock.AnyString())).ThenReturn(&res, nil)
+
+	_, err := s.Login(t.Context(), &model.LoginRequest{Login: res.Username, Password: "wrong"})
+	require.ErrorIs(t, err, service.ErrPasswordVerification)
+
+	// password is valid, but login is not finished until 2fa
+	result, err := s.Login(t.Context(), &model.LoginRequest{Login: res.Username, Password: pass})
+	require.NoError(t, err)
+	require.NotEmpty(t, result.MFAToken)
+	require.Equal(t, int64(1), cached.loginFailures(t, "user:1"))
+}
+
+func TestLoginRateLimit(t *testing.T) {
+	ctrl := mock.NewMockController(t)
+	repoM := mock.Mock[repo.UserRepo](ctrl)
+	cached := newCacheUserRepo(repoM)
+	roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+	sessionRepoM := mock.Mock[repo.SessionRepo](ctrl)
+
+	s, _ := newAuthService(t, cached, roleRepoM, sessionRepoM)
+
+	pass := "pass"
+	res := entity.User{ID: 1, Username: "user", Password: &pass, Active: true}
+	stubSessionStore(sessionRepoM)
+	mock.WhenDouble(repoM.GetByLogin(mock.AnyContext(), mock.AnyString())).ThenReturn(&res, nil)
+
+	login := func(ip, login string) error {
+		ctx := model.ContextWithClient(t.Context(), &model.Client{IP: ip})
+		_, err := s.Login(ctx, &model.LoginRequest{Login: login, Password: pass})
+		return err
+	}
+
+	// case variants of login share one limit, even from different ips
+	for i := range 10 {
+		require.NoError(t, login(fmt.Sprintf("10.0.0.%d", i), []string{"User", "user"}[i%2]))
+	}
+	var rateLimitError *service.RateLimitError
+	require.ErrorAs(t, login("10.0.1.1", "USER"), &rateLimitError)
+	require.Positive(t, rateLimitError.RetryAfter)
+
+	// one ip is limited across logins
+	for i := range 10 {
+		require.NoError(t, login("127.0.0.1", fmt.Sprintf("user%d", i)))
+	}
+	require.ErrorAs(t, login("127.0.0.1", "other"), &rateLimitError)
+	require.NoError(t, login("127.0.0.2", "other"))
+}
+
+func TestRequestEmailVerification(t *testing.T) {
+	ctrl := mock.NewMockController(t)
+	repoM := mock.Mock[repo.UserRepo](ctrl)
+	roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+	sessionRepoM := mock.Mock[repo.SessionRepo](ctrl)
+
+	s, _ := newAuthService(t, repoM, roleRepoM, sessionRepoM)
+
+	notVerified := entity.User{ID: 1, Username: "user", Email: "user@example.com", Active: true}
+	verified := entity.User{ID: 2, Username: "verified", Email: "verified@example.com", Active: true, Verified: true}
+	mock.WhenDouble(repoM.Get(mock.AnyContext(), mock.Exact(notVerified.ID))).ThenReturn(&notVerified, nil)
+	mock.WhenDouble(repoM.Get(mock.AnyContext(), mock.Exact(verified.ID))).ThenReturn(&verified, nil)
+
+	cooldowns := map[string]bool{}
+	mock.WhenDouble(repoM.StartCooldown(
+		mock.AnyContext(),
+		mock.AnyString(),
+		mock.Any[int32](),
+		mock.Any[time.Duration](),
+	)).ThenAnswer(func(args []any) (time.Duration, error) {
+		key := fmt.Sprintf("%s:%d", args[1], args[2])
+		if cooldowns[key] {
+			return 30 * time.Second, nil
+		}
+		cooldowns[key] = true
+		return 0, nil
+	})
+
+	require.ErrorIs(t, s.RequestEmailVerification(t.Context(), verified.ID), service.ErrEmailAlreadyVerified)
+	require.Empty(t, cooldowns)
+
+	require.NoError(t, s.RequestEmailVerification(t.Context(), notVerified.ID))
+
+	err := s.RequestEmailVerification(t.Context(), notVerified.ID)
+	var rateLimitError *service.RateLimitError
+	require.ErrorAs(t, err, &rateLimitError)
+	require.Equal(t, 30*time.Second, rateLimitError.RetryAfter)
+}
+
+func TestVerifyEmail(t *testing.T) {
+	ctrl := mock.NewMockController(t)
+	repoM := mock.Mock[repo.UserRepo](ctrl)
+	roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+	sessionRepoM := mock.Mock[repo.SessionRepo](ctrl)
+
+	s, _ := newAuthService(t, repoM, roleRepoM, sessionRepoM)
+
+	res := entity.User{ID: 1, Username: "user", Email: "user@example.com", Active: true}
+	mock.WhenDouble(repoM.Get(mock.AnyContext(), mock.Exact(res.ID))).ThenReturn(&res, nil)
+	mock.WhenSingle(repoM.UpdateVerified(mock.AnyContext(), mock.Exact(res.ID), mock.Exact(true))).
+		ThenAnswer(func(args []any) error {
+			res.Verified = true
+			return nil
+		})
+
+	sign := func(purpose, value string, expiration time.Duration) *model.TokenRequest {
+		return &model.TokenRequest{
+			Token: signer.NewHMACSigner([]byte("secret")).Sign(purpose, value, expiration),
+		}
+	}
+
+	for _, request := range []*model.TokenRequest{
+		sign("verify_email", "1:user@example.com", -time.Minute),
+		{Token: sign("verify_email", "1:user@example.com", time.Hour).Token + "x"},
+		sign("reset_password", "1:user@example.com", time.Hour),
+		// email was changed after link was sent
+		sign("verify_email", "1:old@example.com", time.Hour),
+	} {
+		require.ErrorIs(t, s.VerifyEmail(t.Context(), request), service.ErrInvalidLinkToken)
+	}
+	require.False(t, res.Verified)
+
+	request := sign("verify_email", "1:user@example.com", time.Hour)
+	require.NoError(t, s.VerifyEmail(t.Context(), request))
+	require.True(t, res.Verified)
+
+	// replayed link changes nothing
+	require.NoError(t, s.VerifyEmail(t.Context(), request))
+	mock.Verify(repoM, mock.Once()).UpdateVerified(mock.AnyContext(), mock.Any[int32](), mock.Any[bool]())
+}
+
+func TestVerifyOldEmail(t *testing.T) {
+	ctrl := mock.NewMockController(t)
+	repoM := mock.Mock[repo.UserRepo](ctrl)
+	roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+	sessionRepoM := mock.Mock[repo.SessionRepo](ctrl)
+
+	s, _ := newAuthService(t, repoM, roleRepoM, sessionRepoM)
+
+	res := entity.User{
+		ID:       1,
+		Username: "user",
+		Email:    "old@example.com",
+		Active:   true,
+	}
+
+	var change *entity.EmailChange
+	mock.WhenDouble(repoM.Get(mock.AnyContext(), mock.Exact(res.ID))).ThenReturn(&res, nil)
+	mock.WhenDouble(repoM.GetEmailChange(mock.AnyContext(), mock.Exact(res.ID))).
+		ThenAnswer(func(args []any) (*entity.EmailChange, error) {
+			return change, nil
+		})
+	mock.WhenSingle(repoM.SetEmailChange(
+		mock.AnyContext(),
+		mock.Exact(res.ID),
+		mock.Any[*entity.EmailChange](),
+		mock.Any[time.Duration](),
+	)).ThenAnswer(func(args []any) error {
+		change = args[2].(*entity.EmailChange)
+		return nil
+	})
+
+	change = &entity.EmailChange{NewEmail: "new@example.com", Nonce: "nonce"}
+	request := &model.TokenRequest{
+		Token: signer.NewHMACSigner([]byte("secret")).Sign("verify_old_email", "1:nonce", time.Hour),
+	}
+
+	require.NoError(t, s.VerifyOldEmail(t.Context(), request))
+	require.True(t, change.OldConfirmed)
+
+	// replayed link doesn't send another email to new address
+	require.ErrorIs(t, s.VerifyOldEmail(t.Context(), request), service.ErrOldEmailConfirmed)
+}
+
+func TestForgotPassword(t *testing.T) {
+	ctrl := mock.NewMockController(t)
+	repoM := mock.Mock[repo.UserRepo](ctrl)
+	roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+	sessionRepoM := mock.Mock[repo.SessionRepo](ctrl)
+
+	s, _ := newAuthService(t, repoM, roleRepoM, sessionRepoM)
+
+	res := entity.User{ID: 1, Username: "user", Email: "user@example.com", Active: true}
+	mock.WhenDouble(repoM.GetByEmail(mock.AnyContext(), mock.Exact(res.Email))).ThenReturn(&res, nil)
+	mock.WhenDouble(repoM.GetByEmail(mock.AnyContext(), mock.Exact("unknown@example.com"))).ThenReturn(nil, nil)
+
+	// unknown email looks the same as known one
+	err := s.ForgotPassword(t.Context(), &model.ForgotPasswordRequest{Email: "unknown@example.com"})
+	require.NoError(t, err)
+	mock.Verify(repoM, mock.Never()).SetPasswordResetNonce(
+		mock.AnyContext(),
+		mock.Any[int32](),
+		mock.AnyString(),
+		mock.Any[time.Duration](),
+	)
+
+	err = s.ForgotPassword(t.Context(), &model.ForgotPasswordRequest{Email: " user@example.com "})
+	require.NoError(t, err)
+	mock.Verify(repoM, mock.Once()).SetPasswordResetNonce(
+		mock.AnyContext(),
+		mock.Exact(res.ID),
+		mock.AnyString(),
+		mock.Any[time.Duration](),
+	)
+
+	err = s.ForgotPassword(t.Context(), &model.ForgotPasswordRequest{Email: res.Email, Captcha: "invalid"})
+	require.ErrorIs(t, err, service.ErrInvalidCaptcha)
+}
+
+func TestResetPassword(t *testing.T) {
+	ctrl := mock.NewMockController(t)
+	repoM := mock.Mock[repo.UserRepo](ctrl)
+	cached := newCacheUserRepo(repoM)
+	roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+	sessionRepoM := mock.Mock[repo.SessionRepo](ctrl)
+
+	s, _ := newAuthService(t, cached, roleRepoM, sessionRepoM)
+
+	pass := "oldpass"
+	res := entity.User{ID: 1, Username: "user", Password: &pass, Active: true}
+
+	store := stubSessionStore(sessionRepoM)
+	mock.WhenDouble(repoM.GetByLogin(mock.AnyContext(), mock.Exact(res.Username))).ThenReturn(&res, nil)
+	mock.WhenDouble(repoM.Get(mock.AnyContext(), mock.Exact(res.ID))).ThenReturn(&res, nil)
+
+	require.NoError(t, cached.SetPasswordResetNonce(t.Context(), res.ID, "nonce", time.Hour))
+
+	result, err := s.Login(t.Context(), &model.LoginRequest{Login: res.Username, Password: pass})
+	require.NoError(t, err)
+
+	sign := func(value string, expiration time.Duration) *model.ResetPasswordRequest {
+		return &model.ResetPasswordRequest{
+			Token:     signer.NewHMACSigner([]byte("secret")).Sign("reset_password", value, expiration),
+			Password1: "secret",
+			Password2: "secret",
+		}
+	}
+
+	for _, request := range []*model.ResetPasswordRequest{
+		sign("1:nonce", -time.Minute),
+		{Token: sign("1:nonce", time.Hour).Token + "x", Password1: "secret", Password2: "secret"},
+		sign("1:other", time.Hour),
+	} {
+		require.ErrorIs(t, s.ResetPassword(t.Context(), request), service.ErrInvalidLinkToken)
+	}
+	mock.Verify(repoM, mock.Never()).UpdatePassword(mock.AnyContext(), mock.Any[int32](), mock.Any[*string]())
+
+	request := sign("1:nonce", time.Hour)
+	require.NoError(t, s.ResetPassword(t.Context(), request))
+	mock.Verify(repoM, mock.Once()).UpdatePassword(mock.AnyContext(), mock.Exact(res.ID), mock.Any[*string]())
+
+	// tokens issued with old password stop working
+	for sessionID, session := range store.sessions {
+		require.Empty(t, cached.refreshFamily(t, sessionID))
+		require.NotNil(t, session.RevokedAt)
+	}
+	_, err = s.Token(t.Context(), result.Tokens.Access)
+	require.ErrorIs(t, err, service.ErrSessionRevoked)
+
+	// link is single use
+	require.ErrorIs(t, s.ResetPassword(t.Context(), request), service.ErrInvalidLinkToken)
+}
+
+func TestChangePassword(t *testing.T) {
+	ctrl := mock.NewMockController(t)
+	repoM := mock.Mock[repo.UserRepo](ctrl)
+	roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+	sessionRepoM := mock.Mock[repo.SessionRepo](ctrl)
+
+	s, _ := newAuthService(t, repoM, roleRepoM, sessionRepoM)
+
+	pass := "oldpass"
+	withPassword := entity.User{ID: 1, Username: "user", Password: &pass, Active: true}
+	withoutPassword := entity.User{ID: 2, Username: "oauth", Active: true}
+	mock.WhenDouble(repoM.Get(mock.AnyContext(), mock.Exact(withPassword.ID))).ThenReturn(&withPassword, nil)
+	mock.WhenDouble(repoM.Get(mock.AnyContext(), mock.Exact(withoutPassword.ID))).ThenReturn(&withoutPassword, nil)
+
+	request := &model.ChangePasswordRequest{OldPassword: "wrong", Password1: "secret", Password2: "secret"}
+	err := s.ChangePassword(t.Context(), withPassword.ID, request)
+	require.ErrorIs(t, err, service.ErrInvalidOldPassword)
+
+	// oauth users must set password first
+	request.OldPassword = ""
+	err = s.ChangePassword(t.Context(), withoutPassword.ID, request)
+	require.ErrorIs(t, err, service.ErrUserPasswordNotSet)
+
+	mock.Verify(repoM, mock.Never()).UpdatePassword(mock.AnyContext(), mock.Any[int32](), mock.Any[*string]())
+
+	request.OldPassword = pass
+	require.NoError(t, s.ChangePassword(t.Context(), withPassword.ID, request))
+	mock.Verify(repoM, mock.Once()).UpdatePassword(mock.AnyContext(), mock.Exact(withPassword.ID), mock.Any[*string]())
+}
+
+func TestChangePasswordLockout(t *testing.T) {
+	ctrl := mock.NewMockController(t)
+	repoM := mock.Mock[repo.UserRepo](ctrl)
+	cached := newCacheUserRepo(repoM)
+	roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+	sessionRepoM := mock.Mock[repo.SessionRepo](ctrl)
+
+	s, _ := newAuthService(t, cached, roleRepoM, sessionRepoM)
+
+	pass := "oldpass"
+	res := entity.User{ID: 1, Username: "user", Password: &pass, Active: true}
+
+	mock.WhenDouble(repoM.Get(mock.AnyContext(), mock.Exact(res.ID))).ThenReturn(&res, nil)
+
+	request := &model.ChangePasswordRequest{OldPassword: "wrong", Password1: "secret", Password2: "secret"}
+	for range 3 {
+		err := s.ChangePassword(t.Context(), res.ID, request)
+		require.ErrorIs(t, err, service.ErrInvalidOldPassword)
+	}
+	cached.requireLoginLock(t, "user:1", time.Minute)
+
+	// locked user is rejected even with valid old password
+	request.OldPassword = pass
+	err := s.ChangePassword(t.Context(), res.ID, request)
+	var rateLimitError *service.RateLimitError
+	require.ErrorAs(t, err, &rateLimitError)
+	mock.Verify(repoM, mock.Never()).UpdatePassword(mock.AnyContext(), mock.Any[int32](), mock.Any[*string]())
+}
+
+func TestSetPassword(t *testing.T) {
+	ctrl := mock.NewMockController(t)
+	repoM := mock.Mock[repo.UserRepo](ctrl)
+	roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+	sessionRepoM := mock.Mock[repo.SessionRepo](ctrl)
+
+	s, _ := newAuthService(t, repoM, roleRepoM, sessionRepoM)
+
+	pass := "oldpass"
+	withPassword := entity.User{ID: 1, Username: "user", Password: &pass, Active: true}
+	withoutPassword := entity.User{ID: 2, Username: "oauth", Active: true}
+	mock.WhenDouble(repoM.Get(mock.AnyContext(), mock.Exact(withPassword.ID))).ThenReturn(&withPassword, nil)
+	mock.WhenDouble(repoM.Get(mock.AnyContext(), mock.Exact(withoutPassword.ID))).ThenReturn(&withoutPassword, nil)
+
+	// existing password can be changed only with old one
+	request := &model.SetPasswordRequest{Password1: "secret", Password2: "secret"}
+	err := s.SetPassword(t.Context(), withPassword.ID, request)
+	require.ErrorIs(t, err, service.ErrUserPasswordAlreadySet)
+	mock.Verify(repoM, mock.Never()).SetPassword(mock.AnyContext(), mock.Any[int32](), mock.AnyString())
+
+	// password is set only if it is still empty in db
+	set := false
+	mock.WhenDouble(repoM.SetPassword(mock.AnyContext(), mock.Exact(withoutPassword.ID), mock.Exact("secret"))).
+		ThenAnswer(func(args []any) (bool, error) {
+			if set {
+				return false, nil
+			}
+			set = true
+			return true, nil
+		})
+	require.NoError(t, s.SetPassword(t.Context(), withoutPassword.ID, request))
+
+	// concurrent request that passed the check before the first one set password
+	err = s.SetPassword(t.Context(), withoutPassword.ID, request)
+	require.ErrorIs(t, err, service.ErrUserPasswordAlreadySet)
+	mock.Verify(repoM, mock.Times(2)).SetPassword(mock.AnyContext(), mock.Exact(withoutPassword.ID), mock.Exact("secret"))
+	mock.Verify(repoM, mock.Never()).UpdatePassword(mock.AnyContext(), mock.Any[int32](), mock.Any[*string]())
+}
+
+func TestEmailChange(t *testing.T) {
+	ctrl := mock.NewMockController(t)
+	repoM := mock.Mock[repo.UserRepo](ctrl)
+	roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+	sessionRepoM := mock.Mock[repo.SessionRepo](ctrl)
+
+	s, _ := newAuthService(t, repoM, roleRepoM, sessionRepoM)
+
+	res := entity.User{ID: 1, Username: "user", Email: "old@example.com", Active: true}
+	users := map[string]*entity.User{
+		res.Email:           &res,
+		"taken@example.com": {ID: 2, Username: "taken", Email: "taken@example.com"},
+	}
+
+	var change *entity.EmailChange
+	mock.WhenDouble(repoM.Get(mock.AnyContext(), mock.Exact(res.ID))).ThenReturn(&res, nil)
+	mock.WhenDouble(repoM.GetByEmail(mock.AnyContext(), mock.AnyString())).
+		ThenAnswer(func(args []any) (*entity.User, error) {
+			return users[args[1].(string)], nil
+		})
+	mock.WhenDouble(repoM.GetEmailChange(mock.AnyContext(), mock.Exact(res.ID))).
+		ThenAnswer(func(args []any) (*entity.EmailChange, error) {
+			return change, nil
+		})
+	mock.WhenSingle(repoM.SetEmailChange(
+		mock.AnyContext(),
+		mock.Exact(res.ID),
+		mock.Any[*entity.EmailChange](),
+		mock.Any[time.Duration](),
+	)).ThenAnswer(func(args []any) error {
+		change = args[2].(*entity.EmailChange)
+		return nil
+	})
+	mock.WhenSingle(repoM.DeleteEmailChange(mock.AnyContext(), mock.Exact(res.ID))).
+		ThenAnswer(func(args []any) error {
+			change = nil
+			return nil
+		})
+	var taken bool
+	mock.WhenSingle(repoM.UpdateEmail(mock.AnyContext(), mock.Exact(res.ID), mock.AnyString())).
+		ThenAnswer(func(args []any) error {
+			if taken {
+				return fmt.Errorf("%w: auth_user_email_key", repo.ErrUniqueViolation)
+			}
+			res.Email = args[2].(string)
+			return nil
+		})
+
+	sign := func(purpose string) *model.TokenRequest {
+		return &model.TokenRequest{
+			Token: signer.NewHMACSigner([]byte("secret")).Sign(purpose, "1:"+change.Nonce, time.Hour),
+		}
+	}
+
+	err := s.RequestEmailChange(t.Context(), res.ID, &model.EmailChangeRequest{Email: res.Email})
+	require.ErrorIs(t, err, service.ErrEmailChangeSameAddress)
+	err = s.RequestEmailChange(t.Context(), res.ID, &model.EmailChangeRequest{Email: "taken@example.com"})
+	require.ErrorIs(t, err, service.ErrUserAlreadyExistsEmail)
+	require.Nil(t, change)
+
+	err = s.VerifyNewEmail(t.Context(), &model.TokenRequest{
+		Token: signer.NewHMACSigner([]byte("secret")).Sign("verify_new_email", "1:nonce", time.Hour),
+	})
+	require.ErrorIs(t, err, service.ErrEmailChangeNotFound)
+
+	// link of previous request stops working
+	require.NoError(t, s.RequestEmailChange(t.Context(), res.ID, &model.EmailChangeRequest{Email: "first@example.com"}))
+	previous := sign("verify_old_email")
+	require.NoError(t, s.RequestEmailChange(t.Context(), res.ID, &model.EmailChangeRequest{Email: "new@example.com"}))
+	require.ErrorIs(t, s.VerifyOldEmail(t.Context(), previous), service.ErrInvalidLinkToken)
+
+	// new email is confirmed only after old one
+	require.ErrorIs(t, s.VerifyNewEmail(t.Context(), sign("verify_new_email")), service.ErrOldEmailNotConfirmed)
+	require.ErrorIs(t, s.VerifyNewEmail(t.Context(), sign("verify_old_email")), service.ErrInvalidLinkToken)
+	require.NoError(t, s.VerifyOldEmail(t.Context(), sign("verify_old_email")))
+
+	// new email was taken while change was pending
+	verifyNew := sign("verify_new_email")
+	users["new@example.com"] = &entity.User{ID: 3, Username: "other", Email: "new@example.com"}
+	require.ErrorIs(t, s.VerifyNewEmail(t.Context(), verifyNew), service.ErrUserAlreadyExistsEmail)
+	require.Equal(t, "old@example.com", res.Email)
+
+	// new email was taken by concurrent registration right after the check
+	delete(users, "new@example.com")
+	taken = true
+	require.ErrorIs(t, s.VerifyNewEmail(t.Context(), verifyNew), service.ErrUserAlreadyExistsEmail)
+	require.Equal(t, "old@example.com", res.Email)
+
+	taken = false
+	require.NoError(t, s.VerifyNewEmail(t.Context(), verifyNew))
+	require.Equal(t, "new@example.com", res.Email)
+	require.Nil(t, change)
+
+	// links are single use
+	require.ErrorIs(t, s.VerifyNewEmail(t.Context(), verifyNew), service.ErrEmailChangeNotFound)
+	require.ErrorIs(t, s.VerifyOldEmail(t.Context(), previous), service.ErrEmailChangeNotFound)
 }
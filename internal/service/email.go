@@ -0,0 +1,324 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pegov/fauth-backend-go/internal/email"
+	"github.com/pegov/fauth-backend-go/internal/entity"
+	"github.com/pegov/fauth-backend-go/internal/model"
+	"github.com/pegov/fauth-backend-go/internal/repo"
+)
+
+var (
+	ErrEmailAlreadyVerified   = errors.New("email already verified")
+	ErrInvalidLinkToken       = errors.New("invalid or expired link")
+	ErrEmailChangeNotFound    = errors.New("email change was not requested or expired")
+	ErrOldEmailNotConfirmed   = errors.New("old email is not confirmed")
+	ErrOldEmailConfirmed      = errors.New("old email is already confirmed")
+	ErrEmailChangeSameAddress = errors.New("new email is the same as current")
+)
+
+const (
+	verifyEmailPurpose    = "verify_email"
+	verifyEmailExpiration = 24 * time.Hour
+	emailCooldown         = time.Minute
+
+	emailChangePurpose    = "email_change"
+	verifyOldEmailPurpose = "verify_old_email"
+	verifyNewEmailPurpose = "verify_new_email"
+	emailChangeExpiration = time.Hour
+)
+
+func randomToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func (s *authService) sendEmail(to, subject, body string) error {
+	message := email.NewMessage(s.cfg.SMTP.From, to, subject, body)
+	if err := s.emailClient.SendEmail(s.cfg.SMTP.From, to, message); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+
+	return nil
+}
+
+func (s *authService) makeLink(path, signed string) string {
+	return strings.TrimRight(s.cfg.App.FrontendURL, "/") +
+		path + "?token=" + url.QueryEscape(signed)
+}
+
+func (s *authService) startCooldown(ctx context.Context, action string, id int32) error {
+	remaining, err := s.userRepo.StartCooldown(ctx, action, id, emailCooldown)
+	if err != nil {
+		return fmt.Errorf("failed to start cooldown: %w", err)
+	}
+
+	if remaining > 0 {
+		return &RateLimitError{RetryAfter: remaining}
+	}
+
+	return nil
+}
+
+// parseSignedID splits "<id>:<rest>" value of signed token.
+func parseSignedID(value string) (int32, string, error) {
+	idStr, rest, ok := strings.Cut(value, ":")
+	if !ok {
+		return 0, "", ErrInvalidLinkToken
+	}
+
+	id, err := strconv.ParseInt(idStr, 10, 32)
+	if err != nil {
+		return 0, "", ErrInvalidLinkToken
+	}
+
+	return int32(id), rest, nil
+}
+
+func (s *authService) RequestEmailVerification(ctx context.Context, id int32) error {
+	user, err := s.getUser(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if user.Verified {
+		return ErrEmailAlreadyVerified
+	}
+
+	if err := s.startCooldown(ctx, verifyEmailPurpose, id); err != nil {
+		return err
+	}
+
+	signed := s.signer.Sign(
+		verifyEmailPurpose,
+		fmt.Sprintf("%d:%s", user.ID, user.Email),
+		verifyEmailExpiration,
+	)
+
+	return s.sendEmail(
+		user.Email,
+		"Email verification",
+		fmt.Sprintf(
+			"Hello, %s!\r\n\r\nFollow the link to verify your email:\r\n%s\r\n",
+			user.Username,
+			s.makeLink("/verify-email", signed),
+		),
+	)
+}
+
+func (s *authService) VerifyEmail(ctx context.Context, request *model.TokenRequest) error {
+	value, err := s.signer.Unsign(verifyEmailPurpose, request.Token)
+	if err != nil {
+		return ErrInvalidLinkToken
+	}
+
+	id, emailAddr, err := parseSignedID(value)
+	if err != nil {
+		return err
+	}
+
+	user, err := s.getUser(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	// email was changed after link was sent
+	if user.Email != emailAddr {
+		return ErrInvalidLinkToken
+	}
+
+	if user.Verified {
+		return nil
+	}
+
+	if err := s.userRepo.UpdateVerified(ctx, id, true); err != nil {
+		return fmt.Errorf("failed to update verified: %w", err)
+	}
+
+	return nil
+}
+
+func (s *authService) RequestEmailChange(
+	ctx context.Context,
+	id int32,
+	request *model.EmailChangeRequest,
+) error {
+	if err := request.Validate(); err != nil {
+		return err
+	}
+
+	user, err := s.getUser(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if user.Email == request.Email {
+		return ErrEmailChangeSameAddress
+	}
+
+	existing, err := s.userRepo.GetByEmail(ctx, request.Email)
+	if err != nil {
+		return fmt.Errorf("failed to get user by email: %w", err)
+	}
+
+	if existing != nil {
+		return ErrUserAlreadyExistsEmail
+	}
+
+	if err := s.startCooldown(ctx, emailChangePurpose, id); err != nil {
+		return err
+	}
+
+	nonce, err := randomToken()
+	if err != nil {
+		return err
+	}
+
+	change := entity.EmailChange{
+		NewEmail: request.Email,
+		Nonce:    nonce,
+	}
+	if err := s.userRepo.SetEmailChange(ctx, id, &change, emailChangeExpiration); err != nil {
+		return fmt.Errorf("failed to set email change: %w", err)
+	}
+
+	signed := s.signer.Sign(
+		verifyOldEmailPurpose,
+		fmt.Sprintf("%d:%s", id, nonce),
+		emailChangeExpiration,
+	)
+
+	return s.sendEmail(
+		user.Email,
+		"Email change",
+		fmt.Sprintf(
+			"Hello, %s!\r\n\r\n"+
+				"Somebody requested to change email of your account to %s.\r\n"+
+				"Follow the link to confirm:\r\n%s\r\n",
+			user.Username,
+			request.Email,
+			s.makeLink("/verify-old-email", signed),
+		),
+	)
+}
+
+// getEmailChange returns pending change for signed token of given purpose.
+func (s *authService) getEmailChange(
+	ctx context.Context,
+	purpose string,
+	request *model.TokenRequest,
+) (int32, *entity.EmailChange, error) {
+	value, err := s.signer.Unsign(purpose, request.Token)
+	if err != nil {
+		return 0, nil, ErrInvalidLinkToken
+	}
+
+	id, nonce, err := parseSignedID(value)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	change, err := s.userRepo.GetEmailChange(ctx, id)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to get email change: %w", err)
+	}
+
+	if change == nil {
+		return 0, nil, ErrEmailChangeNotFound
+	}
+
+	// link from previous request
+	if change.Nonce != nonce {
+		return 0, nil, ErrInvalidLinkToken
+	}
+
+	return id, change, nil
+}
+
+// VerifyOldEmail sends link to new email once, replayed link would
+// flood new address otherwise.
+func (s *authService) VerifyOldEmail(ctx context.Context, request *model.TokenRequest) error {
+	id, change, err := s.getEmailChange(ctx, verifyOldEmailPurpose, request)
+	if err != nil {
+		return err
+	}
+
+	if change.OldConfirmed {
+		return ErrOldEmailConfirmed
+	}
+
+	user, err := s.getUser(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	change.OldConfirmed = true
+	if err := s.userRepo.SetEmailChange(ctx, id, change, emailChangeExpiration); err != nil {
+		return fmt.Errorf("failed to set email change: %w", err)
+	}
+
+	signed := s.signer.Sign(
+		verifyNewEmailPurpose,
+		fmt.Sprintf("%d:%s", id, change.Nonce),
+		emailChangeExpiration,
+	)
+
+	return s.sendEmail(
+		change.NewEmail,
+		"Email change",
+		fmt.Sprintf(
+			"Hello, %s!\r\n\r\nFollow the link to confirm your new email:\r\n%s\r\n",
+			user.Username,
+			s.makeLink("/verify-new-email", signed),
+		),
+	)
+}
+
+func (s *authService) VerifyNewEmail(ctx context.Context, request *model.TokenRequest) error {
+	id, change, err := s.getEmailChange(ctx, verifyNewEmailPurpose, request)
+	if err != nil {
+		return err
+	}
+
+	if !change.OldConfirmed {
+		return ErrOldEmailNotConfirmed
+	}
+
+	// email could be taken while change was pending
+	existing, err := s.userRepo.GetByEmail(ctx, change.NewEmail)
+	if err != nil {
+		return fmt.Errorf("failed to get user by email: %w", err)
+	}
+
+	if existing != nil {
+		return ErrUserAlreadyExistsEmail
+	}
+
+	if err := s.userRepo.UpdateEmail(ctx, id, change.NewEmail); err != nil {
+		// concurrent registration took it after the check above
+		if errors.Is(err, repo.ErrUniqueViolation) {
+			return ErrUserAlreadyExistsEmail
+		}
+
+		return fmt.Errorf("failed to update email: %w", err)
+	}
+
+	if err := s.userRepo.DeleteEmailChange(ctx, id); err != nil {
+		return fmt.Errorf("failed to delete email change: %w", err)
+	}
+
+	return nil
+}
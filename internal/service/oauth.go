@@ -2,28 +2,333 @@ package service
 
 import (
 	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/pegov/fauth-backend-go/internal/config"
+	"github.com/pegov/fauth-backend-go/internal/entity"
 	"github.com/pegov/fauth-backend-go/internal/model"
+	"github.com/pegov/fauth-backend-go/internal/oauth"
 	"github.com/pegov/fauth-backend-go/internal/repo"
-	"github.com/pegov/fauth-backend-go/internal/token"
 )
 
+// OAuthService.Callback returns nil LoginResult when provider was linked
+// to already logged in user, users with 2fa get MFAToken like in Login.
 type OAuthService interface {
-	Login(ctx context.Context, request *model.LoginRequest) (string, string, error)
-	Callback(ctx context.Context, accessToken string) (*token.User, error)
+	Login(ctx context.Context, provider string) (string, string, error)
+	Link(ctx context.Context, provider string, userID int32) (string, string, error)
+	Unlink(ctx context.Context, provider string, userID int32) error
+	Callback(ctx context.Context, provider, state, code string) (*LoginResult, error)
 }
 
 type oauthService struct {
-	userRepo     repo.UserRepo
-	tokenBackend token.JwtBackend
+	cfg         *config.Config
+	userRepo    repo.UserRepo
+	authService *authService
+	providers   map[string]oauth.OAuthProvider
 }
 
 func NewOAuthService(
+	cfg *config.Config,
 	userRepo repo.UserRepo,
-	tokenBackend token.JwtBackend,
+	authService *authService,
+	providers map[string]oauth.OAuthProvider,
 ) *oauthService {
 	return &oauthService{
-		userRepo:     userRepo,
-		tokenBackend: tokenBackend,
+		cfg:         cfg,
+		userRepo:    userRepo,
+		authService: authService,
+		providers:   providers,
 	}
 }
+
+var (
+	ErrOAuthProviderNotFound = errors.New("oauth provider not found")
+	ErrInvalidOAuthState     = errors.New("invalid oauth state")
+	ErrOAuthUserData         = errors.New("failed to get user data from oauth provider")
+	ErrOAuthAlreadyLinked    = errors.New("oauth account already linked")
+	ErrOAuthNotLinked        = errors.New("oauth account not linked")
+	ErrOAuthLastLoginMethod  = errors.New("can't unlink the only login method, set password first")
+)
+
+const oauthStateExpiration = 10 * time.Minute
+
+func (s *oauthService) getProvider(name string) (oauth.OAuthProvider, error) {
+	provider, ok := s.providers[name]
+	if !ok {
+		return nil, ErrOAuthProviderNotFound
+	}
+
+	return provider, nil
+}
+
+func (s *oauthService) redirectURI(provider string) string {
+	return strings.TrimRight(s.cfg.OAuth.CallbackBaseURL, "/") +
+		model.UsersPrefix + "/oauth/" + provider + "/callback"
+}
+
+// start returns uri of provider's consent page and state
+// that must come back to Callback. State value is "<provider>"
+// for login and "<provider>:<user id>" for linking.
+func (s *oauthService) start(
+	ctx context.Context,
+	name string,
+	userID int32,
+) (string, string, error) {
+	provider, err := s.getProvider(name)
+	if err != nil {
+		return "", "", err
+	}
+
+	state, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	value := name
+	if userID != 0 {
+		value = fmt.Sprintf("%s:%d", name, userID)
+	}
+
+	if err := s.userRepo.SetOAuthState(ctx, state, value, oauthStateExpiration); err != nil {
+		return "", "", fmt.Errorf("failed to set oauth state: %w", err)
+	}
+
+	return provider.CreateOAuthURI(s.redirectURI(name), state), state, nil
+}
+
+func (s *oauthService) Login(ctx context.Context, name string) (string, string, error) {
+	return s.start(ctx, name, 0)
+}
+
+func (s *oauthService) Link(
+	ctx context.Context,
+	name string,
+	userID int32,
+) (string, string, error) {
+	return s.start(ctx, name, userID)
+}
+
+// Unlink checks and deletes under lock of user row, so concurrent unlinks
+// of the last two providers can't both pass the check.
+func (s *oauthService) Unlink(ctx context.Context, name string, userID int32) error {
+	return s.userRepo.WithTx(ctx, func(ctx context.Context, userRepo repo.UserRepo) error {
+		user, err := userRepo.GetForUpdate(ctx, userID)
+		if err != nil {
+			return fmt.Errorf("failed to get user by id: %w", err)
+		}
+
+		if user == nil {
+			return ErrUserNotFound
+		}
+
+		providers, err := userRepo.GetOAuthProviders(ctx, userID)
+		if err != nil {
+			return fmt.Errorf("failed to get oauth providers: %w", err)
+		}
+
+		if !slices.Contains(providers, name) {
+			return ErrOAuthNotLinked
+		}
+
+		if user.Password == nil && len(providers) == 1 {
+			return ErrOAuthLastLoginMethod
+		}
+
+		if err := userRepo.DeleteOAuth(ctx, userID, name); err != nil {
+			return fmt.Errorf("failed to delete oauth: %w", err)
+		}
+
+		return nil
+	})
+}
+
+func (s *oauthService) Callback(
+	ctx context.Context,
+	name, state, code string,
+) (*LoginResult, error) {
+	provider, err := s.getProvider(name)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := s.userRepo.PopOAuthState(ctx, state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get oauth state: %w", err)
+	}
+
+	stateProvider, linkUserID, isLink := strings.Cut(value, ":")
+	if stateProvider != name {
+		return nil, ErrInvalidOAuthState
+	}
+
+	data, err := provider.GetUserData(s.redirectURI(name), code)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrOAuthUserData, err)
+	}
+
+	user, err := s.userRepo.GetByOAuth(ctx, name, data.SID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user by oauth: %w", err)
+	}
+
+	if isLink {
+		id, err := strconv.ParseInt(linkUserID, 10, 32)
+		if err != nil {
+			return nil, ErrInvalidOAuthState
+		}
+
+		return nil, s.link(ctx, name, int32(id), user, data)
+	}
+
+	if user == nil {
+		if provider.IsLoginOnly() {
+			return nil, ErrUserNotFound
+		}
+
+		id, err := s.register(ctx, name, data)
+		if err != nil {
+			return nil, err
+		}
+
+		user, err = s.authService.getUser(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !user.Active {
+		return nil, ErrUserNotActive
+	}
+
+	if user.TOTPEnabled {
+		return s.authService.mfaChallenge(user)
+	}
+
+	s.userRepo.UpdateLastLogin(ctx, user.ID)
+
+	tokens, err := s.authService.createTokens(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LoginResult{Tokens: tokens}, nil
+}
+
+// link attaches provider account to user, owner is user
+// that is already linked to this provider account (if any).
+func (s *oauthService) link(
+	ctx context.Context,
+	provider string,
+	userID int32,
+	owner *entity.User,
+	data *oauth.OAuthResponse,
+) error {
+	if owner != nil {
+		if owner.ID == userID {
+			return nil
+		}
+
+		return ErrOAuthAlreadyLinked
+	}
+
+	providers, err := s.userRepo.GetOAuthProviders(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("failed to get oauth providers: %w", err)
+	}
+
+	// another account of this provider
+	if slices.Contains(providers, provider) {
+		return ErrOAuthAlreadyLinked
+	}
+
+	if err := s.userRepo.CreateOAuth(ctx, userID, provider, data.SID); err != nil {
+		return fmt.Errorf("failed to create oauth: %w", err)
+	}
+
+	return nil
+}
+
+// register creates user without password, email is verified only if
+// provider says so. Existing account with the same email is not linked
+// automatically, otherwise it could be taken over through provider.
+func (s *oauthService) register(
+	ctx context.Context,
+	provider string,
+	data *oauth.OAuthResponse,
+) (int32, error) {
+	existing, err := s.userRepo.GetByEmail(ctx, data.Email)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get user by email: %w", err)
+	}
+
+	if existing != nil {
+		return 0, ErrUserAlreadyExistsEmail
+	}
+
+	username, err := s.generateUsername(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int32
+	if err := s.userRepo.WithTx(ctx, func(ctx context.Context, userRepo repo.UserRepo) error {
+		id, err = userRepo.Create(ctx, &model.UserCreate{
+			Email:    data.Email,
+			Username: username,
+			Password: nil,
+			Verified: data.EmailVerified,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create user: %w", err)
+		}
+
+		if err := userRepo.CreateOAuth(ctx, id, provider, data.SID); err != nil {
+			return fmt.Errorf("failed to create oauth: %w", err)
+		}
+
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+const (
+	generatedUsernameAlphabet = "abcdefghijklmnopqrstuvwxyz"
+	generatedUsernameLength   = 8
+	generatedUsernameAttempts = 5
+)
+
+func (s *oauthService) generateUsername(ctx context.Context) (string, error) {
+	for range generatedUsernameAttempts {
+		// rand.Int is uniform, byte modulo 26 would favour first letters
+		b := make([]byte, generatedUsernameLength)
+		for i := range b {
+			n, err := rand.Int(rand.Reader, big.NewInt(int64(len(generatedUsernameAlphabet))))
+			if err != nil {
+				return "", err
+			}
+			b[i] = generatedUsernameAlphabet[n.Int64()]
+		}
+
+		username := "user" + string(b)
+		user, err := s.userRepo.GetByUsername(ctx, username)
+		if err != nil {
+			return "", fmt.Errorf("failed to get user by username: %w", err)
+		}
+
+		if user == nil {
+			return username, nil
+		}
+	}
+
+	return "", errors.New("failed to generate unique username")
+}
@@ -0,0 +1,359 @@
+package service_test
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/ovechkin-dm/mockio/v2/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pegov/fauth-backend-go/internal/entity"
+	"github.com/pegov/fauth-backend-go/internal/model"
+	"github.com/pegov/fauth-backend-go/internal/oauth"
+	"github.com/pegov/fauth-backend-go/internal/repo"
+	"github.com/pegov/fauth-backend-go/internal/service"
+)
+
+func TestOAuthUnlink(t *testing.T) {
+	pass := "pass"
+	tests := []struct {
+		name      string
+		password  *string
+		providers []string
+		expected  error
+	}{
+		{"last login method", nil, []string{"google"}, service.ErrOAuthLastLoginMethod},
+		{"password set", &pass, []string{"google"}, nil},
+		{"another provider", nil, []string{"google", "vk"}, nil},
+		{"not linked", &pass, []string{"vk"}, service.ErrOAuthNotLinked},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := mock.NewMockController(t)
+			repoM := mock.Mock[repo.UserRepo](ctrl)
+			cached := newCacheUserRepo(repoM)
+			roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+			sessionRepoM := mock.Mock[repo.SessionRepo](ctrl)
+
+			_, s, _ := newServices(t, cached, roleRepoM, sessionRepoM, nil)
+
+			// user row is locked for the check and delete
+			res := entity.User{ID: 1, Username: "user", Password: tt.password, Active: true}
+			mock.WhenDouble(repoM.GetForUpdate(mock.AnyContext(), mock.Exact(res.ID))).ThenReturn(&res, nil)
+			mock.WhenDouble(repoM.GetOAuthProviders(mock.AnyContext(), mock.Exact(res.ID))).
+				ThenReturn(tt.providers, nil)
+
+			err := s.Unlink(t.Context(), "google", res.ID)
+			mock.Verify(repoM, mock.Never()).Get(mock.AnyContext(), mock.Any[int32]())
+			if tt.expected != nil {
+				require.ErrorIs(t, err, tt.expected)
+				mock.Verify(repoM, mock.Never()).DeleteOAuth(mock.AnyContext(), mock.Any[int32](), mock.AnyString())
+				return
+			}
+
+			require.NoError(t, err)
+			mock.Verify(repoM, mock.Once()).DeleteOAuth(mock.AnyContext(), mock.Exact(res.ID), mock.Exact("google"))
+		})
+	}
+}
+
+func TestOAuthCallbackLink(t *testing.T) {
+	tests := []struct {
+		name      string
+		state     string
+		owner     *entity.User
+		providers []string
+		expected  error
+		created   bool
+	}{
+		{"linked", "google:1", nil, nil, nil, true},
+		{"already linked to user", "google:1", &entity.User{ID: 1}, nil, nil, false},
+		{"linked to another user", "google:1", &entity.User{ID: 2}, nil, service.ErrOAuthAlreadyLinked, false},
+		{"another account of provider", "google:1", nil, []string{"google"}, service.ErrOAuthAlreadyLinked, false},
+		{"state of another provider", "vk:1", nil, nil, service.ErrInvalidOAuthState, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := mock.NewMockController(t)
+			repoM := mock.Mock[repo.UserRepo](ctrl)
+			roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+			sessionRepoM := mock.Mock[repo.SessionRepo](ctrl)
+			provider := mock.Mock[oauth.OAuthProvider](ctrl)
+
+			_, s, _ := newServices(t, repoM, roleRepoM, sessionRepoM, map[string]oauth.OAuthProvider{
+				"google": provider,
+			})
+
+			mock.WhenDouble(provider.GetUserData(mock.AnyString(), mock.AnyString())).
+				ThenReturn(&oauth.OAuthResponse{SID: "sid", Email: "user@example.com"}, nil)
+			mock.WhenDouble(repoM.PopOAuthState(mock.AnyContext(), mock.Exact("state"))).
+				ThenReturn(tt.state, nil)
+			mock.WhenDouble(repoM.GetByOAuth(mock.AnyContext(), mock.Exact("google"), mock.Exact("sid"))).
+				ThenReturn(tt.owner, nil)
+			mock.WhenDouble(repoM.GetOAuthProviders(mock.AnyContext(), mock.Exact(int32(1)))).
+				ThenReturn(tt.providers, nil)
+
+			result, err := s.Callback(t.Context(), "google", "state", "code")
+			require.Nil(t, result)
+			if tt.expected != nil {
+				require.ErrorIs(t, err, tt.expected)
+			} else {
+				require.NoError(t, err)
+			}
+
+			calls := mock.Never()
+			if tt.created {
+				calls = mock.Once()
+			}
+			mock.Verify(repoM, calls).CreateOAuth(
+				mock.AnyContext(),
+				mock.Exact(int32(1)),
+				mock.Exact("google"),
+				mock.Exact("sid"),
+			)
+		})
+	}
+}
+
+func TestOAuthCallbackLogin(t *testing.T) {
+	ctrl := mock.NewMockController(t)
+	repoM := mock.Mock[repo.UserRepo](ctrl)
+	cached := newCacheUserRepo(repoM)
+	roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+	sessionRepoM := mock.Mock[repo.SessionRepo](ctrl)
+	provider := mock.Mock[oauth.OAuthProvider](ctrl)
+
+	authService, s, _ := newServices(t, cached, roleRepoM, sessionRepoM, map[string]oauth.OAuthProvider{
+		"google": provider,
+	})
+
+	res := entity.User{ID: 1, Username: "user", Active: true}
+	store := stubSessionStore(sessionRepoM)
+	mock.WhenDouble(provider.GetUserData(mock.AnyString(), mock.AnyString())).
+		ThenReturn(&oauth.OAuthResponse{SID: "sid", Email: "user@example.com"}, nil)
+	state := "google"
+	mock.WhenDouble(repoM.PopOAuthState(mock.AnyContext(), mock.Exact("state"))).
+		ThenAnswer(func(args []any) (string, error) {
+			value := state
+			state = ""
+			return value, nil
+		})
+	mock.WhenDouble(repoM.GetByOAuth(mock.AnyContext(), mock.Exact("google"), mock.Exact("sid"))).
+		ThenReturn(&res, nil)
+
+	result, err := s.Callback(t.Context(), "google", "state", "code")
+	require.NoError(t, err)
+	require.Len(t, store.sessions, 1)
+
+	user, err := authService.Token(t.Context(), result.Tokens.Access)
+	require.NoError(t, err)
+	require.Equal(t, res.ID, user.ID)
+
+	// redirect uri must be the same that was sent to consent page
+	mock.Verify(provider, mock.Once()).GetUserData(
+		mock.Exact("https://example.com"+model.UsersPrefix+"/oauth/google/callback"),
+		mock.Exact("code"),
+	)
+	mock.Verify(repoM, mock.Once()).UpdateLastLogin(mock.AnyContext(), mock.Exact(res.ID))
+	mock.Verify(repoM, mock.Never()).Create(mock.AnyContext(), mock.Any[*model.UserCreate]())
+
+	// state is single use
+	_, err = s.Callback(t.Context(), "google", "state", "code")
+	require.ErrorIs(t, err, service.ErrInvalidOAuthState)
+}
+
+var generatedUsernameRe = regexp.MustCompile(`^user[a-z]{8}$`)
+
+func TestOAuthCallbackRegister(t *testing.T) {
+	for _, emailVerified := range []bool{true, false} {
+		ctrl := mock.NewMockController(t)
+		repoM := mock.Mock[repo.UserRepo](ctrl)
+		cached := newCacheUserRepo(repoM)
+		roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+		sessionRepoM := mock.Mock[repo.SessionRepo](ctrl)
+		provider := mock.Mock[oauth.OAuthProvider](ctrl)
+
+		authService, s, _ := newServices(t, cached, roleRepoM, sessionRepoM, map[string]oauth.OAuthProvider{
+			"google": provider,
+		})
+
+		stubSessionStore(sessionRepoM)
+		mock.WhenDouble(provider.GetUserData(mock.AnyString(), mock.AnyString())).
+			ThenReturn(&oauth.OAuthResponse{SID: "sid", Email: "user@example.com", EmailVerified: emailVerified}, nil)
+		mock.WhenDouble(repoM.PopOAuthState(mock.AnyContext(), mock.Exact("state"))).
+			ThenReturn("google", nil)
+
+		var created *model.UserCreate
+		mock.WhenDouble(repoM.Create(mock.AnyContext(), mock.Any[*model.UserCreate]())).
+			ThenAnswer(func(args []any) (int32, error) {
+				created = args[1].(*model.UserCreate)
+				return 1, nil
+			})
+		mock.WhenDouble(repoM.Get(mock.AnyContext(), mock.Exact(int32(1)))).
+			ThenAnswer(func(args []any) (*entity.User, error) {
+				return &entity.User{
+					ID:       1,
+					Email:    created.Email,
+					Username: created.Username,
+					Verified: created.Verified,
+					Active:   true,
+				}, nil
+			})
+
+		result, err := s.Callback(t.Context(), "google", "state", "code")
+		require.NoError(t, err)
+
+		user, err := authService.Token(t.Context(), result.Tokens.Access)
+		require.NoError(t, err)
+		require.Equal(t, int32(1), user.ID)
+
+		// user without password gets generated username and provider account
+		require.Equal(t, "user@example.com", created.Email)
+		require.Regexp(t, generatedUsernameRe, created.Username)
+		require.Nil(t, created.Password)
+		mock.Verify(repoM, mock.Once()).CreateOAuth(
+			mock.AnyContext(),
+			mock.Exact(int32(1)),
+			mock.Exact("google"),
+			mock.Exact("sid"),
+		)
+
+		// email is verified only if provider says so
+		require.Equal(t, emailVerified, created.Verified)
+	}
+}
+
+func TestOAuthCallbackRegisterEmailTaken(t *testing.T) {
+	ctrl := mock.NewMockController(t)
+	repoM := mock.Mock[repo.UserRepo](ctrl)
+	roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+	sessionRepoM := mock.Mock[repo.SessionRepo](ctrl)
+	provider := mock.Mock[oauth.OAuthProvider](ctrl)
+
+	_, s, _ := newServices(t, repoM, roleRepoM, sessionRepoM, map[string]oauth.OAuthProvider{
+		"google": provider,
+	})
+
+	mock.WhenDouble(provider.GetUserData(mock.AnyString(), mock.AnyString())).
+		ThenReturn(&oauth.OAuthResponse{SID: "sid", Email: "user@example.com", EmailVerified: true}, nil)
+	mock.WhenDouble(repoM.PopOAuthState(mock.AnyContext(), mock.Exact("state"))).
+		ThenReturn("google", nil)
+	mock.WhenDouble(repoM.GetByEmail(mock.AnyContext(), mock.Exact("user@example.com"))).
+		ThenReturn(&entity.User{ID: 1, Email: "user@example.com"}, nil)
+
+	// existing account is not taken over through provider
+	result, err := s.Callback(t.Context(), "google", "state", "code")
+	require.ErrorIs(t, err, service.ErrUserAlreadyExistsEmail)
+	require.Nil(t, result)
+	mock.Verify(repoM, mock.Never()).Create(mock.AnyContext(), mock.Any[*model.UserCreate]())
+	mock.Verify(repoM, mock.Never()).CreateOAuth(
+		mock.AnyContext(),
+		mock.Any[int32](),
+		mock.AnyString(),
+		mock.AnyString(),
+	)
+}
+
+func TestOAuthCallbackUsernameCollision(t *testing.T) {
+	tests := []struct {
+		name     string
+		taken    int
+		attempts int
+		created  bool
+	}{
+		{"free", 0, 1, true},
+		{"taken twice", 2, 3, true},
+		{"always taken", 100, 5, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := mock.NewMockController(t)
+			repoM := mock.Mock[repo.UserRepo](ctrl)
+			cached := newCacheUserRepo(repoM)
+			roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+			sessionRepoM := mock.Mock[repo.SessionRepo](ctrl)
+			provider := mock.Mock[oauth.OAuthProvider](ctrl)
+
+			_, s, _ := newServices(t, cached, roleRepoM, sessionRepoM, map[string]oauth.OAuthProvider{
+				"google": provider,
+			})
+
+			stubSessionStore(sessionRepoM)
+			mock.WhenDouble(provider.GetUserData(mock.AnyString(), mock.AnyString())).
+				ThenReturn(&oauth.OAuthResponse{SID: "sid", Email: "user@example.com"}, nil)
+			mock.WhenDouble(repoM.PopOAuthState(mock.AnyContext(), mock.Exact("state"))).
+				ThenReturn("google", nil)
+
+			var checked []string
+			mock.WhenDouble(repoM.GetByUsername(mock.AnyContext(), mock.AnyString())).
+				ThenAnswer(func(args []any) (*entity.User, error) {
+					username := args[1].(string)
+					checked = append(checked, username)
+					if len(checked) <= tt.taken {
+						return &entity.User{ID: 2, Username: username}, nil
+					}
+					return nil, nil
+				})
+
+			var created *model.UserCreate
+			mock.WhenDouble(repoM.Create(mock.AnyContext(), mock.Any[*model.UserCreate]())).
+				ThenAnswer(func(args []any) (int32, error) {
+					created = args[1].(*model.UserCreate)
+					return 1, nil
+				})
+			mock.WhenDouble(repoM.Get(mock.AnyContext(), mock.Exact(int32(1)))).
+				ThenAnswer(func(args []any) (*entity.User, error) {
+					return &entity.User{ID: 1, Username: created.Username, Active: true}, nil
+				})
+
+			_, err := s.Callback(t.Context(), "google", "state", "code")
+			require.Len(t, checked, tt.attempts)
+			for _, username := range checked {
+				require.Regexp(t, generatedUsernameRe, username)
+			}
+
+			if !tt.created {
+				require.Error(t, err)
+				mock.Verify(repoM, mock.Never()).Create(mock.AnyContext(), mock.Any[*model.UserCreate]())
+				return
+			}
+
+			// the first free username is used
+			require.NoError(t, err)
+			require.Equal(t, checked[len(checked)-1], created.Username)
+		})
+	}
+}
+
+func TestOAuthCallbackTOTP(t *testing.T) {
+	ctrl := mock.NewMockController(t)
+	repoM := mock.Mock[repo.UserRepo](ctrl)
+	cached := newCacheUserRepo(repoM)
+	roleRepoM := mock.Mock[repo.RoleRepo](ctrl)
+	sessionRepoM := mock.Mock[repo.SessionRepo](ctrl)
+	provider := mock.Mock[oauth.OAuthProvider](ctrl)
+
+	_, s, _ := newServices(t, cached, roleRepoM, sessionRepoM, map[string]oauth.OAuthProvider{
+		"google": provider,
+	})
+
+	res := entity.User{ID: 1, Username: "user", Active: true, TOTPEnabled: true}
+	store := stubSessionStore(sessionRepoM)
+	mock.WhenDouble(provider.GetUserData(mock.AnyString(), mock.AnyString())).
+		ThenReturn(&oauth.OAuthResponse{SID: "sid", Email: "user@example.com"}, nil)
+	mock.WhenDouble(repoM.PopOAuthState(mock.AnyContext(), mock.Exact("state"))).
+		ThenReturn("google", nil)
+	mock.WhenDouble(repoM.GetByOAuth(mock.AnyContext(), mock.Exact("google"), mock.Exact("sid"))).
+		ThenReturn(&res, nil)
+
+	// provider doesn't replace second factor
+	result, err := s.Callback(t.Context(), "google", "state", "code")
+	require.NoError(t, err)
+	require.Nil(t, result.Tokens)
+	require.NotEmpty(t, result.MFAToken)
+	require.Empty(t, store.sessions)
+	mock.Verify(repoM, mock.Never()).UpdateLastLogin(mock.AnyContext(), mock.Any[int32]())
+}
@@ -0,0 +1,223 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pegov/fauth-backend-go/internal/model"
+)
+
+var (
+	ErrUserPasswordAlreadySet = errors.New("password already set")
+	ErrInvalidOldPassword     = errors.New("invalid old password")
+)
+
+const (
+	resetPasswordPurpose    = "reset_password"
+	resetPasswordExpiration = time.Hour
+)
+
+func (s *authService) updatePassword(ctx context.Context, id int32, password string) error {
+	passwordHash, err := s.passwordHasher.Hash([]byte(password))
+	if err != nil {
+		return fmt.Errorf("unexpected err: %w", err)
+	}
+
+	hash := string(passwordHash)
+	if err := s.userRepo.UpdatePassword(ctx, id, &hash); err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+
+	return nil
+}
+
+// ForgotPassword does not report whether user exists.
+func (s *authService) ForgotPassword(
+	ctx context.Context,
+	request *model.ForgotPasswordRequest,
+) error {
+	if !s.captchaClient.IsValid(request.Captcha) {
+		return ErrInvalidCaptcha
+	}
+
+	user, err := s.userRepo.GetByEmail(ctx, strings.TrimSpace(request.Email))
+	if err != nil {
+		return fmt.Errorf("failed to get user by email: %w", err)
+	}
+
+	if user == nil || !user.Active {
+		return nil
+	}
+
+	remaining, err := s.userRepo.StartCooldown(ctx, resetPasswordPurpose, user.ID, emailCooldown)
+	if err != nil {
+		return fmt.Errorf("failed to start cooldown: %w", err)
+	}
+
+	if remaining > 0 {
+		return nil
+	}
+
+	nonce, err := randomToken()
+	if err != nil {
+		return err
+	}
+
+	if err := s.userRepo.SetPasswordResetNonce(
+		ctx,
+		user.ID,
+		nonce,
+		resetPasswordExpiration,
+	); err != nil {
+		return fmt.Errorf("failed to set password reset nonce: %w", err)
+	}
+
+	signed := s.signer.Sign(
+		resetPasswordPurpose,
+		fmt.Sprintf("%d:%s", user.ID, nonce),
+		resetPasswordExpiration,
+	)
+
+	return s.sendEmail(
+		user.Email,
+		"Password reset",
+		fmt.Sprintf(
+			"Hello, %s!\r\n\r\n"+
+				"Follow the link to set new password:\r\n%s\r\n\r\n"+
+				"If you did not request password reset, ignore this email.\r\n",
+			user.Username,
+			s.makeLink("/reset-password", signed),
+		),
+	)
+}
+
+func (s *authService) ResetPassword(
+	ctx context.Context,
+	request *model.ResetPasswordRequest,
+) error {
+	if err := request.Validate(); err != nil {
+		return err
+	}
+
+	value, err := s.signer.Unsign(resetPasswordPurpose, request.Token)
+	if err != nil {
+		return ErrInvalidLinkToken
+	}
+
+	id, nonce, err := parseSignedID(value)
+	if err != nil {
+		return err
+	}
+
+	// already used (maybe by concurrent request) or newer link was sent
+	ok, err := s.userRepo.UsePasswordResetNonce(ctx, id, nonce)
+	if err != nil {
+		return fmt.Errorf("failed to use password reset nonce: %w", err)
+	}
+
+	if !ok {
+		return ErrInvalidLinkToken
+	}
+
+	if _, err := s.getUser(ctx, id); err != nil {
+		return err
+	}
+
+	if err := s.updatePassword(ctx, id, request.Password1); err != nil {
+		return err
+	}
+
+	// logout everywhere, whoever knew old password may still hold tokens
+	return s.LogoutAll(ctx, id)
+}
+
+func (s *authService) GetPasswordStatus(
+	ctx context.Context,
+	id int32,
+) (*model.PasswordStatus, error) {
+	user, err := s.getUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &model.PasswordStatus{
+		HasPassword: user.Password != nil,
+	}, nil
+}
+
+func (s *authService) ChangePassword(
+	ctx context.Context,
+	id int32,
+	request *model.ChangePasswordRequest,
+) error {
+	if err := request.Validate(); err != nil {
+		return err
+	}
+
+	user, err := s.getUser(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if user.Password == nil {
+		return ErrUserPasswordNotSet
+	}
+
+	// old password is guessed under the same lockout as login
+	if err := s.checkLoginLock(ctx, userLimitKey(id)); err != nil {
+		return err
+	}
+
+	if s.passwordHasher.Compare(
+		[]byte(*user.Password),
+		[]byte(request.OldPassword),
+	) != nil {
+		if err := s.addLoginFailure(ctx, userLimitKey(id)); err != nil {
+			return err
+		}
+
+		return ErrInvalidOldPassword
+	}
+
+	return s.updatePassword(ctx, id, request.Password1)
+}
+
+// SetPassword is for users without password (registered with oauth).
+func (s *authService) SetPassword(
+	ctx context.Context,
+	id int32,
+	request *model.SetPasswordRequest,
+) error {
+	if err := request.Validate(); err != nil {
+		return err
+	}
+
+	user, err := s.getUser(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if user.Password != nil {
+		return ErrUserPasswordAlreadySet
+	}
+
+	passwordHash, err := s.passwordHasher.Hash([]byte(request.Password1))
+	if err != nil {
+		return fmt.Errorf("unexpected err: %w", err)
+	}
+
+	// concurrent request could set password after the check above
+	ok, err := s.userRepo.SetPassword(ctx, id, string(passwordHash))
+	if err != nil {
+		return fmt.Errorf("failed to set password: %w", err)
+	}
+
+	if !ok {
+		return ErrUserPasswordAlreadySet
+	}
+
+	return nil
+}
@@ -0,0 +1,146 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pegov/fauth-backend-go/internal/model"
+)
+
+const (
+	loginRatelimitWindow    = time.Minute
+	loginFailuresExpiration = 24 * time.Hour
+	loginLockoutMax         = 24 * time.Hour
+
+	// 2fa is limited regardless of login lockout config,
+	// 6 digit code must not be guessable by retries
+	mfaMaxFailures = 5
+	mfaLockout     = 15 * time.Minute
+)
+
+// loginLimitKey makes "User" and "user" share limits.
+func loginLimitKey(login string) string {
+	return "login:" + strings.ToLower(login)
+}
+
+// userLimitKey is used for failures and lockout once user is known,
+// so email and username of one account share them.
+func userLimitKey(id int32) string {
+	return fmt.Sprintf("user:%d", id)
+}
+
+func mfaLimitKey(id int32) string {
+	return fmt.Sprintf("mfa:%d", id)
+}
+
+// checkLoginRateLimit limits attempts from one ip and for one login,
+// it is called before user is looked up. Ip is taken from proxy headers
+// only if config lists proxy as trusted (see api.NewRealIPMiddleware).
+func (s *authService) checkLoginRateLimit(ctx context.Context, login string) error {
+	limit := s.cfg.App.LoginRatelimit
+	if limit <= 0 {
+		return nil
+	}
+
+	keys := []string{loginLimitKey(login)}
+	if ip := model.ClientFromContext(ctx).IP; ip != "" {
+		keys = append(keys, "login:ip:"+ip)
+	}
+
+	var retryAfter time.Duration
+	for _, key := range keys {
+		remaining, err := s.userRepo.HitRateLimit(ctx, key, limit, loginRatelimitWindow)
+		if err != nil {
+			return fmt.Errorf("failed to hit rate limit: %w", err)
+		}
+
+		retryAfter = max(retryAfter, remaining)
+	}
+
+	if retryAfter > 0 {
+		return &RateLimitError{RetryAfter: retryAfter}
+	}
+
+	return nil
+}
+
+// checkLoginLock is called before credentials are checked,
+// so locked user is rejected even with valid password.
+func (s *authService) checkLoginLock(ctx context.Context, key string) error {
+	remaining, err := s.userRepo.GetLoginLock(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to get login lock: %w", err)
+	}
+
+	if remaining > 0 {
+		return &RateLimitError{RetryAfter: remaining}
+	}
+
+	return nil
+}
+
+// addLoginFailure locks key after LoginLockoutThreshold consecutive
+// failures, every next failure doubles lockout up to loginLockoutMax.
+// Unknown logins are counted too, otherwise lockout would reveal
+// which logins exist.
+func (s *authService) addLoginFailure(ctx context.Context, key string) error {
+	count, err := s.userRepo.AddLoginFailure(ctx, key, loginFailuresExpiration)
+	if err != nil {
+		return fmt.Errorf("failed to add login failure: %w", err)
+	}
+
+	threshold := int64(s.cfg.App.LoginLockoutThreshold)
+	if threshold <= 0 || count < threshold {
+		return nil
+	}
+
+	if err := s.userRepo.LockLogin(ctx, key, s.loginLockout(count-threshold)); err != nil {
+		return fmt.Errorf("failed to lock login: %w", err)
+	}
+
+	return nil
+}
+
+// addMFAFailure locks 2fa step of user for mfaLockout after
+// mfaMaxFailures failures, new mfa tokens don't reset it.
+func (s *authService) addMFAFailure(ctx context.Context, id int32) error {
+	key := mfaLimitKey(id)
+	count, err := s.userRepo.AddLoginFailure(ctx, key, mfaLockout)
+	if err != nil {
+		return fmt.Errorf("failed to add mfa failure: %w", err)
+	}
+
+	if count < mfaMaxFailures {
+		return nil
+	}
+
+	if err := s.userRepo.LockLogin(ctx, key, mfaLockout); err != nil {
+		return fmt.Errorf("failed to lock mfa: %w", err)
+	}
+
+	return nil
+}
+
+func (s *authService) clearLoginFailures(ctx context.Context, id int32) error {
+	for _, key := range []string{userLimitKey(id), mfaLimitKey(id)} {
+		if err := s.userRepo.ClearLoginFailures(ctx, key); err != nil {
+			return fmt.Errorf("failed to clear login failures: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *authService) loginLockout(n int64) time.Duration {
+	lockout := time.Duration(s.cfg.App.LoginLockoutDuration) * time.Second
+	for range n {
+		lockout *= 2
+		if lockout >= loginLockoutMax {
+			return loginLockoutMax
+		}
+	}
+
+	return min(lockout, loginLockoutMax)
+}
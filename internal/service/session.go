@@ -0,0 +1,114 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pegov/fauth-backend-go/internal/model"
+	"github.com/pegov/fauth-backend-go/internal/token"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+func (s *authService) GetSessions(
+	ctx context.Context,
+	id int32,
+	currentSessionID string,
+) ([]*model.Session, error) {
+	sessions, err := s.sessionRepo.GetActiveByUser(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sessions: %w", err)
+	}
+
+	result := make([]*model.Session, 0, len(sessions))
+	for i := range sessions {
+		result = append(result, model.SessionFromEntity(&sessions[i], currentSessionID))
+	}
+
+	return result, nil
+}
+
+func (s *authService) RevokeSession(ctx context.Context, id int32, sessionID string) error {
+	session, err := s.sessionRepo.Get(ctx, sessionID)
+	if err != nil {
+		return fmt.Errorf("failed to get session: %w", err)
+	}
+
+	// sessions of other users are reported as not found
+	if session == nil || session.UserID != id || session.RevokedAt != nil {
+		return ErrSessionNotFound
+	}
+
+	return s.revokeSession(ctx, sessionID, session.ExpiresAt)
+}
+
+// revokeSession denies all tokens of session, denylist entry lives until
+// expiresAt, when the last refresh token of session expires.
+func (s *authService) revokeSession(
+	ctx context.Context,
+	sessionID string,
+	expiresAt time.Time,
+) error {
+	if ttl := time.Until(expiresAt); ttl > 0 {
+		if err := s.userRepo.DenySession(ctx, sessionID, ttl); err != nil {
+			return fmt.Errorf("failed to deny session: %w", err)
+		}
+	}
+
+	if err := s.userRepo.DeleteRefreshFamily(ctx, sessionID); err != nil {
+		return fmt.Errorf("failed to delete refresh family: %w", err)
+	}
+
+	if err := s.sessionRepo.Revoke(ctx, sessionID); err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+
+	return nil
+}
+
+// Logout revokes session of refresh token. Clients without cookies may
+// send access token instead, then its session is revoked. Invalid token
+// is ignored since there is nothing to revoke.
+func (s *authService) Logout(ctx context.Context, refreshOrAccessToken string) error {
+	claims, err := s.tokenBackend.Decode(refreshOrAccessToken, token.RefreshTokenType)
+	if err == nil {
+		if claims.SessionID == "" {
+			return nil
+		}
+
+		return s.revokeSession(ctx, claims.SessionID, claims.ExpiresAt.Time)
+	}
+
+	claims, err = s.tokenBackend.Decode(refreshOrAccessToken, token.AccessTokenType)
+	if err != nil || claims.SessionID == "" {
+		return nil
+	}
+
+	// access token expires before session, so session's expiration is used
+	err = s.RevokeSession(ctx, claims.UserID, claims.SessionID)
+	if err != nil && !errors.Is(err, ErrSessionNotFound) {
+		return err
+	}
+
+	return nil
+}
+
+// LogoutAll revokes all sessions of user, so both refresh and access
+// tokens of them are rejected. Unlike kick it doesn't depend on iat,
+// which has only second precision, so login right after it works.
+func (s *authService) LogoutAll(ctx context.Context, id int32) error {
+	sessions, err := s.sessionRepo.GetActiveByUser(ctx, id)
+	if err != nil {
+		return fmt.Errorf("failed to get sessions: %w", err)
+	}
+
+	for _, session := range sessions {
+		if err := s.revokeSession(ctx, session.ID, session.ExpiresAt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
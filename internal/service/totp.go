@@ -0,0 +1,280 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pegov/fauth-backend-go/internal/entity"
+	"github.com/pegov/fauth-backend-go/internal/model"
+	"github.com/pegov/fauth-backend-go/internal/repo"
+	"github.com/pegov/fauth-backend-go/internal/totp"
+)
+
+var (
+	ErrTOTPAlreadyEnabled = errors.New("2fa already enabled")
+	ErrTOTPNotEnabled     = errors.New("2fa not enabled")
+	ErrTOTPNotSetUp       = errors.New("2fa setup was not started")
+	ErrInvalidTOTPCode    = errors.New("invalid 2fa code")
+)
+
+func (s *authService) SetupTOTP(ctx context.Context, id int32) (*model.TOTPSetup, error) {
+	user, err := s.getUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.TOTPEnabled {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted, err := s.totpCipher.Encrypt(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	// not enabled until the first code is confirmed
+	if err := s.userRepo.UpdateTOTP(ctx, id, &encrypted, false); err != nil {
+		return nil, fmt.Errorf("failed to update totp: %w", err)
+	}
+
+	return &model.TOTPSetup{
+		Secret: secret,
+		URI:    totp.ProvisioningURI(secret, s.cfg.TOTP.Issuer, user.Username),
+	}, nil
+}
+
+// verifyTOTP checks code against the stored (encrypted) secret of user,
+// code of time step that was already used is rejected.
+func (s *authService) verifyTOTP(ctx context.Context, user *entity.User, code string) error {
+	if user.TOTPSecret == nil {
+		return ErrTOTPNotSetUp
+	}
+
+	secret, err := s.totpCipher.Decrypt(*user.TOTPSecret)
+	if err != nil {
+		return err
+	}
+
+	step, ok := totp.ValidateStep(secret, code, time.Now())
+	if !ok {
+		return ErrInvalidTOTPCode
+	}
+
+	ok, err = s.userRepo.UseTOTPStep(ctx, user.ID, step, totp.StepLifetime)
+	if err != nil {
+		return fmt.Errorf("failed to use totp step: %w", err)
+	}
+
+	if !ok {
+		return ErrInvalidTOTPCode
+	}
+
+	return nil
+}
+
+// verifyLimited runs verify under the same lockout as LoginTOTP, wrong
+// codes count as 2fa failures.
+func (s *authService) verifyLimited(
+	ctx context.Context,
+	user *entity.User,
+	code string,
+	verify func(context.Context, *entity.User, string) error,
+) error {
+	if err := s.checkLoginLock(ctx, mfaLimitKey(user.ID)); err != nil {
+		return err
+	}
+
+	if err := verify(ctx, user, code); err != nil {
+		if errors.Is(err, ErrInvalidTOTPCode) {
+			if err := s.addMFAFailure(ctx, user.ID); err != nil {
+				return err
+			}
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// verifyTOTPLimited is verifyTOTP under 2fa lockout, for confirmation of
+// a new secret, recovery codes can't confirm it.
+func (s *authService) verifyTOTPLimited(ctx context.Context, user *entity.User, code string) error {
+	return s.verifyLimited(ctx, user, code, s.verifyTOTP)
+}
+
+// verifySecondFactorLimited is verifySecondFactor under 2fa lockout, so
+// user without device can manage 2fa with recovery code.
+func (s *authService) verifySecondFactorLimited(ctx context.Context, user *entity.User, code string) error {
+	return s.verifyLimited(ctx, user, code, s.verifySecondFactor)
+}
+
+// verifySecondFactor accepts either totp code or unused recovery code,
+// recovery code is marked as used.
+func (s *authService) verifySecondFactor(
+	ctx context.Context,
+	user *entity.User,
+	code string,
+) error {
+	code = strings.TrimSpace(code)
+	if len(code) == totp.Digits {
+		return s.verifyTOTP(ctx, user, code)
+	}
+
+	codes, err := s.userRepo.GetRecoveryCodes(ctx, user.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get recovery codes: %w", err)
+	}
+
+	code = totp.NormalizeRecoveryCode(code)
+	for _, recoveryCode := range codes {
+		if s.passwordHasher.Compare([]byte(recoveryCode.Code), []byte(code)) != nil {
+			continue
+		}
+
+		ok, err := s.userRepo.UseRecoveryCode(ctx, recoveryCode.ID)
+		if err != nil {
+			return fmt.Errorf("failed to use recovery code: %w", err)
+		}
+
+		if !ok {
+			break
+		}
+
+		return nil
+	}
+
+	return ErrInvalidTOTPCode
+}
+
+// replaceRecoveryCodes must be called inside transaction.
+func (s *authService) replaceRecoveryCodes(
+	ctx context.Context,
+	userRepo repo.UserRepo,
+	id int32,
+) ([]string, error) {
+	codes, err := totp.GenerateRecoveryCodes(totp.RecoveryCodesCount)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make([]string, 0, len(codes))
+	for _, code := range codes {
+		hash, err := s.passwordHasher.Hash([]byte(code))
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, string(hash))
+	}
+
+	if err := userRepo.DeleteRecoveryCodes(ctx, id); err != nil {
+		return nil, fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+
+	if err := userRepo.CreateRecoveryCodes(ctx, id, hashes); err != nil {
+		return nil, fmt.Errorf("failed to create recovery codes: %w", err)
+	}
+
+	return codes, nil
+}
+
+func (s *authService) ConfirmTOTP(
+	ctx context.Context,
+	id int32,
+	request *model.TOTPCodeRequest,
+) (*model.RecoveryCodes, error) {
+	user, err := s.getUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.TOTPEnabled {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+
+	if err := s.verifyTOTPLimited(ctx, user, request.Code); err != nil {
+		return nil, err
+	}
+
+	var codes []string
+	if err := s.userRepo.WithTx(ctx, func(ctx context.Context, userRepo repo.UserRepo) error {
+		if err := userRepo.UpdateTOTP(ctx, id, user.TOTPSecret, true); err != nil {
+			return fmt.Errorf("failed to update totp: %w", err)
+		}
+
+		codes, err = s.replaceRecoveryCodes(ctx, userRepo, id)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	return &model.RecoveryCodes{Codes: codes}, nil
+}
+
+func (s *authService) RegenerateRecoveryCodes(
+	ctx context.Context,
+	id int32,
+	request *model.TOTPCodeRequest,
+) (*model.RecoveryCodes, error) {
+	user, err := s.getUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if !user.TOTPEnabled {
+		return nil, ErrTOTPNotEnabled
+	}
+
+	if err := s.verifySecondFactorLimited(ctx, user, request.Code); err != nil {
+		return nil, err
+	}
+
+	var codes []string
+	if err := s.userRepo.WithTx(ctx, func(ctx context.Context, userRepo repo.UserRepo) error {
+		codes, err = s.replaceRecoveryCodes(ctx, userRepo, id)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	return &model.RecoveryCodes{Codes: codes}, nil
+}
+
+func (s *authService) RemoveTOTP(
+	ctx context.Context,
+	id int32,
+	request *model.TOTPCodeRequest,
+) error {
+	user, err := s.getUser(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if !user.TOTPEnabled {
+		return ErrTOTPNotEnabled
+	}
+
+	if err := s.verifySecondFactorLimited(ctx, user, request.Code); err != nil {
+		return err
+	}
+
+	return s.userRepo.WithTx(ctx, func(ctx context.Context, userRepo repo.UserRepo) error {
+		if err := userRepo.UpdateTOTP(ctx, id, nil, false); err != nil {
+			return fmt.Errorf("failed to update totp: %w", err)
+		}
+
+		if err := userRepo.DeleteRecoveryCodes(ctx, id); err != nil {
+			return fmt.Errorf("failed to delete recovery codes: %w", err)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,83 @@
+package signer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signer creates url-safe expiring tokens for links sent by email.
+// Purpose is mixed into signature, so token for one action
+// can't be used for another.
+type Signer interface {
+	Sign(purpose, value string, expiration time.Duration) string
+	Unsign(purpose, signed string) (string, error)
+}
+
+type hmacSigner struct {
+	secret []byte
+}
+
+func NewHMACSigner(secret []byte) Signer {
+	return &hmacSigner{secret: secret}
+}
+
+var (
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrSignatureExpired = errors.New("signature expired")
+)
+
+var encoding = base64.RawURLEncoding
+
+func (s *hmacSigner) mac(purpose, value, exp string) []byte {
+	m := hmac.New(sha256.New, s.secret)
+	m.Write([]byte(purpose))
+	m.Write([]byte{0})
+	m.Write([]byte(value))
+	m.Write([]byte{0})
+	m.Write([]byte(exp))
+	return m.Sum(nil)
+}
+
+func (s *hmacSigner) Sign(purpose, value string, expiration time.Duration) string {
+	exp := strconv.FormatInt(time.Now().Add(expiration).Unix(), 36)
+	return encoding.EncodeToString([]byte(value)) +
+		"." + exp +
+		"." + encoding.EncodeToString(s.mac(purpose, value, exp))
+}
+
+func (s *hmacSigner) Unsign(purpose, signed string) (string, error) {
+	parts := strings.Split(signed, ".")
+	if len(parts) != 3 {
+		return "", ErrInvalidSignature
+	}
+
+	value, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return "", ErrInvalidSignature
+	}
+
+	sig, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrInvalidSignature
+	}
+
+	if !hmac.Equal(sig, s.mac(purpose, string(value), parts[1])) {
+		return "", ErrInvalidSignature
+	}
+
+	exp, err := strconv.ParseInt(parts[1], 36, 64)
+	if err != nil {
+		return "", ErrInvalidSignature
+	}
+
+	if time.Now().Unix() > exp {
+		return "", ErrSignatureExpired
+	}
+
+	return string(value), nil
+}
@@ -0,0 +1,43 @@
+package signer
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSigner(t *testing.T) {
+	s := NewHMACSigner([]byte("secret"))
+
+	signed := s.Sign("verify_email", "1:test@test.com", time.Hour)
+
+	value, err := s.Unsign("verify_email", signed)
+	if err != nil {
+		t.Fatalf("got err = %v", err)
+	}
+	if value != "1:test@test.com" {
+		t.Fatalf("got value = %s", value)
+	}
+
+	tests := []struct {
+		name    string
+		purpose string
+		signed  string
+		wantErr error
+	}{
+		{"Other purpose", "reset_password", signed, ErrInvalidSignature},
+		{"Tampered", "verify_email", "x" + signed, ErrInvalidSignature},
+		{"Malformed", "verify_email", "abc", ErrInvalidSignature},
+		{"Other secret", "verify_email", NewHMACSigner([]byte("other")).Sign("verify_email", "1", time.Hour), ErrInvalidSignature},
+		{"Expired", "verify_email", s.Sign("verify_email", "1", -time.Minute), ErrSignatureExpired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.Unsign(tt.purpose, tt.signed)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("%s: got err = %v, want = %v", tt.name, err, tt.wantErr)
+			}
+		})
+	}
+}
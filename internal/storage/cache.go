@@ -15,8 +15,26 @@ type CacheCmdResultInt64 interface {
 	Err() error
 }
 
+type CacheCmdResultBool interface {
+	Result() (bool, error)
+	Err() error
+}
+
 type CacheOps interface {
 	Get(context.Context, string) CacheCmdResultString
 	Set(context.Context, string, interface{}, time.Duration) CacheCmdResultString
 	Del(context.Context, ...string) CacheCmdResultInt64
+	// GetDel returns value of key and deletes it atomically.
+	GetDel(context.Context, string) CacheCmdResultString
+	// SetNX sets key only if it doesn't exist, result is false otherwise.
+	SetNX(context.Context, string, interface{}, time.Duration) CacheCmdResultBool
+	// CompareAndSwap sets key to value only if its current value is old,
+	// result is false otherwise.
+	CompareAndSwap(ctx context.Context, key, old, value string, expiration time.Duration) CacheCmdResultBool
+	// CompareAndDelete deletes key only if its current value is old,
+	// result is false otherwise.
+	CompareAndDelete(ctx context.Context, key, old string) CacheCmdResultBool
+	// IncrExpire increments key and sets its expiration atomically,
+	// so counter can't be left without expiration.
+	IncrExpire(context.Context, string, time.Duration) CacheCmdResultInt64
 }
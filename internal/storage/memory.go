@@ -4,10 +4,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strconv"
+	"sync"
 	"time"
 )
 
+// MemoryCache is safe for concurrent use, every operation is atomic
+// like a single command of redis.
 type MemoryCache struct {
+	mu     sync.Mutex
 	memory map[string]MemoryCacheRecord
 }
 
@@ -17,11 +22,16 @@ func NewMemoryCache() CacheOps {
 	}
 }
 
+// MemoryCacheRecord without exp never expires.
 type MemoryCacheRecord struct {
 	value string
 	exp   time.Time
 }
 
+func (r MemoryCacheRecord) expired() bool {
+	return !r.exp.IsZero() && time.Now().After(r.exp)
+}
+
 type MemoryCacheResultString struct {
 	value string
 	err   error
@@ -48,11 +58,27 @@ func (r *MemoryCacheResultInt64) Err() error {
 	return r.err
 }
 
+type MemoryCacheResultBool struct {
+	value bool
+	err   error
+}
+
+func (r *MemoryCacheResultBool) Result() (bool, error) {
+	return r.value, r.err
+}
+
+func (r *MemoryCacheResultBool) Err() error {
+	return r.err
+}
+
 var (
 	ErrNil = errors.New("nil")
 )
 
 func (r *MemoryCache) Get(ctx context.Context, key string) CacheCmdResultString {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	record, ok := r.memory[key]
 	if !ok {
 		return &MemoryCacheResultString{
@@ -60,7 +86,7 @@ func (r *MemoryCache) Get(ctx context.Context, key string) CacheCmdResultString
 		}
 	}
 
-	if time.Now().After(record.exp) {
+	if record.expired() {
 		return &MemoryCacheResultString{
 			err: ErrNil,
 		}
@@ -77,7 +103,21 @@ func (r *MemoryCache) Set(
 	value interface{},
 	expiration time.Duration,
 ) CacheCmdResultString {
-	exp := time.Now().Add(expiration)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.set(key, value, expiration)
+}
+
+func (r *MemoryCache) set(
+	key string,
+	value interface{},
+	expiration time.Duration,
+) CacheCmdResultString {
+	var exp time.Time
+	if expiration > 0 {
+		exp = time.Now().Add(expiration)
+	}
 	s := fmt.Sprintf("%v", value)
 	r.memory[key] = MemoryCacheRecord{
 		value: s,
@@ -93,10 +133,15 @@ func (r *MemoryCache) Del(
 	ctx context.Context,
 	keys ...string,
 ) CacheCmdResultInt64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	var v int64
 	for _, key := range keys {
-		if _, ok := r.memory[key]; ok {
-			v += 1
+		if record, ok := r.memory[key]; ok {
+			if !record.expired() {
+				v += 1
+			}
 			delete(r.memory, key)
 		}
 	}
@@ -104,3 +149,115 @@ func (r *MemoryCache) Del(
 		value: v,
 	}
 }
+
+func (r *MemoryCache) GetDel(ctx context.Context, key string) CacheCmdResultString {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	record, ok := r.memory[key]
+	if !ok {
+		return &MemoryCacheResultString{
+			err: ErrNil,
+		}
+	}
+
+	delete(r.memory, key)
+	if record.expired() {
+		return &MemoryCacheResultString{
+			err: ErrNil,
+		}
+	}
+
+	return &MemoryCacheResultString{
+		value: record.value,
+	}
+}
+
+func (r *MemoryCache) SetNX(
+	ctx context.Context,
+	key string,
+	value interface{},
+	expiration time.Duration,
+) CacheCmdResultBool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if record, ok := r.memory[key]; ok && !record.expired() {
+		return &MemoryCacheResultBool{
+			value: false,
+		}
+	}
+
+	r.set(key, value, expiration)
+	return &MemoryCacheResultBool{
+		value: true,
+	}
+}
+
+func (r *MemoryCache) CompareAndSwap(
+	ctx context.Context,
+	key, old, value string,
+	expiration time.Duration,
+) CacheCmdResultBool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	record, ok := r.memory[key]
+	if !ok || record.expired() || record.value != old {
+		return &MemoryCacheResultBool{
+			value: false,
+		}
+	}
+
+	r.set(key, value, expiration)
+	return &MemoryCacheResultBool{
+		value: true,
+	}
+}
+
+func (r *MemoryCache) CompareAndDelete(ctx context.Context, key, old string) CacheCmdResultBool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	record, ok := r.memory[key]
+	if !ok || record.expired() || record.value != old {
+		return &MemoryCacheResultBool{
+			value: false,
+		}
+	}
+
+	delete(r.memory, key)
+	return &MemoryCacheResultBool{
+		value: true,
+	}
+}
+
+func (r *MemoryCache) IncrExpire(
+	ctx context.Context,
+	key string,
+	expiration time.Duration,
+) CacheCmdResultInt64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	record, ok := r.memory[key]
+	if !ok || record.expired() {
+		record = MemoryCacheRecord{value: "0"}
+	}
+
+	v, err := strconv.ParseInt(record.value, 10, 64)
+	if err != nil {
+		return &MemoryCacheResultInt64{
+			err: err,
+		}
+	}
+
+	v += 1
+	record.value = strconv.FormatInt(v, 10)
+	record.exp = time.Now().Add(expiration)
+	r.memory[key] = record
+
+	return &MemoryCacheResultInt64{
+		value: v,
+	}
+}
@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryCacheExpiration(t *testing.T) {
+	cache := NewMemoryCache()
+
+	require.NoError(t, cache.Set(t.Context(), "key", 1, time.Millisecond).Err())
+	v, err := cache.Get(t.Context(), "key").Result()
+	require.NoError(t, err)
+	require.Equal(t, "1", v)
+
+	time.Sleep(2 * time.Millisecond)
+	require.ErrorIs(t, cache.Get(t.Context(), "key").Err(), ErrNil)
+
+	// expired key can be set again
+	ok, err := cache.SetNX(t.Context(), "key", 2, 0).Result()
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok, err = cache.SetNX(t.Context(), "key", 3, 0).Result()
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestMemoryCacheIncrExpire(t *testing.T) {
+	cache := NewMemoryCache().(*MemoryCache)
+
+	for want := range int64(3) {
+		v, err := cache.IncrExpire(t.Context(), "counter", time.Minute).Result()
+		require.NoError(t, err)
+		require.Equal(t, want+1, v)
+	}
+
+	// every increment extends expiration
+	record := cache.memory["counter"]
+	require.WithinDuration(t, time.Now().Add(time.Minute), record.exp, time.Second)
+
+	v, err := cache.IncrExpire(t.Context(), "counter", time.Millisecond).Result()
+	require.NoError(t, err)
+	require.Equal(t, int64(4), v)
+
+	// counter starts over after expiration
+	time.Sleep(2 * time.Millisecond)
+	v, err = cache.IncrExpire(t.Context(), "counter", time.Minute).Result()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), v)
+
+	require.NoError(t, cache.Set(t.Context(), "text", "a", 0).Err())
+	require.Error(t, cache.IncrExpire(t.Context(), "text", time.Minute).Err())
+}
+
+func TestMemoryCacheCompareAndSwap(t *testing.T) {
+	cache := NewMemoryCache()
+	require.NoError(t, cache.Set(t.Context(), "key", "a", 0).Err())
+
+	tests := []struct {
+		name     string
+		key      string
+		old      string
+		expected bool
+		value    string
+	}{
+		{"mismatch", "key", "b", false, "a"},
+		{"match", "key", "a", true, "c"},
+		{"old value after swap", "key", "a", false, "c"},
+		{"missing key", "missing", "", false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := cache.CompareAndSwap(t.Context(), tt.key, tt.old, "c", time.Minute).Result()
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, ok)
+
+			value, _ := cache.Get(t.Context(), tt.key).Result()
+			require.Equal(t, tt.value, value)
+		})
+	}
+
+	// expired key is missing
+	require.NoError(t, cache.Set(t.Context(), "expired", "a", time.Millisecond).Err())
+	time.Sleep(2 * time.Millisecond)
+	ok, err := cache.CompareAndSwap(t.Context(), "expired", "a", "b", time.Minute).Result()
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestMemoryCacheDel(t *testing.T) {
+	cache := NewMemoryCache()
+	require.NoError(t, cache.Set(t.Context(), "a", 1, 0).Err())
+	require.NoError(t, cache.Set(t.Context(), "expired", 1, time.Millisecond).Err())
+	time.Sleep(2 * time.Millisecond)
+
+	// expired key is not counted as deleted
+	n, err := cache.Del(t.Context(), "a", "expired", "missing").Result()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), n)
+
+	n, err = cache.Del(t.Context(), "a").Result()
+	require.NoError(t, err)
+	require.Zero(t, n)
+}
+
+func TestMemoryCacheCompareAndDelete(t *testing.T) {
+	cache := NewMemoryCache()
+	require.NoError(t, cache.Set(t.Context(), "key", "a", 0).Err())
+
+	tests := []struct {
+		name     string
+		key      string
+		old      string
+		expected bool
+		exists   bool
+	}{
+		{"mismatch", "key", "b", false, true},
+		{"match", "key", "a", true, false},
+		{"already deleted", "key", "a", false, false},
+		{"missing key", "missing", "", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := cache.CompareAndDelete(t.Context(), tt.key, tt.old).Result()
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, ok)
+
+			err = cache.Get(t.Context(), tt.key).Err()
+			if tt.exists {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, ErrNil)
+			}
+		})
+	}
+
+	// expired key is missing
+	require.NoError(t, cache.Set(t.Context(), "expired", "a", time.Millisecond).Err())
+	time.Sleep(2 * time.Millisecond)
+	ok, err := cache.CompareAndDelete(t.Context(), "expired", "a").Result()
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestMemoryCacheGetDel(t *testing.T) {
+	cache := NewMemoryCache()
+	require.NoError(t, cache.Set(t.Context(), "key", "a", 0).Err())
+
+	v, err := cache.GetDel(t.Context(), "key").Result()
+	require.NoError(t, err)
+	require.Equal(t, "a", v)
+
+	require.ErrorIs(t, cache.GetDel(t.Context(), "key").Err(), ErrNil)
+	require.ErrorIs(t, cache.Get(t.Context(), "key").Err(), ErrNil)
+
+	require.NoError(t, cache.Set(t.Context(), "expired", "a", time.Millisecond).Err())
+	time.Sleep(2 * time.Millisecond)
+	require.ErrorIs(t, cache.GetDel(t.Context(), "expired").Err(), ErrNil)
+}
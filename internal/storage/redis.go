@@ -54,3 +54,68 @@ func (r *RedisCacheWrapper) Set(
 func (r *RedisCacheWrapper) Del(ctx context.Context, keys ...string) CacheCmdResultInt64 {
 	return r.client.Del(ctx, keys...)
 }
+
+func (r *RedisCacheWrapper) GetDel(ctx context.Context, key string) CacheCmdResultString {
+	return r.client.GetDel(ctx, key)
+}
+
+func (r *RedisCacheWrapper) SetNX(
+	ctx context.Context,
+	key string,
+	value interface{},
+	expiration time.Duration,
+) CacheCmdResultBool {
+	return r.client.SetNX(ctx, key, value, expiration)
+}
+
+var compareAndSwapScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+return 1
+`)
+
+func (r *RedisCacheWrapper) CompareAndSwap(
+	ctx context.Context,
+	key, old, value string,
+	expiration time.Duration,
+) CacheCmdResultBool {
+	v, err := compareAndSwapScript.Run(
+		ctx,
+		r.client,
+		[]string{key},
+		old,
+		value,
+		expiration.Milliseconds(),
+	).Int64()
+	return redis.NewBoolResult(v == 1, err)
+}
+
+var compareAndDeleteScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call("DEL", KEYS[1])
+return 1
+`)
+
+func (r *RedisCacheWrapper) CompareAndDelete(ctx context.Context, key, old string) CacheCmdResultBool {
+	v, err := compareAndDeleteScript.Run(ctx, r.client, []string{key}, old).Int64()
+	return redis.NewBoolResult(v == 1, err)
+}
+
+var incrExpireScript = redis.NewScript(`
+local v = redis.call("INCR", KEYS[1])
+redis.call("PEXPIRE", KEYS[1], ARGV[1])
+return v
+`)
+
+func (r *RedisCacheWrapper) IncrExpire(
+	ctx context.Context,
+	key string,
+	expiration time.Duration,
+) CacheCmdResultInt64 {
+	v, err := incrExpireScript.Run(ctx, r.client, []string{key}, expiration.Milliseconds()).Int64()
+	return redis.NewIntResult(v, err)
+}
@@ -0,0 +1,76 @@
+package token
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	AlgorithmEdDSA = "EdDSA"
+	AlgorithmRS256 = "RS256"
+	AlgorithmPS256 = "PS256"
+	AlgorithmES256 = "ES256"
+)
+
+var ErrUnsupportedAlgorithm = errors.New("unsupported jwt algorithm")
+
+func signingMethod(algorithm string) (jwt.SigningMethod, error) {
+	switch algorithm {
+	case AlgorithmEdDSA:
+		return jwt.SigningMethodEdDSA, nil
+	case AlgorithmRS256:
+		return jwt.SigningMethodRS256, nil
+	case AlgorithmPS256:
+		return jwt.SigningMethodPS256, nil
+	case AlgorithmES256:
+		return jwt.SigningMethodES256, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, algorithm)
+	}
+}
+
+// keyAlgorithm returns algorithm for public key, rsaAlgorithm is used
+// for RSA keys since they can be used both with RS256 and PS256.
+func keyAlgorithm(publicKey crypto.PublicKey, rsaAlgorithm string) (string, error) {
+	switch key := publicKey.(type) {
+	case ed25519.PublicKey:
+		return AlgorithmEdDSA, nil
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return "", fmt.Errorf("%w: ecdsa curve %s", ErrUnsupportedAlgorithm, key.Curve.Params().Name)
+		}
+		return AlgorithmES256, nil
+	case *rsa.PublicKey:
+		if rsaAlgorithm == AlgorithmPS256 {
+			return AlgorithmPS256, nil
+		}
+		return AlgorithmRS256, nil
+	default:
+		return "", fmt.Errorf("%w: key type %T", ErrUnsupportedAlgorithm, publicKey)
+	}
+}
+
+// checkKeyAlgorithm returns error if key can't be used with algorithm.
+func checkKeyAlgorithm(algorithm string, publicKey crypto.PublicKey) error {
+	if _, err := signingMethod(algorithm); err != nil {
+		return err
+	}
+
+	expected, err := keyAlgorithm(publicKey, algorithm)
+	if err != nil {
+		return err
+	}
+
+	if expected != algorithm {
+		return fmt.Errorf("%w: %s key can't be used with %s", ErrUnsupportedAlgorithm, expected, algorithm)
+	}
+
+	return nil
+}
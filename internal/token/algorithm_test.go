@@ -0,0 +1,89 @@
+package token_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pegov/fauth-backend-go/internal/token"
+)
+
+func TestAlgorithms(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tests := []struct {
+		algorithm  string
+		privateKey crypto.Signer
+		kty        string
+	}{
+		{token.AlgorithmRS256, rsaKey, "RSA"},
+		{token.AlgorithmPS256, rsaKey, "RSA"},
+		{token.AlgorithmES256, ecdsaKey, "EC"},
+	}
+
+	payload := token.User{ID: 1, Username: "user", Roles: []string{}}
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			keyring, err := token.NewKeyring(token.Key{
+				Kid:        "1",
+				Algorithm:  tt.algorithm,
+				PrivateKey: tt.privateKey,
+				PublicKey:  tt.privateKey.Public(),
+			})
+			require.NoError(t, err)
+			backend := token.NewJwtBackend(keyring, token.DefaultClaimsOptions)
+
+			accessToken, err := backend.Encode(&payload, time.Minute, token.AccessTokenType)
+			require.NoError(t, err)
+
+			claims, err := backend.Decode(accessToken, token.AccessTokenType)
+			require.NoError(t, err)
+			require.Equal(t, payload.ID, claims.UserID)
+
+			jwks := backend.JWKS()
+			require.Len(t, jwks.Keys, 1)
+			require.Equal(t, tt.kty, jwks.Keys[0].Kty)
+			require.Equal(t, tt.algorithm, jwks.Keys[0].Alg)
+		})
+	}
+}
+
+func TestAlgorithmMismatch(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	payload := token.User{ID: 1, Username: "user", Roles: []string{}}
+
+	newBackend := func(algorithm string) token.JwtBackend {
+		keyring, err := token.NewKeyring(token.Key{
+			Kid:        "1",
+			Algorithm:  algorithm,
+			PrivateKey: rsaKey,
+			PublicKey:  rsaKey.Public(),
+		})
+		require.NoError(t, err)
+		return token.NewJwtBackend(keyring, token.DefaultClaimsOptions)
+	}
+
+	accessToken, err := newBackend(token.AlgorithmRS256).Encode(&payload, time.Minute, token.AccessTokenType)
+	require.NoError(t, err)
+
+	_, err = newBackend(token.AlgorithmPS256).Decode(accessToken, token.AccessTokenType)
+	require.ErrorIs(t, err, token.ErrJwtDecodeInvalidToken)
+
+	_, err = token.NewKeyring(token.Key{
+		Kid:        "1",
+		Algorithm:  token.AlgorithmEdDSA,
+		PrivateKey: rsaKey,
+		PublicKey:  rsaKey.Public(),
+	})
+	require.ErrorIs(t, err, token.ErrUnsupportedAlgorithm)
+}
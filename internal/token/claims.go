@@ -7,32 +7,49 @@ import (
 const (
 	AccessTokenType  = "access"
 	RefreshTokenType = "refresh"
+	// MFATokenType is issued after password check when 2fa is enabled,
+	// it can only be exchanged for access and refresh tokens at /login/2fa
+	MFATokenType = "mfa"
 )
 
 type TokenHeader struct {
 	Kid string `json:"kid"`
 }
 
+// UserClaims contains registered claims (iss, sub, aud, exp, nbf, iat, jti)
+// and user data. ID of registered claims is jti, user id is UserID.
 type UserClaims struct {
-	Iat      int64    `json:"iat"`
-	Exp      int64    `json:"exp"`
 	Type     string   `json:"type"`
-	ID       int32    `json:"id"`
+	UserID   int32    `json:"id"`
 	Username string   `json:"username"`
 	Roles    []string `json:"roles"`
+	// Permissions of all roles, resolved when token is issued
+	Permissions []string `json:"perms,omitempty"`
+	// SessionID is shared by tokens issued for the same login,
+	// refresh tokens rotated in session form one family
+	SessionID string `json:"sid,omitempty"`
 	jwt.RegisteredClaims
 }
 
 type User struct {
-	ID       int32    `json:"id"`
-	Username string   `json:"username"`
-	Roles    []string `json:"roles"`
+	ID          int32    `json:"id"`
+	Username    string   `json:"username"`
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+	SessionID   string   `json:"sid,omitempty"`
 }
 
 func UserPayloadFromUserClaims(p *UserClaims) *User {
+	permissions := p.Permissions
+	if permissions == nil {
+		permissions = []string{}
+	}
+
 	return &User{
-		ID:       p.ID,
-		Username: p.Username,
-		Roles:    p.Roles,
+		ID:          p.UserID,
+		Username:    p.Username,
+		Roles:       p.Roles,
+		Permissions: permissions,
+		SessionID:   p.SessionID,
 	}
 }
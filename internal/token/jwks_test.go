@@ -0,0 +1,58 @@
+package token_test
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pegov/fauth-backend-go/internal/token"
+)
+
+func TestJWKSEd25519(t *testing.T) {
+	// RFC 8037 appendix A.1, A.2 and A.3
+	seed, err := base64.RawURLEncoding.DecodeString("nWGxne_9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A")
+	require.NoError(t, err)
+	privateKey := ed25519.NewKeyFromSeed(seed)
+	x := "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"
+	thumbprint := "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k"
+
+	// kid is not set, thumbprint is used
+	root := t.TempDir()
+	source := token.KeyringSource{
+		PrivateKeyPath: filepath.Join(root, "private.pem"),
+		PublicKeyPath:  filepath.Join(root, "public.pem"),
+	}
+	writeKey(t, token.Key{
+		PrivateKey: privateKey,
+		PublicKey:  privateKey.Public(),
+	}, source.PrivateKeyPath, source.PublicKeyPath)
+
+	keyring, err := token.LoadKeyring(source)
+	require.NoError(t, err)
+	jwks := token.NewJwtBackend(keyring, token.DefaultClaimsOptions).JWKS()
+
+	require.Equal(t, []token.JWK{{
+		Kty: "OKP",
+		Crv: "Ed25519",
+		X:   x,
+		Kid: thumbprint,
+		Use: "sig",
+		Alg: token.AlgorithmEdDSA,
+	}}, jwks.Keys)
+
+	// members of other key types are omitted
+	data, err := json.Marshal(jwks.Keys[0])
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"kty": "OKP",
+		"crv": "Ed25519",
+		"x": "`+x+`",
+		"kid": "`+thumbprint+`",
+		"use": "sig",
+		"alg": "EdDSA"
+	}`, string(data))
+}
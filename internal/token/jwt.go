@@ -2,10 +2,12 @@ package token
 
 import (
 	"crypto/ed25519"
-	"crypto/x509"
-	"encoding/pem"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
-	"log"
+	"slices"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -13,51 +15,84 @@ import (
 
 type JwtBackend interface {
 	Encode(payload *User, exp time.Duration, tokenType string) (string, error)
+	// EncodeRefresh returns refresh token and its jti.
+	EncodeRefresh(payload *User, exp time.Duration) (string, string, error)
 	Decode(token string, tokenType string) (*UserClaims, error)
+	JWKS() *JWKS
+	Keyring() *Keyring
+	// SetKeyring replaces keys, it is safe to call concurrently
+	// with Encode and Decode.
+	SetKeyring(keyring *Keyring)
+}
+
+// ClaimsOptions sets iss and aud of issued tokens and allow-lists
+// checked by Decode. Token is accepted if its iss is in AllowedIssuers
+// and at least one of its aud is in AllowedAudiences, empty allow-lists
+// default to Issuer and Audience, so each consumer can accept
+// only tokens minted for it.
+type ClaimsOptions struct {
+	Issuer           string
+	Audience         []string
+	AllowedIssuers   []string
+	AllowedAudiences []string
+}
+
+// DefaultClaimsOptions is used by NewJwtBackendRaw.
+var DefaultClaimsOptions = ClaimsOptions{
+	Issuer:   "fauth",
+	Audience: []string{"fauth"},
 }
 
 type jwtBackend struct {
-	PrivateKey ed25519.PrivateKey
-	PublicKey  ed25519.PublicKey
-	CurrentKid string
+	keyring          atomic.Pointer[Keyring]
+	issuer           string
+	audience         []string
+	allowedIssuers   []string
+	allowedAudiences []string
 }
 
-func NewJwtBackend(
-	privateKeyBytes []byte,
-	publicKeyBytes []byte,
-	currentKid string,
-) JwtBackend {
-	privateBlock, _ := pem.Decode(privateKeyBytes)
-	privateParsed, err := x509.ParsePKCS8PrivateKey(privateBlock.Bytes)
-	if err != nil {
-		log.Fatalln(err)
+func NewJwtBackend(keyring *Keyring, options ClaimsOptions) JwtBackend {
+	backend := &jwtBackend{
+		issuer:           options.Issuer,
+		audience:         options.Audience,
+		allowedIssuers:   options.AllowedIssuers,
+		allowedAudiences: options.AllowedAudiences,
 	}
-	privateKey := privateParsed.(ed25519.PrivateKey)
-
-	publicBlock, _ := pem.Decode(publicKeyBytes)
-	publicParsed, _ := x509.ParsePKIXPublicKey(publicBlock.Bytes)
-	if err != nil {
-		log.Fatalln(err)
+	if len(backend.allowedIssuers) == 0 {
+		backend.allowedIssuers = []string{options.Issuer}
 	}
-	publicKey := publicParsed.(ed25519.PublicKey)
-
-	return &jwtBackend{
-		PrivateKey: privateKey,
-		PublicKey:  publicKey,
-		CurrentKid: currentKid,
+	if len(backend.allowedAudiences) == 0 {
+		backend.allowedAudiences = options.Audience
 	}
+	backend.keyring.Store(keyring)
+	return backend
+}
+
+func (backend *jwtBackend) Keyring() *Keyring {
+	return backend.keyring.Load()
 }
 
+func (backend *jwtBackend) SetKeyring(keyring *Keyring) {
+	backend.keyring.Store(keyring)
+}
+
+// NewJwtBackendRaw creates backend with single ed25519 key, panics on invalid key.
 func NewJwtBackendRaw(
 	privateKeyBytesRaw,
 	publicKeyBytesRaw []byte,
 	currentKid string,
 ) JwtBackend {
-	return &jwtBackend{
-		PrivateKey: privateKeyBytesRaw,
-		PublicKey:  publicKeyBytesRaw,
-		CurrentKid: currentKid,
+	keyring, err := NewKeyring(Key{
+		Kid:        currentKid,
+		Algorithm:  AlgorithmEdDSA,
+		PrivateKey: ed25519.PrivateKey(privateKeyBytesRaw),
+		PublicKey:  ed25519.PublicKey(publicKeyBytesRaw),
+	})
+	if err != nil {
+		panic(err)
 	}
+
+	return NewJwtBackend(keyring, DefaultClaimsOptions)
 }
 
 func (backend *jwtBackend) Encode(
@@ -65,34 +100,71 @@ func (backend *jwtBackend) Encode(
 	expiration time.Duration,
 	tokenType string,
 ) (string, error) {
-	token := jwt.New(jwt.SigningMethodEdDSA)
-	token.Header["kid"] = backend.CurrentKid
+	tokenString, _, err := backend.encode(payload, expiration, tokenType)
+	return tokenString, err
+}
+
+func (backend *jwtBackend) EncodeRefresh(
+	payload *User,
+	expiration time.Duration,
+) (string, string, error) {
+	return backend.encode(payload, expiration, RefreshTokenType)
+}
+
+func (backend *jwtBackend) encode(
+	payload *User,
+	expiration time.Duration,
+	tokenType string,
+) (string, string, error) {
+	signing := backend.keyring.Load().SigningKey()
+	method, err := signingMethod(signing.Algorithm)
+	if err != nil {
+		return "", "", err
+	}
+
+	token := jwt.New(method)
+	token.Header["kid"] = signing.Kid
 
 	claims := UserClaims{
-		ID:       payload.ID,
-		Username: payload.Username,
-		Roles:    payload.Roles,
+		UserID:      payload.ID,
+		Username:    payload.Username,
+		Roles:       payload.Roles,
+		Permissions: payload.Permissions,
+		SessionID:   payload.SessionID,
+	}
+	jti, err := newJTI()
+	if err != nil {
+		return "", "", err
 	}
+
 	iat := time.Now()
 	exp := iat.Add(expiration)
+	claims.Issuer = backend.issuer
+	claims.Audience = backend.audience
+	claims.Subject = strconv.Itoa(int(payload.ID))
+	claims.ID = jti
 	claims.IssuedAt = jwt.NewNumericDate(iat)
+	claims.NotBefore = jwt.NewNumericDate(iat)
 	claims.ExpiresAt = jwt.NewNumericDate(exp)
 	claims.Type = tokenType
 
 	token.Claims = claims
 
-	tokenString, err := token.SignedString(backend.PrivateKey)
+	tokenString, err := token.SignedString(signing.PrivateKey)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
-	return tokenString, nil
+	return tokenString, jti, nil
 }
 
 var (
 	ErrJwtDecodeMissingKid       = errors.New("jwt decode missing kid")
 	ErrJwtDecodeInvalidKid       = errors.New("jwt decode invalid kid")
+	ErrJwtDecodeInvalidAlgorithm = errors.New("jwt decode invalid algorithm")
 	ErrJwtDecodeInvalidToken     = errors.New("jwt decode invalid token")
+	ErrJwtDecodeInvalidIssuer    = errors.New("jwt decode invalid issuer")
+	ErrJwtDecodeInvalidAudience  = errors.New("jwt decode invalid audience")
 	ErrJwtDecodeInvalidTokenType = errors.New("jwt decode invalid token type")
 )
 
@@ -100,31 +172,73 @@ func (backend *jwtBackend) Decode(
 	tokenString string,
 	tokenType string,
 ) (*UserClaims, error) {
+	keyring := backend.keyring.Load()
 	var payload UserClaims
 	token, err := jwt.ParseWithClaims(
 		tokenString,
 		&payload,
 		func(t *jwt.Token) (any, error) {
-			kid, ok := t.Header["kid"]
+			kid, ok := t.Header["kid"].(string)
 			if !ok {
 				return nil, ErrJwtDecodeMissingKid
 			}
 
-			if kid != backend.CurrentKid {
+			key, ok := keyring.Key(kid)
+			if !ok {
 				return nil, ErrJwtDecodeInvalidKid
 			}
 
-			return backend.PublicKey, nil
+			// alg from header must match key, otherwise
+			// token could be verified with unexpected algorithm
+			if t.Method.Alg() != key.Algorithm {
+				return nil, ErrJwtDecodeInvalidAlgorithm
+			}
+
+			return key.PublicKey, nil
 		},
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
 	)
 
 	if err != nil || !token.Valid {
 		return nil, ErrJwtDecodeInvalidToken
 	}
 
+	if !slices.Contains(backend.allowedIssuers, payload.Issuer) {
+		return nil, ErrJwtDecodeInvalidIssuer
+	}
+
+	if !slices.ContainsFunc(payload.Audience, func(aud string) bool {
+		return slices.Contains(backend.allowedAudiences, aud)
+	}) {
+		return nil, ErrJwtDecodeInvalidAudience
+	}
+
 	if payload.Type != tokenType {
 		return nil, ErrJwtDecodeInvalidTokenType
 	}
 
 	return &payload, nil
 }
+
+// JWKS returns public keys that can be used to verify tokens.
+func (backend *jwtBackend) JWKS() *JWKS {
+	keyring := backend.keyring.Load()
+	kids := keyring.Kids()
+	keys := make([]JWK, 0, len(kids))
+	for _, kid := range kids {
+		key, _ := keyring.Key(kid)
+		keys = append(keys, newJWK(key))
+	}
+
+	return &JWKS{Keys: keys}
+}
+
+func newJTI() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,57 @@
+package token_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pegov/fauth-backend-go/internal/token"
+)
+
+func TestRegisteredClaims(t *testing.T) {
+	keyring, err := token.NewKeyring(newKey(t, "1", "a"))
+	require.NoError(t, err)
+	payload := token.User{ID: 42, Username: "user", Roles: []string{}}
+
+	backend := token.NewJwtBackend(keyring, token.ClaimsOptions{
+		Issuer:   "fauth",
+		Audience: []string{"api"},
+	})
+
+	accessToken, err := backend.Encode(&payload, time.Minute, token.AccessTokenType)
+	require.NoError(t, err)
+
+	claims, err := backend.Decode(accessToken, token.AccessTokenType)
+	require.NoError(t, err)
+	require.Equal(t, "fauth", claims.Issuer)
+	require.Equal(t, "42", claims.Subject)
+	require.Equal(t, []string{"api"}, []string(claims.Audience))
+	require.NotEmpty(t, claims.ID)
+	require.NotNil(t, claims.NotBefore)
+	require.NotNil(t, claims.ExpiresAt)
+
+	other, err := backend.Encode(&payload, time.Minute, token.AccessTokenType)
+	require.NoError(t, err)
+	otherClaims, err := backend.Decode(other, token.AccessTokenType)
+	require.NoError(t, err)
+	require.NotEqual(t, claims.ID, otherClaims.ID)
+
+	// token minted for "api" is not accepted by consumer of "billing"
+	_, err = token.NewJwtBackend(keyring, token.ClaimsOptions{
+		Issuer:   "fauth",
+		Audience: []string{"billing"},
+	}).Decode(accessToken, token.AccessTokenType)
+	require.ErrorIs(t, err, token.ErrJwtDecodeInvalidAudience)
+
+	_, err = token.NewJwtBackend(keyring, token.ClaimsOptions{
+		Issuer:           "other",
+		AllowedAudiences: []string{"billing", "api"},
+	}).Decode(accessToken, token.AccessTokenType)
+	require.ErrorIs(t, err, token.ErrJwtDecodeInvalidIssuer)
+
+	expired, err := backend.Encode(&payload, -time.Minute, token.AccessTokenType)
+	require.NoError(t, err)
+	_, err = backend.Decode(expired, token.AccessTokenType)
+	require.ErrorIs(t, err, token.ErrJwtDecodeInvalidToken)
+}
@@ -0,0 +1,298 @@
+package token
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Key is signing key if PrivateKey is set, verify-only key otherwise.
+// Algorithm is derived from key type if empty.
+type Key struct {
+	Kid        string
+	Algorithm  string
+	PrivateKey crypto.Signer
+	PublicKey  crypto.PublicKey
+}
+
+// Keyring holds one signing key and verify-only keys of previous
+// (or next) rotations. Key is rotated by moving public key of current
+// signing key to verify-only keys and setting new signing key.
+// Old verify-only key can be removed once refresh tokens signed by it
+// have expired.
+type Keyring struct {
+	signing Key
+	keys    map[string]Key
+	kids    []string
+}
+
+var (
+	ErrKeyringEmptyKid     = errors.New("keyring empty kid")
+	ErrKeyringDuplicateKid = errors.New("keyring duplicate kid")
+	ErrKeyringKeyMismatch  = errors.New("keyring private and public keys mismatch")
+)
+
+func prepareKey(key Key) (Key, error) {
+	if key.Kid == "" {
+		return Key{}, ErrKeyringEmptyKid
+	}
+
+	if key.Algorithm == "" {
+		algorithm, err := keyAlgorithm(key.PublicKey, "")
+		if err != nil {
+			return Key{}, fmt.Errorf("%s: %w", key.Kid, err)
+		}
+		key.Algorithm = algorithm
+	}
+
+	if err := checkKeyAlgorithm(key.Algorithm, key.PublicKey); err != nil {
+		return Key{}, fmt.Errorf("%s: %w", key.Kid, err)
+	}
+
+	return key, nil
+}
+
+func NewKeyring(signing Key, verify ...Key) (*Keyring, error) {
+	signing, err := prepareKey(signing)
+	if err != nil {
+		return nil, err
+	}
+
+	if signing.PrivateKey == nil || !isSamePublicKey(signing.PublicKey, signing.PrivateKey.Public()) {
+		return nil, ErrKeyringKeyMismatch
+	}
+
+	keyring := &Keyring{
+		signing: signing,
+		keys:    map[string]Key{signing.Kid: signing},
+		kids:    []string{signing.Kid},
+	}
+
+	for _, key := range verify {
+		key, err := prepareKey(key)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := keyring.keys[key.Kid]; ok {
+			return nil, fmt.Errorf("%w: %s", ErrKeyringDuplicateKid, key.Kid)
+		}
+
+		key.PrivateKey = nil
+		keyring.keys[key.Kid] = key
+		keyring.kids = append(keyring.kids, key.Kid)
+	}
+
+	return keyring, nil
+}
+
+func (k *Keyring) SigningKey() Key {
+	return k.signing
+}
+
+func (k *Keyring) Key(kid string) (Key, bool) {
+	key, ok := k.keys[kid]
+	return key, ok
+}
+
+// Kids returns signing kid first, then verify-only kids.
+func (k *Keyring) Kids() []string {
+	return slices.Clone(k.kids)
+}
+
+// ParsePrivateKey parses PKCS8, PKCS1 (RSA) or SEC1 (EC) pem.
+func ParsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no pem block")
+	}
+
+	var parsed any
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", parsed)
+	}
+
+	return key, nil
+}
+
+// ParsePublicKey parses PKIX or PKCS1 (RSA) pem.
+func ParsePublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no pem block")
+	}
+
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// readPublicKey derives algorithm from key type if it is empty,
+// RSA keys get RS256.
+func readPublicKey(kid, path, algorithm string) (Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Key{}, err
+	}
+
+	publicKey, err := ParsePublicKey(data)
+	if err != nil {
+		return Key{}, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if algorithm == "" {
+		algorithm, err = keyAlgorithm(publicKey, "")
+		if err != nil {
+			return Key{}, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	return Key{Kid: kid, Algorithm: algorithm, PublicKey: publicKey}, nil
+}
+
+func isAlgorithm(value string) bool {
+	_, err := signingMethod(value)
+	return err == nil
+}
+
+// parseVerifyKey parses "<kid>:<path>" or "<kid>:<alg>:<path>".
+func parseVerifyKey(entry string) (string, string, string, error) {
+	kid, path, ok := strings.Cut(entry, ":")
+	if !ok {
+		return "", "", "", fmt.Errorf("verify key must be <kid>:[<alg>:]<path>, got %q", entry)
+	}
+
+	var algorithm string
+	if alg, rest, ok := strings.Cut(path, ":"); ok && isAlgorithm(alg) {
+		algorithm, path = alg, rest
+	}
+
+	return strings.TrimSpace(kid), algorithm, strings.TrimSpace(path), nil
+}
+
+// parseKeyFileName parses "<kid>.pem" or "<kid>.<alg>.pem".
+func parseKeyFileName(name string) (string, string) {
+	kid := strings.TrimSuffix(name, ".pem")
+	if i := strings.LastIndex(kid, "."); i != -1 && isAlgorithm(kid[i+1:]) {
+		return kid[:i], kid[i+1:]
+	}
+
+	return kid, ""
+}
+
+func isSamePublicKey(a, b crypto.PublicKey) bool {
+	key, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && key.Equal(b)
+}
+
+// KeyringSource describes where keys are loaded from.
+// Files in Dir are verify-only public keys named "<kid>.pem" or
+// "<kid>.<alg>.pem", VerifyKeys entries are "<kid>:<path>" or
+// "<kid>:<alg>:<path>". Algorithm is used for signing key only,
+// verify-only keys without alg get it from their type, RSA keys get RS256,
+// so PS256 keys must set it. Algorithm of verify-only key doesn't change
+// when signing algorithm does.
+//
+// Kid defaults to thumbprint of signing key (see Thumbprint).
+// To rotate keys put public key of current signing key into Dir under
+// its kid (and alg), then replace key files and change Kid (or leave it empty).
+// Tokens signed with old key stay valid as long as its public key is in Dir.
+type KeyringSource struct {
+	PrivateKeyPath string
+	PublicKeyPath  string
+	Kid            string
+	Algorithm      string
+	Dir            string
+	VerifyKeys     []string
+}
+
+func LoadKeyring(source KeyringSource) (*Keyring, error) {
+	privateKeyData, err := os.ReadFile(source.PrivateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, err := ParsePrivateKey(privateKeyData)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", source.PrivateKeyPath, err)
+	}
+
+	signing, err := readPublicKey(
+		strings.TrimSpace(source.Kid),
+		source.PublicKeyPath,
+		source.Algorithm,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if signing.Kid == "" {
+		signing.Kid, err = Thumbprint(signing.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	signing.Algorithm = source.Algorithm
+	signing.PrivateKey = privateKey
+
+	var verify []Key
+	if source.Dir != "" {
+		paths, err := filepath.Glob(filepath.Join(source.Dir, "*.pem"))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, path := range paths {
+			kid, algorithm := parseKeyFileName(filepath.Base(path))
+			key, err := readPublicKey(kid, path, algorithm)
+			if err != nil {
+				return nil, err
+			}
+
+			// public key of signing key may be kept in Dir, but other key
+			// under signing kid is an error, not something to skip silently
+			if kid == signing.Kid && isSamePublicKey(key.PublicKey, signing.PublicKey) {
+				continue
+			}
+
+			verify = append(verify, key)
+		}
+	}
+
+	for _, entry := range source.VerifyKeys {
+		kid, algorithm, path, err := parseVerifyKey(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := readPublicKey(kid, path, algorithm)
+		if err != nil {
+			return nil, err
+		}
+
+		verify = append(verify, key)
+	}
+
+	return NewKeyring(signing, verify...)
+}
@@ -0,0 +1,210 @@
+package token_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pegov/fauth-backend-go/internal/token"
+)
+
+func newKey(t *testing.T, kid string, seed string) token.Key {
+	t.Helper()
+
+	privateKey := ed25519.NewKeyFromSeed([]byte(strings.Repeat(seed, ed25519.SeedSize)))
+	return token.Key{
+		Kid:        kid,
+		PrivateKey: privateKey,
+		PublicKey:  privateKey.Public().(ed25519.PublicKey),
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	oldKey := newKey(t, "1", "a")
+	currentKey := newKey(t, "2", "b")
+	payload := token.User{ID: 1, Username: "user", Roles: []string{}}
+
+	oldKeyring, err := token.NewKeyring(oldKey)
+	require.NoError(t, err)
+	oldToken, err := token.NewJwtBackend(oldKeyring, token.DefaultClaimsOptions).Encode(&payload, time.Minute, token.AccessTokenType)
+	require.NoError(t, err)
+
+	// old signing key is kept for verification only
+	oldKey.PrivateKey = nil
+	keyring, err := token.NewKeyring(currentKey, oldKey)
+	require.NoError(t, err)
+	backend := token.NewJwtBackend(keyring, token.DefaultClaimsOptions)
+
+	claims, err := backend.Decode(oldToken, token.AccessTokenType)
+	require.NoError(t, err)
+	require.Equal(t, payload.ID, claims.UserID)
+
+	newToken, err := backend.Encode(&payload, time.Minute, token.AccessTokenType)
+	require.NoError(t, err)
+	_, err = backend.Decode(newToken, token.AccessTokenType)
+	require.NoError(t, err)
+
+	// old key retired
+	retiredKeyring, err := token.NewKeyring(currentKey)
+	require.NoError(t, err)
+	_, err = token.NewJwtBackend(retiredKeyring, token.DefaultClaimsOptions).Decode(oldToken, token.AccessTokenType)
+	require.ErrorIs(t, err, token.ErrJwtDecodeInvalidToken)
+
+	jwks := backend.JWKS()
+	require.Len(t, jwks.Keys, 2)
+	require.Equal(t, "2", jwks.Keys[0].Kid)
+	require.Equal(t, "1", jwks.Keys[1].Kid)
+	require.Equal(t, "OKP", jwks.Keys[0].Kty)
+}
+
+func TestKeyringDuplicateKid(t *testing.T) {
+	_, err := token.NewKeyring(newKey(t, "1", "a"), newKey(t, "1", "b"))
+	require.ErrorIs(t, err, token.ErrKeyringDuplicateKid)
+}
+
+func TestKeyringKeyMismatch(t *testing.T) {
+	key := newKey(t, "1", "a")
+	key.PublicKey = newKey(t, "1", "b").PublicKey
+
+	_, err := token.NewKeyring(key)
+	require.ErrorIs(t, err, token.ErrKeyringKeyMismatch)
+}
+
+func TestSetKeyring(t *testing.T) {
+	oldKey := newKey(t, "1", "a")
+	payload := token.User{ID: 1, Username: "user", Roles: []string{}}
+
+	oldKeyring, err := token.NewKeyring(oldKey)
+	require.NoError(t, err)
+	backend := token.NewJwtBackend(oldKeyring, token.DefaultClaimsOptions)
+
+	oldToken, err := backend.Encode(&payload, time.Minute, token.AccessTokenType)
+	require.NoError(t, err)
+
+	oldKey.PrivateKey = nil
+	keyring, err := token.NewKeyring(newKey(t, "2", "b"), oldKey)
+	require.NoError(t, err)
+	backend.SetKeyring(keyring)
+
+	_, err = backend.Decode(oldToken, token.AccessTokenType)
+	require.NoError(t, err)
+	require.Equal(t, []string{"2", "1"}, keyring.Kids())
+	require.Len(t, backend.JWKS().Keys, 2)
+}
+
+func writeKey(t *testing.T, key token.Key, privatePath, publicPath string) {
+	t.Helper()
+
+	if privatePath != "" {
+		der, err := x509.MarshalPKCS8PrivateKey(key.PrivateKey)
+		require.NoError(t, err)
+		data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		require.NoError(t, os.WriteFile(privatePath, data, 0o600))
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(key.PublicKey)
+	require.NoError(t, err)
+	data := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	require.NoError(t, os.WriteFile(publicPath, data, 0o644))
+}
+
+func TestLoadKeyringDir(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "keys")
+	require.NoError(t, os.Mkdir(dir, 0o755))
+
+	signing := newKey(t, "2", "b")
+	source := token.KeyringSource{
+		PrivateKeyPath: filepath.Join(root, "private.pem"),
+		PublicKeyPath:  filepath.Join(root, "public.pem"),
+		Kid:            "2",
+		Algorithm:      token.AlgorithmEdDSA,
+		Dir:            dir,
+	}
+	writeKey(t, signing, source.PrivateKeyPath, source.PublicKeyPath)
+	writeKey(t, newKey(t, "1", "a"), "", filepath.Join(dir, "1.pem"))
+
+	// public key of signing key in dir is skipped
+	writeKey(t, signing, "", filepath.Join(dir, "2.pem"))
+	keyring, err := token.LoadKeyring(source)
+	require.NoError(t, err)
+	require.Equal(t, []string{"2", "1"}, keyring.Kids())
+
+	// other key under signing kid
+	writeKey(t, newKey(t, "2", "c"), "", filepath.Join(dir, "2.pem"))
+	_, err = token.LoadKeyring(source)
+	require.ErrorIs(t, err, token.ErrKeyringDuplicateKid)
+}
+
+func TestThumbprint(t *testing.T) {
+	// RFC 8037 appendix A.3
+	x, err := base64.RawURLEncoding.DecodeString("11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo")
+	require.NoError(t, err)
+
+	thumbprint, err := token.Thumbprint(ed25519.PublicKey(x))
+	require.NoError(t, err)
+	require.Equal(t, "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k", thumbprint)
+}
+
+func TestLoadKeyringVerifyKeyAlgorithm(t *testing.T) {
+	newRSAKey := func(kid, algorithm string) token.Key {
+		privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		return token.Key{
+			Kid:        kid,
+			Algorithm:  algorithm,
+			PrivateKey: privateKey,
+			PublicKey:  privateKey.Public(),
+		}
+	}
+
+	oldKey := newRSAKey("1", token.AlgorithmRS256)
+	oldKeyring, err := token.NewKeyring(oldKey)
+	require.NoError(t, err)
+	payload := token.User{ID: 1, Username: "user"}
+	oldToken, err := token.NewJwtBackend(oldKeyring, token.DefaultClaimsOptions).
+		Encode(&payload, time.Minute, token.AccessTokenType)
+	require.NoError(t, err)
+
+	// signing algorithm is switched to PS256
+	root := t.TempDir()
+	dir := filepath.Join(root, "keys")
+	require.NoError(t, os.Mkdir(dir, 0o755))
+	source := token.KeyringSource{
+		PrivateKeyPath: filepath.Join(root, "private.pem"),
+		PublicKeyPath:  filepath.Join(root, "public.pem"),
+		Kid:            "2",
+		Algorithm:      token.AlgorithmPS256,
+		Dir:            dir,
+		VerifyKeys:     []string{"3:PS256:" + filepath.Join(root, "3.pem")},
+	}
+	writeKey(t, newRSAKey("2", token.AlgorithmPS256), source.PrivateKeyPath, source.PublicKeyPath)
+	writeKey(t, oldKey, "", filepath.Join(dir, "1.RS256.pem"))
+	writeKey(t, newRSAKey("3", token.AlgorithmPS256), "", filepath.Join(root, "3.pem"))
+
+	keyring, err := token.LoadKeyring(source)
+	require.NoError(t, err)
+
+	for kid, algorithm := range map[string]string{
+		"1": token.AlgorithmRS256,
+		"2": token.AlgorithmPS256,
+		"3": token.AlgorithmPS256,
+	} {
+		key, ok := keyring.Key(kid)
+		require.True(t, ok)
+		require.Equal(t, algorithm, key.Algorithm)
+	}
+
+	_, err = token.NewJwtBackend(keyring, token.DefaultClaimsOptions).Decode(oldToken, token.AccessTokenType)
+	require.NoError(t, err)
+}
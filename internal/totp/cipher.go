@@ -0,0 +1,67 @@
+package totp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+)
+
+// SecretCipher encrypts totp secrets before they are stored in the database.
+type SecretCipher interface {
+	Encrypt(secret string) (string, error)
+	Decrypt(encrypted string) (string, error)
+}
+
+type aesSecretCipher struct {
+	aead cipher.AEAD
+}
+
+var (
+	ErrDecryptSecret = errors.New("failed to decrypt totp secret")
+)
+
+// NewAESSecretCipher expects 16, 24 or 32 byte key (AES-128/192/256 GCM).
+func NewAESSecretCipher(key []byte) (SecretCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &aesSecretCipher{aead: aead}, nil
+}
+
+func (c *aesSecretCipher) Encrypt(secret string) (string, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := c.aead.Seal(nonce, nonce, []byte(secret), nil)
+	return base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+func (c *aesSecretCipher) Decrypt(encrypted string) (string, error) {
+	sealed, err := base64.RawStdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", ErrDecryptSecret
+	}
+
+	nonceSize := c.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return "", ErrDecryptSecret
+	}
+
+	secret, err := c.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return "", ErrDecryptSecret
+	}
+
+	return string(secret), nil
+}
@@ -0,0 +1,114 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerateCode(t *testing.T) {
+	// RFC 6238 Appendix B, SHA1 (truncated to 6 digits)
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+	tests := []struct {
+		ts   int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		got, err := GenerateCode(secret, time.Unix(tt.ts, 0))
+		if err != nil {
+			t.Fatalf("ts=%d: got err = %v", tt.ts, err)
+		}
+
+		if got != tt.want {
+			t.Fatalf("ts=%d: got = %s, want = %s", tt.ts, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	code, err := GenerateCode(secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !Validate(secret, code, now) {
+		t.Fatal("current code must be valid")
+	}
+
+	if !Validate(secret, code, now.Add(Period*time.Second)) {
+		t.Fatal("previous step code must be valid")
+	}
+
+	if Validate(secret, code, now.Add(3*Period*time.Second)) {
+		t.Fatal("old code must be invalid")
+	}
+
+	if Validate(secret, "12345", now) {
+		t.Fatal("short code must be invalid")
+	}
+}
+
+func TestValidateStep(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	code, err := GenerateCode(secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	step, ok := ValidateStep(secret, code, now)
+	if !ok || step != counterAt(now) {
+		t.Fatal("current code must be valid for current step")
+	}
+
+	// the same step is returned while code is accepted
+	step, ok = ValidateStep(secret, code, now.Add(Period*time.Second))
+	if !ok || step != counterAt(now) {
+		t.Fatal("previous step code must return its step")
+	}
+}
+
+func TestSecretCipher(t *testing.T) {
+	c, err := NewAESSecretCipher([]byte(strings.Repeat("k", 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := c.Encrypt("SECRET")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decrypted, err := c.Decrypt(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decrypted != "SECRET" {
+		t.Fatalf("got = %s, want = SECRET", decrypted)
+	}
+
+	if _, err := c.Decrypt(encrypted[:len(encrypted)-2]); err == nil {
+		t.Fatal("tampered secret must not be decrypted")
+	}
+}
@@ -5,15 +5,91 @@ CREATE TABLE IF NOT EXISTS auth_user(
 	password TEXT,
 	active BOOLEAN DEFAULT TRUE,
 	verified BOOLEAN DEFAULT FALSE,
+	totp_secret TEXT,
+	totp_enabled BOOLEAN NOT NULL DEFAULT FALSE,
 	created_at TIMESTAMP WITH TIME ZONE,
 	last_login TIMESTAMP WITH TIME ZONE
 );
 CREATE INDEX IF NOT EXISTS auth_user_username_idx ON auth_user(username);
 CREATE INDEX IF NOT EXISTS auth_user_email_idx ON auth_user(email);
+-- columns added after release, table above already exists in old databases
+ALTER TABLE auth_user ADD COLUMN IF NOT EXISTS totp_secret TEXT;
+ALTER TABLE auth_user ADD COLUMN IF NOT EXISTS totp_enabled BOOLEAN NOT NULL DEFAULT FALSE;
 
 CREATE TABLE IF NOT EXISTS auth_oauth(
-	user_id INTEGER PRIMARY KEY REFERENCES auth_user(id) ON DELETE CASCADE,
+	user_id INTEGER NOT NULL REFERENCES auth_user(id) ON DELETE CASCADE,
 	provider TEXT NOT NULL,
-	sid TEXT NOT NULL
+	sid TEXT NOT NULL,
+	PRIMARY KEY(user_id, provider)
 );
-CREATE INDEX IF NOT EXISTS auth_oauth_provider_sid_idx ON auth_oauth(provider, sid);
\ No newline at end of file
+-- old databases have user_id as primary key, only one provider per user
+DO $$
+DECLARE
+	pkey_name TEXT;
+BEGIN
+	SELECT conname INTO pkey_name
+	FROM pg_constraint
+	WHERE conrelid = 'auth_oauth'::regclass AND contype = 'p' AND array_length(conkey, 1) = 1;
+
+	IF pkey_name IS NOT NULL THEN
+		EXECUTE format('ALTER TABLE auth_oauth DROP CONSTRAINT %I', pkey_name);
+		ALTER TABLE auth_oauth ADD PRIMARY KEY(user_id, provider);
+	END IF;
+END $$;
+DROP INDEX IF EXISTS auth_oauth_provider_sid_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS auth_oauth_provider_sid_uniq ON auth_oauth(provider, sid);
+
+CREATE TABLE IF NOT EXISTS auth_recovery_code(
+	id SERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES auth_user(id) ON DELETE CASCADE,
+	code TEXT NOT NULL,
+	used_at TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX IF NOT EXISTS auth_recovery_code_user_id_idx ON auth_recovery_code(user_id);
+
+CREATE TABLE IF NOT EXISTS auth_role(
+	id SERIAL PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE,
+	description TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS auth_user_role(
+	user_id INTEGER NOT NULL REFERENCES auth_user(id) ON DELETE CASCADE,
+	role_id INTEGER NOT NULL REFERENCES auth_role(id) ON DELETE CASCADE,
+	PRIMARY KEY(user_id, role_id)
+);
+
+CREATE TABLE IF NOT EXISTS auth_role_permission(
+	role_id INTEGER NOT NULL REFERENCES auth_role(id) ON DELETE CASCADE,
+	permission TEXT NOT NULL,
+	PRIMARY KEY(role_id, permission)
+);
+
+-- admin role has all permissions, first admin is assigned manually,
+-- list must match model.Permissions (checked by TestAdminSeedHasAllPermissions)
+INSERT INTO auth_role(name, description) VALUES ('admin', 'Administrator') ON CONFLICT DO NOTHING;
+INSERT INTO auth_role_permission(role_id, permission)
+SELECT r.id, p.permission
+FROM auth_role r, unnest(ARRAY[
+	'users:mass_logout',
+	'users:ban',
+	'users:kick',
+	'users:roles',
+	'roles:read',
+	'roles:write'
+]) AS p(permission)
+WHERE r.name = 'admin'
+ON CONFLICT DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS auth_session(
+	id TEXT PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES auth_user(id) ON DELETE CASCADE,
+	ip TEXT NOT NULL,
+	user_agent TEXT NOT NULL,
+	device TEXT NOT NULL,
+	created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+	last_used_at TIMESTAMP WITH TIME ZONE NOT NULL,
+	expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+	revoked_at TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX IF NOT EXISTS auth_session_user_id_idx ON auth_session(user_id);